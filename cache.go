@@ -0,0 +1,440 @@
+package cppdep
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores build outputs under a key that is a hash of everything that was used
+// to build them, so that outputs can be restored rather than rebuilt.
+type Cache interface {
+	// Get restores the output stored under key to path. It returns false if there is
+	// no output stored under key.
+	Get(key, path string) (bool, error)
+
+	// Put stores the file at path under key.
+	Put(key, path string) error
+}
+
+// CacheStats are the statistics kept for a LocalCache.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Stores    int64
+	Evictions int64
+
+	// Entries and Size are computed from the contents of the cache directory
+	Entries int   `json:"-"`
+	Size    int64 `json:"-"`
+}
+
+// LocalCache is a Cache that stores outputs in a local directory. Statistics are kept
+// in memory and written to the cache directory when Flush is called.
+type LocalCache struct {
+	Dir string
+
+	// MaxSize is the maximum size in bytes of all the outputs in the cache. When Flush is
+	// called the least recently used outputs are evicted until the cache is below MaxSize.
+	// A MaxSize of 0 means no limit.
+	MaxSize int64
+
+	mu    sync.Mutex
+	stats CacheStats
+}
+
+func (lc *LocalCache) entryPath(key string) string {
+	return filepath.Join(lc.Dir, "objects", key[:2], key)
+}
+
+func (lc *LocalCache) statsPath() string {
+	return filepath.Join(lc.Dir, "stats.json")
+}
+
+func (lc *LocalCache) Get(key, path string) (bool, error) {
+	entry := lc.entryPath(key)
+	if err := copyFileAtomic(entry, path); os.IsNotExist(err) {
+		lc.mu.Lock()
+		lc.stats.Misses++
+		lc.mu.Unlock()
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// the modification time of an entry is used to find the least recently used entries
+	now := time.Now()
+	os.Chtimes(entry, now, now)
+	lc.mu.Lock()
+	lc.stats.Hits++
+	lc.mu.Unlock()
+	return true, nil
+}
+
+func (lc *LocalCache) Put(key, path string) error {
+	entry := lc.entryPath(key)
+	if err := os.MkdirAll(filepath.Dir(entry), 0755); err != nil {
+		return err
+	}
+	if err := copyFileAtomic(path, entry); err != nil {
+		return err
+	}
+	lc.mu.Lock()
+	lc.stats.Stores++
+	lc.mu.Unlock()
+	return nil
+}
+
+// Flush evicts outputs if the cache is larger than MaxSize and adds the statistics
+// gathered since the last call to Flush to those stored in the cache directory.
+func (lc *LocalCache) Flush() error {
+	if lc.MaxSize > 0 {
+		if _, err := lc.Evict(lc.MaxSize); err != nil {
+			return err
+		}
+	}
+
+	lc.mu.Lock()
+	stats := lc.stats
+	lc.stats = CacheStats{}
+	lc.mu.Unlock()
+
+	stored, err := lc.readStats()
+	if err != nil {
+		return err
+	}
+	stored.Hits += stats.Hits
+	stored.Misses += stats.Misses
+	stored.Stores += stats.Stores
+	stored.Evictions += stats.Evictions
+	buf, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(lc.Dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(lc.statsPath(), buf)
+}
+
+func (lc *LocalCache) readStats() (CacheStats, error) {
+	var stats CacheStats
+	buf, err := ioutil.ReadFile(lc.statsPath())
+	if os.IsNotExist(err) {
+		return stats, nil
+	} else if err != nil {
+		return stats, err
+	}
+	err = json.Unmarshal(buf, &stats)
+	return stats, err
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (lc *LocalCache) entries() ([]cacheEntry, error) {
+	var entries []cacheEntry
+	err := filepath.Walk(filepath.Join(lc.Dir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			entries = append(entries, cacheEntry{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Evict removes the least recently used outputs until the total size of the cache is
+// no more than maxSize bytes. The number of outputs removed is returned.
+func (lc *LocalCache) Evict(maxSize int64) (int, error) {
+	entries, err := lc.entries()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		size += entry.size
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+
+	removed := 0
+	for _, entry := range entries {
+		if size <= maxSize {
+			break
+		}
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		size -= entry.size
+		removed++
+	}
+	lc.mu.Lock()
+	lc.stats.Evictions += int64(removed)
+	lc.mu.Unlock()
+	return removed, nil
+}
+
+// Stats returns the statistics stored in the cache directory along with the number of
+// outputs in the cache and their total size.
+func (lc *LocalCache) Stats() (CacheStats, error) {
+	stats, err := lc.readStats()
+	if err != nil {
+		return stats, err
+	}
+	entries, err := lc.entries()
+	if err != nil {
+		return stats, err
+	}
+	stats.Entries = len(entries)
+	for _, entry := range entries {
+		stats.Size += entry.size
+	}
+	return stats, nil
+}
+
+// copyFileAtomic copies src to dst by writing to a temporary file in the directory
+// of dst and renaming it, so that a partially written dst is never seen. The file mode
+// of src is kept.
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileHasher computes and remembers the content hashes of files.
+type fileHasher struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+func (fh *fileHasher) reset() {
+	fh.mu.Lock()
+	fh.hashes = nil
+	fh.mu.Unlock()
+}
+
+func (fh *fileHasher) hash(path string) (string, error) {
+	fh.mu.Lock()
+	sum, ok := fh.hashes[path]
+	fh.mu.Unlock()
+	if ok {
+		return sum, nil
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return "", err
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+
+	fh.mu.Lock()
+	if fh.hashes == nil {
+		fh.hashes = make(map[string]string)
+	}
+	fh.hashes[path] = sum
+	fh.mu.Unlock()
+	return sum, nil
+}
+
+// compilerIdentity returns a string identifying the version of the compiler in use so
+// that outputs of different compilers are not mixed up in the cache.
+func (c *Compiler) compilerIdentity() (string, error) {
+	c.identityOnce.Do(func() {
+		path, err := exec.LookPath("g++")
+		if err != nil {
+			c.identityErr = err
+			return
+		}
+		out, err := exec.Command(path, "--version").Output()
+		if err != nil {
+			c.identityErr = err
+			return
+		}
+		c.identity = path + "\n" + string(out)
+	})
+	return c.identity, c.identityErr
+}
+
+// cacheKey returns the key for an output built by running the compiler with args using
+// the files at inputPaths. args should not include the output path. Paths within the
+// CacheRoots are hashed relative to them.
+func (c *Compiler) cacheKey(kind string, args, inputPaths []string) (string, error) {
+	identity, err := c.compilerIdentity()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "cppdep %s\n%s\n", kind, identity)
+	for _, arg := range args {
+		fmt.Fprintf(h, "arg %s\n", c.cachePath(arg))
+	}
+	sortedPaths := append([]string{}, inputPaths...)
+	sort.Strings(sortedPaths)
+	for i, path := range sortedPaths {
+		if i > 0 && path == sortedPaths[i-1] {
+			continue
+		}
+		sum, err := c.hasher.hash(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "input %s %s\n", c.cachePath(path), sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachePath replaces the path of one of the CacheRoots, or the OutputDir, at the start
+// of arg, either on its own or after a flag such as -I, with the name of the root. The
+// longest root that matches is used, as the roots may be nested.
+func (c *Compiler) cachePath(arg string) string {
+	start := strings.Index(arg, string(filepath.Separator))
+	if start == -1 || !isPathFlag(arg[:start]) {
+		return arg
+	}
+	path := arg[start:]
+	best, bestLen := -1, 0
+	for i, root := range append(append([]string{}, c.CacheRoots...), c.OutputDir) {
+		root = filepath.Clean(root)
+		if !filepath.IsAbs(root) || len(root) <= bestLen {
+			continue
+		}
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			best, bestLen = i, len(root)
+		}
+	}
+	if best == -1 {
+		return arg
+	}
+	return fmt.Sprintf("%s$ROOT%d%s", arg[:start], best, path[bestLen:])
+}
+
+// isPathFlag returns true if prefix is empty or a flag that a path can follow, such as
+// -I, -isystem, -DDIR= or -Wl,-rpath,.
+func isPathFlag(prefix string) bool {
+	if prefix == "" || strings.HasSuffix(prefix, "=") || strings.HasSuffix(prefix, ",") {
+		return true
+	}
+	if len(prefix) < 2 || prefix[0] != '-' {
+		return false
+	}
+	for _, r := range prefix[1:] {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreFromCache attempts to restore outputPath from the cache. The key for the output
+// is returned so that it can be stored in the cache once built. Errors using the cache
+// are logged and treated as a miss, so that a broken cache never fails a build.
+func (c *Compiler) restoreFromCache(kind, outputPath string, args, inputPaths []string) (key string, restored bool) {
+	key, err := c.cacheKey(kind, args, inputPaths)
+	if err != nil {
+		logCacheError(err)
+		return "", false
+	}
+	restored, err = c.Cache.Get(key, outputPath)
+	if err != nil {
+		logCacheError(err)
+	}
+	if !restored {
+		return key, false
+	}
+	// not all caches keep the file mode of an output
+	mode := os.FileMode(0644)
+	if kind == "binary" {
+		mode = 0755
+	}
+	if err := os.Chmod(outputPath, mode); err != nil {
+		logCacheError(err)
+		return key, false
+	}
+	c.executedMu.Lock()
+	c.executed[outputPath] = struct{}{}
+	c.executedMu.Unlock()
+	c.printStatus(fmt.Sprintf("Restored: %s", filepath.Base(outputPath)))
+	return key, restored
+}
+
+func (c *Compiler) storeInCache(key, outputPath string) {
+	if key == "" {
+		return
+	}
+	if err := c.Cache.Put(key, outputPath); err != nil {
+		logCacheError(err)
+	}
+}
+
+func logCacheError(err error) {
+	if err != nil && !supressLogging {
+		fmt.Fprintf(os.Stderr, "cppdep: build cache error: %v\n", err)
+	}
+}
@@ -0,0 +1,144 @@
+package cppdep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cppdep_cache_test")
+	if err != nil {
+		t.Fatalf("Failed to setup cache dir")
+	}
+	defer os.RemoveAll(dir)
+
+	lc := &LocalCache{Dir: filepath.Join(dir, "cache")}
+	src := filepath.Join(dir, "src.o")
+	if err := ioutil.WriteFile(src, []byte("object contents"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	dst := filepath.Join(dir, "dst.o")
+	key := "0123456789abcdef"
+	if ok, err := lc.Get(key, dst); err != nil || ok {
+		t.Errorf("Expected cache miss: %v %v", ok, err)
+	}
+	if err := lc.Put(key, src); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if ok, err := lc.Get(key, dst); err != nil || !ok {
+		t.Fatalf("Expected cache hit: %v %v", ok, err)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "object contents" {
+		t.Errorf("restored file not as expected: %q %v", b, err)
+	}
+
+	if err := lc.Flush(); err != nil {
+		t.Fatalf("Flush returned error: %v", err)
+	}
+	stats, err := lc.Stats()
+	switch {
+	case err != nil:
+		t.Fatalf("Stats returned error: %v", err)
+	case stats.Hits != 1 || stats.Misses != 1 || stats.Stores != 1:
+		t.Errorf("stats not as expected: %+v", stats)
+	case stats.Entries != 1 || stats.Size != int64(len("object contents")):
+		t.Errorf("stats not as expected: %+v", stats)
+	}
+}
+
+func TestLocalCacheEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cppdep_cache_test")
+	if err != nil {
+		t.Fatalf("Failed to setup cache dir")
+	}
+	defer os.RemoveAll(dir)
+
+	lc := &LocalCache{Dir: filepath.Join(dir, "cache"), MaxSize: 20}
+	src := filepath.Join(dir, "src.o")
+	if err := ioutil.WriteFile(src, []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	keys := []string{"aa0001", "bb0002", "cc0003"}
+	for i, key := range keys {
+		if err := lc.Put(key, src); err != nil {
+			t.Fatalf("Put returned error: %v", err)
+		}
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(lc.entryPath(key), modTime, modTime)
+	}
+	// using an entry should make it the most recently used
+	if ok, _ := lc.Get(keys[0], filepath.Join(dir, "dst.o")); !ok {
+		t.Fatalf("Expected cache hit")
+	}
+	if err := lc.Flush(); err != nil {
+		t.Fatalf("Flush returned error: %v", err)
+	}
+
+	stats, _ := lc.Stats()
+	switch {
+	case stats.Evictions != 1:
+		t.Errorf("Expected one eviction: %+v", stats)
+	case stats.Size > 20:
+		t.Errorf("Expected cache to be under max size: %+v", stats)
+	}
+	if _, err := os.Stat(lc.entryPath(keys[1])); !os.IsNotExist(err) {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	if _, err := os.Stat(lc.entryPath(keys[0])); err != nil {
+		t.Errorf("Expected recently used entry to be kept")
+	}
+}
+
+func TestCacheKeyRelativeToRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cppdep_cache_test")
+	if err != nil {
+		t.Fatalf("Failed to setup dir")
+	}
+	defer os.RemoveAll(dir)
+
+	// two checkouts of the same sources in different places
+	key := func(checkout, contents string) string {
+		srcRoot := filepath.Join(dir, checkout, "src")
+		os.MkdirAll(srcRoot, 0755)
+		source := filepath.Join(srcRoot, "a.cc")
+		if err := ioutil.WriteFile(source, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		c := &Compiler{
+			OutputDir:  filepath.Join(dir, checkout, "build/default"),
+			CacheRoots: []string{srcRoot, filepath.Join(dir, checkout, "build")},
+		}
+		args := []string{"-I" + srcRoot, "-I" + filepath.Join(dir, checkout, "build/gen"), "-include", filepath.Join(c.OutputDir, "pch/a.h"), "-c", source}
+		k, err := c.cacheKey("object", args, []string{source})
+		if err != nil {
+			t.Fatalf("cacheKey returned error: %v", err)
+		}
+		return k
+	}
+	a, b := key("a", "int a;\n"), key("b", "int a;\n")
+	if a != b {
+		t.Errorf("Expected checkouts in different places to have the same key")
+	}
+	if c := key("c", "int c;\n"); c == a {
+		t.Errorf("Expected different contents to have different keys")
+	}
+
+	c := &Compiler{OutputDir: "/build/default", CacheRoots: []string{"/src", "/src/sub"}}
+	for arg, exp := range map[string]string{
+		"/src/sub/a.cc":     "$ROOT1/a.cc",
+		"-I/src":            "-I$ROOT0",
+		"-DDIR=/src/data":   "-DDIR=$ROOT0/data",
+		"/build/default/a":  "$ROOT2/a",
+		"/srcother/a.cc":    "/srcother/a.cc",
+		"-DPATH=x/src/a.cc": "-DPATH=x/src/a.cc",
+		"-O2":               "-O2",
+	} {
+		if got := c.cachePath(arg); got != exp {
+			t.Errorf("cachePath(%q) = %q, expected %q", arg, got, exp)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package cppdep
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -19,27 +19,105 @@ var (
 type Compiler struct {
 	IncludeDirs []string // include directories to be passed to compile
 	Flags       []string // compile flags passed to the compiler
+	LinkFlags   []string // flags passed to the compiler only when linking
+
+	// BinaryLinks are extra link settings that only apply to binaries whose
+	// name matches the BinaryLink's Pattern.
+	BinaryLinks []BinaryLink
+
+	// PrecompiledHeaders are compiled before any objects, and then force included
+	// when compiling the source files in their scope.
+	PrecompiledHeaders []PrecompiledHeader
+
+	// Unity when set will compile batches of sources together as single translation
+	// units rather than compiling each source individually.
+	Unity *UnityBuild
+
+	// Cache when set is used to restore objects and binaries that have been built
+	// before from the exact same inputs, rather than running the compiler.
+	Cache Cache
+
+	// CacheRoots are directories, such as the source root and the build dir, that
+	// paths in cache keys are made relative to, so that checkouts of the source tree
+	// in different places share cache entries. The OutputDir is always one of them.
+	CacheRoots []string
+
+	// Sandbox when set compiles each object in a temporary directory containing only
+	// the files that the dependency graph says it needs, in order to find dependencies
+	// that were missed while scanning. A compile that fails because an include can not
+	// be found returns a *MissingDependencyError. Precompiled headers are not used in
+	// sandboxed compiles, and unity build sources are not sandboxed since they include
+	// their sources by absolute path.
+	Sandbox bool
+
+	// Executor runs the compile and link commands. LocalExecutor is used if nil.
+	Executor Executor
+
+	// Trace when set records the time spent in each phase of CompileAll and in
+	// each compile and link.
+	Trace *Trace
+
+	// Diagnostics when set collects the errors and warnings reported by each compile.
+	Diagnostics *Diagnostics
+
+	// Progress when set shows the progress of CompileAll in a status line, instead of
+	// printing a line for each action.
+	Progress *Progress
+
+	// LinkDeps maps a link library argument to the link library arguments it depends
+	// on, for example {"-lpq": {"-lssl", "-lcrypto"}}. It is used to order the link
+	// libraries of a binary so that static linking works.
+	LinkDeps map[string][]string
 
 	// OutputDir is base output dir, object files written to OutputDir/obj
 	// and compiled binaries will be written to OutputDir/bin
 	OutputDir string
 
-	Concurrency int // the number of concurrent compiles
+	Concurrency int // the number of concurrent compiles and links
+
+	// CompileConcurrency and LinkConcurrency limit the number of compiles and links
+	// running at the same time, within Concurrency. 0 means Concurrency.
+	CompileConcurrency int
+	LinkConcurrency    int
+
+	// CompileMemory and LinkMemory are the memory in bytes a compile or link is
+	// expected to need. When set, another compile or link is only started if the
+	// system has that much memory available on top of what running ones need.
+	CompileMemory uint64
+	LinkMemory    uint64
 
 	// Verbose when set to true will print out the compile statements being run
 	Verbose bool
+
+	hasher       fileHasher
+	durations    *durationLog
+	outputMu     sync.Mutex
+	executedMu   sync.Mutex
+	executed     map[string]struct{}
+	identityOnce sync.Once
+	identity     string
+	identityErr  error
 }
 
-// BinPath returns the path where the binary for a given main file will be written.
-func (c *Compiler) BinPath(file *File) string {
-	var path string
+// BinaryLink defines link flags and libraries to be added when linking any binary
+// whose name matches Pattern. Pattern is either a binary name or a glob as defined
+// by filepath.Match.
+type BinaryLink struct {
+	Pattern string
+	Flags   []string
+	Libs    []string
+}
+
+func binaryName(file *File) string {
 	if file.BinaryName != "" {
-		path = filepath.Join(c.OutputDir, "bin", file.BinaryName)
-	} else {
-		base := filepath.Base(file.Path)
-		dotIndex := strings.LastIndex(base, ".")
-		path = filepath.Join(c.OutputDir, "bin", base[:dotIndex])
+		return file.BinaryName
 	}
+	return removeExt(filepath.Base(file.Path))
+}
+
+// BinPath returns the path where the binary for a given main file will be written.
+func (c *Compiler) BinPath(file *File) string {
+	path := filepath.Join(c.OutputDir, "bin", binaryName(file))
 	if file.Type == LibType {
 		path = path + ".so"
 	}
@@ -51,6 +129,13 @@ func (c *Compiler) BinPath(file *File) string {
 // return false. Upon success the path of all the output binaries are returned in
 // the same order as the input files.
 func (c *Compiler) CompileAll(files []*File) (paths []string, err error) {
+	return c.CompileAllContext(context.Background(), files)
+}
+
+// CompileAllContext is like CompileAll, but stops the build when ctx is done. No more
+// compiles or links are started, running ones are killed, and their partial outputs
+// are removed. The error of ctx is returned.
+func (c *Compiler) CompileAllContext(ctx context.Context, files []*File) (paths []string, err error) {
 	if err := os.MkdirAll(filepath.Join(c.OutputDir, "bin"), 0755); err != nil {
 		return nil, err
 	}
@@ -58,122 +143,166 @@ func (c *Compiler) CompileAll(files []*File) (paths []string, err error) {
 		return nil, err
 	}
 
+	c.hasher.reset()
+	c.executedMu.Lock()
+	c.executed = make(map[string]struct{})
+	c.executedMu.Unlock()
+
+	plan, err := c.planBuild(files)
+	if err != nil {
+		return nil, err
+	}
+
+	c.durations = loadDurations(c.durationsPath())
+	// a dry run finishes actions instantly, which says nothing about how long they take
+	_, c.durations.readOnly = c.Executor.(*DryRunExecutor)
+	defer func() {
+		if err := c.durations.save(); err != nil && !supressLogging {
+			fmt.Fprintf(os.Stderr, "cppdep: failed to save build durations: %v\n", err)
+		}
+	}()
+
+	pchs := plan.pchs
+	estimates := c.durations.compileEstimates(plan.sources)
+
+	compilePool := &jobPool{limit: c.CompileConcurrency, memory: c.CompileMemory}
+	linkPool := &jobPool{limit: c.LinkConcurrency, memory: c.LinkMemory}
+	var jobs []*job
+	objectJobs := make(map[*File]*job)
+	for _, source := range plan.sources {
+		source := source
+		j := &job{
+			name:     source.Path,
+			estimate: estimates[source],
+			pool:     compilePool,
+		}
+		j.run = func() error {
+			_, err := c.makeObject(ctx, source)
+			c.Progress.finish(j.estimate, !c.produced(c.objectPath(source)))
+			return err
+		}
+		objectJobs[source] = j
+		jobs = append(jobs, j)
+	}
+	for _, binInfo := range plan.binaries {
+		binInfo := binInfo
+		j := &job{
+			name:     c.BinPath(binInfo.file),
+			estimate: c.durations.linkEstimate(c.BinPath(binInfo.file)),
+			pool:     linkPool,
+		}
+		j.run = func() error {
+			var objects []string
+			for _, file := range binInfo.sources {
+				objects = append(objects, c.objectPath(file))
+			}
+			path, err := c.makeBinary(ctx, binInfo.file, objects, binInfo.libs)
+			c.Progress.finish(j.estimate, !c.produced(path))
+			return err
+		}
+		for _, source := range binInfo.sources {
+			j.dependsOn(objectJobs[plan.sourcesByPath[source.Path]])
+		}
+		jobs = append(jobs, j)
+	}
+
+	var work time.Duration
+	for _, j := range jobs {
+		work += j.estimate
+	}
+	c.Progress.start(len(pchs)+len(jobs), work, c.Concurrency)
+	defer func() { c.Progress.done(err != nil) }()
+
+	endPCH := c.Trace.Begin(PhaseCategory, "precompiled headers")
+	for _, pch := range pchs {
+		path, err := c.makePCH(ctx, pch)
+		if err != nil {
+			endPCH()
+			return nil, err
+		}
+		c.Progress.finish(0, !c.produced(path))
+	}
+	endPCH()
+
+	endBuild := c.Trace.Begin(PhaseCategory, "compile and link")
+	err = runJobs(ctx, jobs, c.Concurrency)
+	endBuild()
+	if err != nil {
+		return nil, err
+	}
+
+	var binPaths []string
+	for _, binInfo := range plan.binaries {
+		binPaths = append(binPaths, c.BinPath(binInfo.file))
+	}
+	return binPaths, nil
+}
+
+// buildPlan is everything that has to be built for a set of binaries.
+type buildPlan struct {
+	binaries      []binaryInfo // in the order of ByBase
+	sources       []*File      // the sources of all binaries, in the order of ByBase
+	sourcesByPath map[string]*File
+	pchs          []*PrecompiledHeader // the precompiled headers used by sources
+}
+
+// planBuild works out the sources and link libraries of the binaries whose main
+// functions are defined by files. For unity builds the generated unity sources
+// are written.
+func (c *Compiler) planBuild(files []*File) (*buildPlan, error) {
 	var sortedFiles []*File
 	sortedFiles = append(sortedFiles, files...)
 	sort.Sort(ByBase(sortedFiles))
 	files = sortedFiles
-	uniqueSources := make(map[string]*File)
 	var fileSources [][]*File
 	var fileLibs [][]string
 	for _, file := range files {
 		deps := file.DepListFollowSource()
 		deps = append(deps, file)
 		sources, libs := filterDeps(deps)
-		for _, source := range sources {
-			uniqueSources[source.Path] = source
-		}
 		fileSources = append(fileSources, sources)
 		fileLibs = append(fileLibs, libs)
 	}
-
-	concurrency := c.Concurrency
-	if concurrency == 0 {
-		concurrency = 1
-	}
-
-	var mu sync.Mutex
-	var compileErr error
-	var wg sync.WaitGroup
-	sourceCh := make(chan *File)
-
-	compileDepLoop := func() {
-		defer wg.Done()
-		for source := range sourceCh {
-			var err error
-
-			mu.Lock()
-			cerr := compileErr
-			mu.Unlock()
-			if cerr != nil {
-				continue
-			}
-			_, err = c.makeObject(source)
-
-			if err != nil {
-				mu.Lock()
-				compileErr = err
-				mu.Unlock()
-			}
+	if c.Unity != nil {
+		var extraLibs [][]string
+		var err error
+		fileSources, extraLibs, err = c.unitySources(files, fileSources)
+		if err != nil {
+			return nil, err
+		}
+		for i := range fileLibs {
+			fileLibs[i] = append(fileLibs[i], extraLibs[i]...)
 		}
 	}
-
-	for i := 0; i < concurrency; i++ {
-		wg.Add(1)
-		go compileDepLoop()
-	}
-
-	var sortedSources []*File
-	for _, source := range uniqueSources {
-		sortedSources = append(sortedSources, source)
-	}
-	sort.Sort(ByBase(sortedSources))
-	for _, source := range sortedSources {
-		sourceCh <- source
-	}
-	close(sourceCh)
-	wg.Wait()
-	if compileErr != nil {
-		return nil, compileErr
-	}
-
-	binCh := make(chan binaryInfo)
-	var binWg sync.WaitGroup
-
-	binWg.Add(concurrency)
-	for i := 0; i < concurrency; i++ {
-		go func() {
-			defer binWg.Done()
-			for binInfo := range binCh {
-				mu.Lock()
-				cerr := compileErr
-				mu.Unlock()
-				if cerr != nil {
-					continue
-				}
-
-				var objects []string
-				for _, file := range binInfo.sources {
-					objects = append(objects, c.objectPath(file))
-				}
-
-				_, err := c.makeBinary(binInfo.file, objects, binInfo.libs)
-				if err != nil {
-					mu.Lock()
-					compileErr = err
-					mu.Unlock()
-				}
-			}
-		}()
+	uniqueSources := make(map[string]*File)
+	for _, sources := range fileSources {
+		for _, source := range sources {
+			uniqueSources[source.Path] = source
+		}
 	}
 
+	plan := &buildPlan{sourcesByPath: uniqueSources}
 	for i, file := range files {
-		binCh <- binaryInfo{
+		plan.binaries = append(plan.binaries, binaryInfo{
 			file:    file,
 			sources: fileSources[i],
 			libs:    fileLibs[i],
-		}
+		})
 	}
-	close(binCh)
-	binWg.Wait()
-	if compileErr != nil {
-		return nil, compileErr
+	for _, source := range uniqueSources {
+		plan.sources = append(plan.sources, source)
 	}
-
-	var binPaths []string
-	for _, file := range files {
-		binPaths = append(binPaths, c.BinPath(file))
+	sort.Sort(ByBase(plan.sources))
+	for i := range c.PrecompiledHeaders {
+		pch := &c.PrecompiledHeaders[i]
+		for _, source := range plan.sources {
+			if pch.Header != source && pch.inScope(source) {
+				plan.pchs = append(plan.pchs, pch)
+				break
+			}
+		}
 	}
-	return binPaths, nil
+	return plan, nil
 }
 
 func (c *Compiler) Compile(file *File) (path string, err error) {
@@ -198,6 +327,9 @@ var supressLogging bool
 var (
 	makeObjectHook func(file *File)
 	makeBinaryHook func(file *File)
+	makePCHHook    func(file *File)
+
+	depFileMismatchHook func(file *File, missed, unused []string)
 )
 
 func (c *Compiler) objectPath(file *File) string {
@@ -206,46 +338,161 @@ func (c *Compiler) objectPath(file *File) string {
 	return filepath.Join(c.OutputDir, "obj", base[:dotIndex]+".o")
 }
 
-func (c *Compiler) makeObject(file *File) (path string, err error) {
+func (c *Compiler) makeObject(ctx context.Context, file *File) (path string, err error) {
 	objectPath := c.objectPath(file)
+	depFilePath := c.depFilePath(objectPath)
 
-	var depPaths []string
-	for _, dep := range append(file.DepList(), file) {
-		if dep.Type == HeaderType || dep == file {
-			depPaths = append(depPaths, dep.Path)
-		}
-	}
+	deps, depPaths, pchs := c.objectInputs(file)
+	scannedPaths := depPaths
+
+	// the dependency file of the last compile lists the headers the compiler actually
+	// used, which covers any includes that scanning failed to find
+	recorded, missing := c.depFileDeps(objectPath)
+	depPaths = appendMissing(depPaths, recorded)
 
 	// NOTE: in this instance we could speed this up by using the dep files
 	//			 ModTime field. This would be faster, but wouldn't use this
 	//			 generic method. Can address if it becomes an issue.
-	needsCompile, err := needsRebuild(depPaths, []string{objectPath})
+	needsCompile, err := c.needsRebuild(depPaths, []string{objectPath})
 	if err != nil {
 		return "", err
-	} else if !needsCompile {
+	} else if !needsCompile && !missing {
 		return objectPath, nil
 	}
 
-	cmd := exec.Command("g++", "-o", objectPath)
-	cmd.Args = append(cmd.Args, c.Flags...)
-	cmd.Args = append(cmd.Args, c.includeDirective()...)
-	cmd.Args = append(cmd.Args, "-c")
-	cmd.Args = append(cmd.Args, file.Path)
-	if !supressLogging {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if c.Verbose {
-			fmt.Printf("%s\n", strings.Join(cmd.Args, " "))
-		} else {
-			fmt.Printf("Compiling: %s\n", filepath.Base(objectPath))
+	args := append(c.objectFlags(deps, pchs), "-c", file.Path)
+
+	// the key covers the headers recorded by the last compile as well as those found by
+	// scanning, so that a change to a header scanning cannot find still misses the cache.
+	// If the recorded headers are unknown the cache is bypassed for the same reason.
+	var cacheKey string
+	if c.Cache != nil && !missing {
+		var restored bool
+		if cacheKey, restored = c.restoreFromCache("object", objectPath, args, depPaths); restored {
+			return objectPath, nil
 		}
+	}
 
+	action := &Action{
+		Kind:        CompileAction,
+		Description: fmt.Sprintf("Compiling: %s", filepath.Base(objectPath)),
+		Argv:        append([]string{"g++", "-o", objectPath, "-MMD", "-MF", depFilePath}, args...),
+		Inputs:      depPaths,
+		Outputs:     []string{objectPath, depFilePath},
 	}
 	if makeObjectHook != nil {
 		makeObjectHook(file)
 	}
-	err = cmd.Run()
-	return objectPath, err
+	var output []byte
+	end := c.beginAction(CompileAction, file.Path)
+	if c.Sandbox && len(file.unitySources) == 0 {
+		output, err = c.runSandboxed(ctx, action, file, deps)
+	} else {
+		output, err = c.run(ctx, action)
+	}
+	end(action, err)
+	c.collectDiagnostics(file.Path, output)
+	c.showOutput(action, output, err)
+	if err != nil {
+		return objectPath, err
+	}
+	if c.Cache != nil && c.depFileCovered(objectPath, depPaths) {
+		c.storeInCache(cacheKey, objectPath)
+	}
+	c.checkDepFile(file, scannedPaths, pchs)
+	return objectPath, nil
+}
+
+// objectInputs returns the files compiled into the object for file, the paths of
+// those of them that are read from disk along with the precompiled headers used, and
+// the precompiled headers.
+func (c *Compiler) objectInputs(file *File) (deps []*File, depPaths []string, pchs []*PrecompiledHeader) {
+	deps = append(file.DepList(), file)
+	for _, dep := range deps {
+		if dep.Type == HeaderType || dep.Type == SourceType {
+			depPaths = append(depPaths, dep.Path)
+		}
+	}
+	if !c.Sandbox {
+		pchs = c.filePCHs(file)
+	}
+	for _, pch := range pchs {
+		depPaths = append(depPaths, c.pchPath(pch))
+	}
+	return deps, depPaths, pchs
+}
+
+// objectFlags returns the flags for compiling a source with the dependencies deps
+// using the precompiled headers pchs.
+func (c *Compiler) objectFlags(deps []*File, pchs []*PrecompiledHeader) []string {
+	var args []string
+	args = append(args, c.Flags...)
+	args = append(args, depCFlags(deps)...)
+	args = append(args, c.includeDirective()...)
+	for _, pch := range pchs {
+		args = append(args, "-include", c.pchIncludePath(pch))
+	}
+	return args
+}
+
+// checkDepFile warns when the headers the compiler used for file differ from the
+// headers found while scanning.
+func (c *Compiler) checkDepFile(file *File, scanned []string, pchs []*PrecompiledHeader) {
+	missed, unused, err := c.compareDepFile(file, scanned, pchs)
+	if err != nil || (len(missed) == 0 && len(unused) == 0) {
+		return
+	}
+	if depFileMismatchHook != nil {
+		depFileMismatchHook(file, missed, unused)
+	}
+	if supressLogging {
+		return
+	}
+	for _, path := range missed {
+		fmt.Fprintf(os.Stderr, "warning: %s: compiler used %s, which scanning did not find\n", file.Path, path)
+	}
+	if c.Verbose {
+		for _, path := range unused {
+			fmt.Fprintf(os.Stderr, "warning: %s: scanning found %s, which the compiler did not use\n", file.Path, path)
+		}
+	}
+}
+
+// runSandboxed runs the compile action for file in a sandbox containing only deps.
+// Paths within the sandbox are changed back to their original paths in the output.
+func (c *Compiler) runSandboxed(ctx context.Context, action *Action, file *File, deps []*File) ([]byte, error) {
+	sb, err := newSandbox(c.OutputDir, deps, c.IncludeDirs)
+	if err != nil {
+		return nil, err
+	}
+	defer sb.remove()
+
+	action.Argv = sb.rewriteArgs(action.Argv, file.Path)
+	output, err := c.run(ctx, action)
+	output = sb.rewriteOutput(output)
+	if err != nil {
+		if missing := sb.missingDependency(file.Path, output); missing != nil {
+			return output, missing
+		}
+		return output, err
+	}
+	sb.rewriteDepFile(c.depFilePath(c.objectPath(file)))
+	return output, nil
+}
+
+// depCFlags returns the deduplicated CFlags of all files in deps.
+func depCFlags(deps []*File) []string {
+	var cflags []string
+	seen := make(map[string]struct{})
+	for _, dep := range deps {
+		for _, flag := range dep.CFlags {
+			if _, ok := seen[flag]; !ok {
+				seen[flag] = struct{}{}
+				cflags = append(cflags, flag)
+			}
+		}
+	}
+	return cflags
 }
 
 type binaryInfo struct {
@@ -254,38 +501,71 @@ type binaryInfo struct {
 	libs    []string
 }
 
-func (c *Compiler) makeBinary(file *File, objectPaths, libList []string) (path string, err error) {
+func (c *Compiler) makeBinary(ctx context.Context, file *File, objectPaths, libList []string) (path string, err error) {
 	binaryPath := c.BinPath(file)
-	needsCompile, err := needsRebuild(objectPaths, []string{binaryPath})
+	needsCompile, err := c.needsRebuild(objectPaths, []string{binaryPath})
 	if err != nil {
 		return "", err
 	} else if !needsCompile {
 		return binaryPath, nil
 	}
 
-	cmd := exec.Command("g++", "-o", binaryPath)
-	if file.Type == LibType {
-		cmd.Args = append(cmd.Args, "-shared")
-	}
-	cmd.Args = append(cmd.Args, c.Flags...)
-	cmd.Args = append(cmd.Args, objectPaths...)
-	cmd.Args = append(cmd.Args, libList...)
-	if !supressLogging {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if c.Verbose {
-			fmt.Printf("%s\n", strings.Join(cmd.Args, " "))
-		} else {
-			fmt.Printf("Compiling: %s\n", filepath.Base(binaryPath))
+	flags, libs := c.linkArgs(file, libList)
+	args := append(append(flags, objectPaths...), libs...)
+
+	var cacheKey string
+	if c.Cache != nil {
+		var restored bool
+		if cacheKey, restored = c.restoreFromCache("binary", binaryPath, args, objectPaths); restored {
+			return binaryPath, nil
 		}
 	}
+
+	action := &Action{
+		Kind:        LinkAction,
+		Description: fmt.Sprintf("Compiling: %s", filepath.Base(binaryPath)),
+		Argv:        append([]string{"g++", "-o", binaryPath}, args...),
+		Inputs:      objectPaths,
+		Outputs:     []string{binaryPath},
+	}
 	if makeBinaryHook != nil {
 		makeBinaryHook(file)
 	}
-	err = cmd.Run()
+	end := c.beginAction(LinkAction, binaryPath)
+	err = c.execute(ctx, action)
+	end(action, err)
+	if err == nil && c.Cache != nil {
+		c.storeInCache(cacheKey, binaryPath)
+	}
 	return binaryPath, err
 }
 
+// linkArgs returns the flags that go before the objects when linking the binary for
+// file, and the link libraries, including those in libList, that go after them.
+func (c *Compiler) linkArgs(file *File, libList []string) (flags, libs []string) {
+	if file.Type == LibType {
+		flags = append(flags, "-shared")
+	}
+	linkFlags, linkLibs := c.binaryLinkSettings(file)
+	flags = append(flags, c.Flags...)
+	flags = append(flags, c.LinkFlags...)
+	flags = append(flags, linkFlags...)
+	return flags, orderLinkArgs(append(libList, linkLibs...), c.LinkDeps)
+}
+
+// binaryLinkSettings returns the link flags and libraries from all BinaryLinks whose
+// Pattern matches the name of the binary for file, in the order they are defined.
+func (c *Compiler) binaryLinkSettings(file *File) (flags, libs []string) {
+	name := binaryName(file)
+	for _, bl := range c.BinaryLinks {
+		if matched, _ := filepath.Match(bl.Pattern, name); matched {
+			flags = append(flags, bl.Flags...)
+			libs = append(libs, bl.Libs...)
+		}
+	}
+	return flags, libs
+}
+
 func filterDeps(deps []*File) (sources []*File, libs []string) {
 	for _, dep := range deps {
 		if dep.Type == SourceType {
@@ -298,6 +578,97 @@ func filterDeps(deps []*File) (sources []*File, libs []string) {
 	return sources, libs
 }
 
+// execute runs action using the Compiler's Executor, logging it unless logging is
+// supressed.
+func (c *Compiler) execute(ctx context.Context, action *Action) error {
+	output, err := c.run(ctx, action)
+	c.showOutput(action, output, err)
+	return err
+}
+
+// run runs action and returns its captured output, which is not printed. See
+// showOutput.
+func (c *Compiler) run(ctx context.Context, action *Action) ([]byte, error) {
+	c.executedMu.Lock()
+	for _, output := range action.Outputs {
+		c.executed[output] = struct{}{}
+	}
+	c.executedMu.Unlock()
+
+	if c.Verbose {
+		c.printStatus(strings.Join(action.Argv, " "))
+	} else {
+		c.printStatus(action.Description)
+	}
+	ex := c.Executor
+	if ex == nil {
+		ex = LocalExecutor{}
+	}
+	action.Context = ctx
+	output, err := runCaptured(ex, action)
+	if err != nil {
+		// a failed or cancelled command can leave a partially written output with a
+		// fresh modification time, which would otherwise be taken as up to date
+		for _, path := range action.Outputs {
+			os.Remove(path)
+		}
+	}
+	return output, err
+}
+
+// showOutput prints the output of a finished action in one piece, so that the output
+// of actions running at the same time is not interleaved.
+func (c *Compiler) showOutput(action *Action, output []byte, err error) {
+	if supressLogging || !hasActionOutput(output, err, c.Verbose) {
+		return
+	}
+	if c.Progress != nil {
+		c.Progress.print(func() { writeActionOutput(os.Stderr, action, output, err, c.Verbose) })
+		return
+	}
+	c.outputMu.Lock()
+	writeActionOutput(os.Stderr, action, output, err, c.Verbose)
+	c.outputMu.Unlock()
+}
+
+// printStatus prints a line saying what the build is doing, or shows it on the status
+// line when c.Progress is set.
+func (c *Compiler) printStatus(line string) {
+	if supressLogging {
+		return
+	}
+	if c.Progress != nil {
+		c.Progress.status(line)
+		return
+	}
+	fmt.Println(line)
+}
+
+// produced returns whether the file at path was written during this build, either by
+// running an action or by restoring it from the cache.
+func (c *Compiler) produced(path string) bool {
+	c.executedMu.Lock()
+	defer c.executedMu.Unlock()
+	_, ok := c.executed[path]
+	return ok
+}
+
+// needsRebuild is the same as the needsRebuild function, except that any input that
+// was produced during this build (see produced) always needs a rebuild. This
+// keeps the build correct if outputs are not actually written, such as when using a
+// DryRunExecutor.
+func (c *Compiler) needsRebuild(inputPaths, outputPaths []string) (bool, error) {
+	c.executedMu.Lock()
+	for _, path := range inputPaths {
+		if _, ok := c.executed[path]; ok {
+			c.executedMu.Unlock()
+			return true, nil
+		}
+	}
+	c.executedMu.Unlock()
+	return needsRebuild(inputPaths, outputPaths)
+}
+
 func needsRebuild(inputPaths, outputPaths []string) (bool, error) {
 	var inputModTime time.Time
 	for _, path := range inputPaths {
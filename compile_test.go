@@ -2,11 +2,16 @@ package cppdep
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -400,3 +405,662 @@ func TestCompileRenamedBinaries(t *testing.T) {
 	}
 
 }
+
+func TestCompileBinaryLinks(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := &SourceTree{
+		SrcRoot: "test_files/gzcat",
+	}
+	st.ProcessDirectory()
+
+	mainFile := st.FindSource("gzcat")
+
+	c := &Compiler{
+		OutputDir:   outputDir,
+		BinaryLinks: []BinaryLink{{Pattern: "other*", Libs: []string{"-lz"}}},
+	}
+	if _, err := c.Compile(mainFile); err == nil {
+		t.Errorf("Expected link to fail when binary link pattern does not match")
+	}
+
+	c.BinaryLinks = []BinaryLink{{Pattern: "gz*", Libs: []string{"-lz"}}}
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Errorf("Compile returned error: %v", err)
+	}
+}
+
+func TestCompileLinkFlagsOnlyUsedForLinking(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	st.ProcessDirectory()
+
+	mainFile := st.FindSource("main")
+
+	c := &Compiler{
+		LinkFlags: []string{"-Wl,--no-such-linker-option"},
+		OutputDir: outputDir,
+	}
+	if _, err := c.Compile(mainFile); err == nil {
+		t.Errorf("Expected link to fail due to invalid link flag")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "obj/main.o")); err != nil {
+		t.Errorf("Expected objects to compile without link flags: %v", err)
+	}
+}
+
+func TestCompilePkgConfigLibrary(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	origRunPkgConfig := runPkgConfig
+	defer func() { runPkgConfig = origRunPkgConfig }()
+	runPkgConfig = func(pkg string) ([]byte, error) {
+		return []byte("-DPKG_CONFIG_CFLAGS -lz\n"), nil
+	}
+
+	st := &SourceTree{
+		SrcRoot:            "test_files/pkg_config",
+		PkgConfigLibraries: map[string]string{"zlib.h": "zlib"},
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+
+	c := &Compiler{OutputDir: outputDir}
+	if _, err := c.Compile(st.FindSource("main")); err != nil {
+		t.Errorf("Compile returned error: %v", err)
+	}
+}
+
+func TestCompilePrecompiledHeader(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := &SourceTree{
+		SrcRoot:     "test_files/pch",
+		AutoInclude: true,
+	}
+	st.ProcessDirectory()
+
+	mainFile := st.FindSource("main")
+	header := st.FindFile("app/heavy.h")
+	if header == nil {
+		t.Fatalf("Unable to find precompiled header")
+	}
+
+	c := &Compiler{
+		IncludeDirs: st.IncludeDirs,
+		OutputDir:   outputDir,
+		PrecompiledHeaders: []PrecompiledHeader{
+			{Header: header, Scope: []string{filepath.Join(st.SrcRoot, "app")}},
+		},
+	}
+
+	binaryPath, err := c.Compile(mainFile)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	if _, err := os.Stat(c.pchPath(&c.PrecompiledHeaders[0])); err != nil {
+		t.Errorf("precompiled header was not created in output directory")
+	}
+	buf := &bytes.Buffer{}
+	cmd := exec.Command(binaryPath)
+	cmd.Stdout = buf
+	if err := cmd.Run(); err != nil {
+		t.Errorf("Failed to execute %q", binaryPath)
+	} else if buf.String() != "Hello World!\n" {
+		t.Errorf("Program output not as expected: %q", buf.String())
+	}
+
+	pchCount := 0
+	objCount := 0
+	makePCHHook = func(file *File) {
+		pchCount++
+	}
+	makeObjectHook = func(file *File) {
+		objCount++
+	}
+	defer func() {
+		makePCHHook = nil
+		makeObjectHook = nil
+	}()
+
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Second compile failed: %v", err)
+	} else if pchCount != 0 || objCount != 0 {
+		t.Errorf("Expected nothing to be rebuilt: %d precompiled headers, %d objects", pchCount, objCount)
+	}
+
+	if runtime.GOOS == "darwin" {
+		if testing.Short() {
+			t.Skip("Skipping rest of the test because we need to sleep for a second on OS X")
+		}
+		time.Sleep(time.Second)
+	}
+	now := time.Now()
+	if err := os.Chtimes(header.Path, now, now); err != nil {
+		t.Fatalf("Failed to modify times for %q", header.Path)
+	}
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Third compile failed: %v", err)
+	} else if pchCount != 1 || objCount != 1 {
+		t.Errorf("Expected precompiled header and main.o to be rebuilt: %d precompiled headers, %d objects", pchCount, objCount)
+	}
+}
+
+func TestPrecompiledHeaderPaths(t *testing.T) {
+	c := &Compiler{OutputDir: "/build/default"}
+	a := &PrecompiledHeader{Header: &File{Path: "/src/a/common.h"}}
+	b := &PrecompiledHeader{Header: &File{Path: "/src/b/common.h"}}
+	aPath, bPath := c.pchPath(a), c.pchPath(b)
+	switch {
+	case aPath == bPath:
+		t.Errorf("Expected headers with the same name to have different paths: %s", aPath)
+	case filepath.Dir(aPath) != "/build/default/pch" || !strings.HasPrefix(filepath.Base(aPath), "common_") || !strings.HasSuffix(aPath, ".h.gch"):
+		t.Errorf("Unexpected precompiled header path: %s", aPath)
+	}
+
+	// the same relative layout gives the same path in another checkout
+	other := &Compiler{OutputDir: "/other/build/default"}
+	if otherPath := other.pchPath(&PrecompiledHeader{Header: &File{Path: "/other/src/a/common.h"}}); filepath.Base(otherPath) != filepath.Base(aPath) {
+		t.Errorf("Expected the same name in another checkout: %s and %s", otherPath, aPath)
+	}
+}
+
+func TestCompileUnityBuild(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	st.ProcessDirectory()
+
+	mainFile := st.FindSource("main")
+
+	c := &Compiler{
+		OutputDir: outputDir,
+		Unity:     &UnityBuild{Dir: filepath.Join(outputDir, "unity")},
+	}
+
+	var objects []string
+	makeObjectHook = func(file *File) {
+		objects = append(objects, filepath.Base(file.Path))
+	}
+	defer func() {
+		makeObjectHook = nil
+	}()
+
+	binaryPath, err := c.Compile(mainFile)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	if exp := []string{"unity_main_0.cc"}; !reflect.DeepEqual(exp, objects) {
+		t.Errorf("objects compiled not as expected:\nexp: %v\ngot: %v", exp, objects)
+	}
+	buf := &bytes.Buffer{}
+	cmd := exec.Command(binaryPath)
+	cmd.Stdout = buf
+	if err := cmd.Run(); err != nil || buf.String() != "Hello World!\n" {
+		t.Errorf("Failed to execute %q: %v %q", binaryPath, err, buf.String())
+	}
+
+	objects = nil
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Second compile failed: %v", err)
+	} else if len(objects) != 0 {
+		t.Errorf("Expected no objects to be rebuilt: %v", objects)
+	}
+
+	objects = nil
+	c.Unity.Excludes = []string{"a.cc"}
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Third compile failed: %v", err)
+	} else if sort.Strings(objects); !reflect.DeepEqual([]string{"a.cc", "main.cc"}, objects) {
+		t.Errorf("objects compiled not as expected: %v", objects)
+	}
+}
+
+func TestCompileUnityBuildPerDirectory(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot:     "test_files/unity",
+		AutoInclude: true,
+	}
+	st.ProcessDirectory()
+
+	c := &Compiler{
+		IncludeDirs: st.IncludeDirs,
+		OutputDir:   outputDir,
+		Unity: &UnityBuild{
+			Dir:          filepath.Join(outputDir, "unity"),
+			PerDirectory: true,
+		},
+	}
+
+	objCount := 0
+	makeObjectHook = func(file *File) {
+		objCount++
+	}
+	defer func() {
+		makeObjectHook = nil
+	}()
+
+	paths, err := c.CompileAll([]*File{st.FindSource("main"), st.FindSource("mainb")})
+	if err != nil {
+		t.Fatalf("CompileAll returned error: %v", err)
+	} else if objCount != 3 {
+		t.Errorf("Expected 3 objects to be built, actually %d were built", objCount)
+	}
+
+	expOutputs := []string{"Hello World!\n", "Hello\n"}
+	for i, path := range paths {
+		buf := &bytes.Buffer{}
+		cmd := exec.Command(path)
+		cmd.Stdout = buf
+		if err := cmd.Run(); err != nil || buf.String() != expOutputs[i] {
+			t.Errorf("Failed to execute %q: %v %q", path, err, buf.String())
+		}
+	}
+}
+
+// TestCompileUnityBuildConcurrent is most useful when run with -race, as the dependency
+// lists of the unity files are walked while other jobs walk those of the source tree.
+func TestCompileUnityBuildConcurrent(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot:     "test_files/unity",
+		AutoInclude: true,
+		Concurrency: 4,
+	}
+	st.ProcessDirectory()
+
+	c := &Compiler{
+		IncludeDirs: st.IncludeDirs,
+		OutputDir:   outputDir,
+		Concurrency: 4,
+		Unity: &UnityBuild{
+			Dir:          filepath.Join(outputDir, "unity"),
+			PerDirectory: true,
+		},
+	}
+	paths, err := c.CompileAll([]*File{st.FindSource("main"), st.FindSource("mainb")})
+	if err != nil {
+		t.Fatalf("CompileAll returned error: %v", err)
+	}
+	expOutputs := []string{"Hello World!\n", "Hello\n"}
+	for i, path := range paths {
+		if out, err := exec.Command(path).Output(); err != nil || string(out) != expOutputs[i] {
+			t.Errorf("Failed to execute %q: %v %q", path, err, out)
+		}
+	}
+}
+
+func TestCompileRestoresFromCache(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	st.ProcessDirectory()
+
+	mainFile := st.FindSource("main")
+
+	cache := &LocalCache{Dir: filepath.Join(outputDir, "cache")}
+	c := &Compiler{
+		OutputDir: filepath.Join(outputDir, "build"),
+		Cache:     cache,
+	}
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+
+	objCount := 0
+	binCount := 0
+	makeObjectHook = func(file *File) {
+		objCount++
+	}
+	makeBinaryHook = func(file *File) {
+		binCount++
+	}
+	defer func() {
+		makeBinaryHook = nil
+		makeObjectHook = nil
+	}()
+
+	// a clean build should be restored entirely from the cache
+	os.RemoveAll(c.OutputDir)
+	binaryPath, err := c.Compile(mainFile)
+	switch {
+	case err != nil:
+		t.Fatalf("Second compile failed: %v", err)
+	case objCount != 0:
+		t.Errorf("Expected no object files to be built: %d", objCount)
+	case binCount != 0:
+		t.Errorf("Expected no binary to be built: %d", binCount)
+	}
+	buf := &bytes.Buffer{}
+	cmd := exec.Command(binaryPath)
+	cmd.Stdout = buf
+	if err := cmd.Run(); err != nil || buf.String() != "Hello World!\n" {
+		t.Errorf("Failed to execute restored binary %q: %v %q", binaryPath, err, buf.String())
+	}
+
+	// different flags should not use the cached outputs
+	c.Flags = []string{"-DDIFFERENT_FLAGS"}
+	os.RemoveAll(c.OutputDir)
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Third compile failed: %v", err)
+	} else if objCount != 2 || binCount != 1 {
+		t.Errorf("Expected everything to be rebuilt: %d objects, %d binaries", objCount, binCount)
+	}
+}
+
+func TestCompileSandboxFindsMissedDependency(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := &SourceTree{
+		SrcRoot:         "test_files/fast_scan_fail",
+		UseFastScanning: true,
+	}
+	st.ProcessDirectory()
+
+	c := &Compiler{
+		OutputDir: outputDir,
+		Sandbox:   true,
+	}
+	_, err = c.Compile(st.FindSource("main"))
+	missing, ok := err.(*MissingDependencyError)
+	switch {
+	case !ok:
+		t.Fatalf("Expected a MissingDependencyError, got: %v", err)
+	case missing.Include != "myinc.h":
+		t.Errorf("Expected missing include to be myinc.h: %q", missing.Include)
+	case missing.File != filepath.Join(st.SrcRoot, "main.cc") || missing.Line != 8:
+		t.Errorf("location of missing include not as expected: %s:%d", missing.File, missing.Line)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(outputDir, "sandbox")); len(entries) != 0 {
+		t.Errorf("Expected sandbox to be removed after compiling")
+	}
+
+	st = &SourceTree{
+		SrcRoot: "test_files/fast_scan_fail",
+	}
+	st.ProcessDirectory()
+	if _, err := c.Compile(st.FindSource("main")); err != nil {
+		t.Errorf("Expected sandboxed compile to succeed with full scanning: %v", err)
+	}
+}
+
+func TestCompileSandboxExternalIncludeDirs(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	// headers of libraries outside of the source tree are not in the sandbox, so their
+	// include dirs must not be moved into it
+	files := map[string]string{
+		"ext/ext.h":     "#define EXT 0\n",
+		"sys/sys.h":     "#define SYS 0\n",
+		"quote/quote.h": "#define QUOTE 0\n",
+		"src/main.cc":   "#include <ext.h>\n#include <sys.h>\n#include \"quote.h\"\n#include \"lib.h\"\nint main() { return EXT + SYS + QUOTE + LIB; }\n",
+		"src/inc/lib.h": "#define LIB 0\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(outputDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	includeDir := filepath.Join(outputDir, "src/inc")
+	st := &SourceTree{
+		SrcRoot:     filepath.Join(outputDir, "src"),
+		IncludeDirs: []string{includeDir},
+	}
+	st.ProcessDirectory()
+
+	c := &Compiler{
+		OutputDir:   filepath.Join(outputDir, "build"),
+		IncludeDirs: st.IncludeDirs,
+		Sandbox:     true,
+		Flags: []string{
+			"-I" + filepath.Join(outputDir, "ext"),
+			"-isystem", filepath.Join(outputDir, "sys"),
+			"-iquote" + filepath.Join(outputDir, "quote"),
+		},
+	}
+	if _, err := c.Compile(st.FindSource("main")); err != nil {
+		t.Fatalf("Sandboxed compile failed: %v", err)
+	}
+
+	sb := &sandbox{dir: "/sandbox", includeDirs: []string{includeDir}}
+	args := sb.rewriteArgs([]string{"-I" + includeDir, "-isystem", includeDir, "-I/opt/ext/include", "-isystem", "/usr/local/include"}, "main.cc")
+	expected := []string{"-I/sandbox" + includeDir, "-isystem", "/sandbox" + includeDir, "-I/opt/ext/include", "-isystem", "/usr/local/include"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Unexpected sandboxed args:\ngot: %q\nexp: %q", args, expected)
+	}
+}
+
+func TestCompileDepFileCorrectsScannedGraph(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := &SourceTree{
+		SrcRoot:         "test_files/fast_scan_fail",
+		UseFastScanning: true,
+	}
+	st.ProcessDirectory()
+	mainFile := st.FindSource("main")
+
+	var missed, unused []string
+	objCount := 0
+	depFileMismatchHook = func(file *File, m, u []string) { missed, unused = m, u }
+	makeObjectHook = func(file *File) { objCount++ }
+	defer func() {
+		depFileMismatchHook = nil
+		makeObjectHook = nil
+	}()
+
+	c := &Compiler{OutputDir: outputDir}
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("First compile failed: %v", err)
+	}
+	header, _ := filepath.Abs(filepath.Join(st.SrcRoot, "myinc.h"))
+	if !reflect.DeepEqual(missed, []string{header}) {
+		t.Errorf("Expected myinc.h to be reported as missed by scanning: %v", missed)
+	}
+
+	objCount = 0
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Second compile failed: %v", err)
+	} else if objCount != 0 {
+		t.Errorf("Expected nothing to be rebuilt: %d", objCount)
+	}
+
+	if runtime.GOOS == "darwin" {
+		if testing.Short() {
+			t.Skip("Skipping rest of the test because we need to sleep for a second on OS X")
+		}
+		time.Sleep(time.Second)
+	}
+	info, err := os.Stat(header)
+	if err != nil {
+		t.Fatalf("Failed to stat %q: %v", header, err)
+	}
+	now := time.Now()
+	if err := os.Chtimes(header, now, now); err != nil {
+		t.Fatalf("Failed to modify times for %q", header)
+	}
+	defer os.Chtimes(header, info.ModTime(), info.ModTime())
+
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Third compile failed: %v", err)
+	} else if objCount != 1 {
+		t.Errorf("Expected main.o to be rebuilt after changing a header scanning missed: %d", objCount)
+	}
+
+	st = &SourceTree{SrcRoot: "test_files/fast_scan_fail"}
+	st.ProcessDirectory()
+	missed, unused = nil, nil
+	c = &Compiler{OutputDir: outputDir, Sandbox: true}
+	os.Chtimes(header, now.Add(time.Second), now.Add(time.Second))
+	if _, err := c.Compile(st.FindSource("main")); err != nil {
+		t.Fatalf("Sandboxed compile failed: %v", err)
+	} else if missed != nil || unused != nil {
+		t.Errorf("Expected no mismatch with full scanning in a sandbox: missed %v, unused %v", missed, unused)
+	}
+}
+
+func TestCompileCacheUsesRecordedHeaders(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	// scanning cannot follow an include of a macro, so only the dependency file knows
+	// about value.h
+	srcDir := filepath.Join(outputDir, "src")
+	os.Mkdir(srcDir, 0755)
+	mainSrc := "#include <stdio.h>\n#define HDR \"value.h\"\n#include HDR\nint main() { printf(\"%d\\n\", VALUE); return 0; }\n"
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "main.cc"), []byte(mainSrc), 0644); err != nil {
+		t.Fatalf("Failed to write main.cc: %v", err)
+	}
+	header := filepath.Join(srcDir, "value.h")
+
+	st := &SourceTree{SrcRoot: srcDir}
+	st.ProcessDirectory()
+	mainFile := st.FindSource("main")
+	if mainFile == nil {
+		t.Fatalf("Failed to find main.cc")
+	}
+
+	c := &Compiler{
+		OutputDir: filepath.Join(outputDir, "build"),
+		Cache:     &LocalCache{Dir: filepath.Join(outputDir, "cache")},
+	}
+	mtime := time.Now()
+	for i, value := range []int{1, 2, 1, 3} {
+		if err := ioutil.WriteFile(header, []byte(fmt.Sprintf("#define VALUE %d\n", value)), 0644); err != nil {
+			t.Fatalf("Failed to write value.h: %v", err)
+		}
+		mtime = mtime.Add(time.Second)
+		os.Chtimes(header, mtime, mtime)
+
+		binaryPath, err := c.Compile(mainFile)
+		if err != nil {
+			t.Fatalf("Compile %d failed: %v", i, err)
+		}
+		out, err := exec.Command(binaryPath).Output()
+		if err != nil {
+			t.Fatalf("Failed to execute %q: %v", binaryPath, err)
+		} else if want := fmt.Sprintf("%d\n", value); string(out) != want {
+			t.Errorf("Compile %d: expected output %q, got %q", i, want, out)
+		}
+	}
+}
+
+// blockingExecutor writes part of the output of each compile and then blocks until the
+// action is cancelled.
+type blockingExecutor struct {
+	started chan string
+}
+
+func (be *blockingExecutor) Execute(a *Action) error {
+	if a.Kind != CompileAction {
+		return fmt.Errorf("unexpected %s action", a.Kind)
+	}
+	ioutil.WriteFile(a.Outputs[0], []byte("partial"), 0644)
+	be.started <- a.Outputs[0]
+	<-a.Context.Done()
+	return errors.New("killed")
+}
+
+func TestCompileAllContextCancel(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	if err := st.ProcessDirectoryContext(context.Background()); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+
+	ex := &blockingExecutor{started: make(chan string, 3)}
+	c := &Compiler{OutputDir: outputDir, Concurrency: 2, Executor: ex}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-ex.started
+		<-ex.started
+		cancel()
+	}()
+	_, err = c.CompileAllContext(ctx, []*File{st.FindSource("main")})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled: %v", err)
+	}
+	if len(ex.started) != 0 {
+		t.Errorf("Expected no more compiles to be started after cancelling")
+	}
+	objects, _ := filepath.Glob(filepath.Join(outputDir, "obj", "*.o"))
+	if len(objects) != 0 {
+		t.Errorf("Expected partial objects to be removed: %v", objects)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	st = SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	if err := st.ProcessDirectoryContext(cancelled); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from processing directory: %v", err)
+	}
+}
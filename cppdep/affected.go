@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cgilling/cppdep"
+)
+
+// changedFiles returns the paths of the files changed since the git revision since in
+// the git repository that contains srcRoot: those that differ between since and the
+// working tree, including uncommitted changes, and untracked files that are not
+// ignored. Paths within srcRoot are joined to it as given, so that they match the
+// paths of the source tree even if srcRoot is reached through a symlink.
+func changedFiles(srcRoot, since string) ([]string, error) {
+	top, err := gitOutput(srcRoot, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	top = strings.TrimSpace(top)
+	diff, err := gitOutput(srcRoot, "diff", "--name-only", "-z", since, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := gitOutput(srcRoot, "ls-files", "--others", "--exclude-standard", "--full-name", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	realSrcRoot, err := filepath.EvalSymlinks(srcRoot)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range strings.Split(diff+untracked, "\x00") {
+		if name == "" {
+			continue
+		}
+		path := filepath.Join(top, filepath.FromSlash(name))
+		if rel, err := filepath.Rel(realSrcRoot, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			path = filepath.Join(srcRoot, rel)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// gitOutput runs git with args in dir and returns its output.
+func gitOutput(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return stdout.String(), nil
+}
+
+// affectedFiles returns the binaries and libraries of b affected by changes to the
+// files at paths. All of them are affected if the config file at configPath changed.
+// The libraries of the config are included unless binaries were named on the command
+// line.
+func affectedFiles(b *build, configPath string, paths []string) []*cppdep.File {
+	candidates := b.files
+	for _, name := range *b.opts.binaryNames {
+		if name == "*" {
+			candidates = appendMissingFiles(candidates, b.libraryFiles())
+			break
+		}
+	}
+	realConfigPath, _ := filepath.EvalSymlinks(configPath)
+	for _, path := range paths {
+		if realPath, err := filepath.EvalSymlinks(path); err == nil && realPath == realConfigPath {
+			return candidates
+		}
+	}
+	return filterBinaries(candidates, b.st.Affected(paths))
+}
+
+// appendMissingFiles appends the files in extra that are not already in files.
+func appendMissingFiles(files, extra []*cppdep.File) []*cppdep.File {
+	in := make(map[*cppdep.File]bool)
+	for _, file := range files {
+		in[file] = true
+	}
+	files = append([]*cppdep.File{}, files...)
+	for _, file := range extra {
+		if !in[file] {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// filterBinaries returns the binaries and libraries in candidates that are in files.
+func filterBinaries(candidates, files []*cppdep.File) []*cppdep.File {
+	in := make(map[*cppdep.File]bool)
+	for _, file := range files {
+		in[file] = true
+	}
+	var binFiles []*cppdep.File
+	for _, binFile := range candidates {
+		if in[binFile] {
+			binFiles = append(binFiles, binFile)
+		}
+	}
+	return binFiles
+}
+
+// printBinaryNames writes the sorted names of the binaries and libraries that files
+// are built into.
+func printBinaryNames(w io.Writer, b *build, files []*cppdep.File) {
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(b.c.BinPath(file)))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestChangedFiles(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "cppdep_affected_test")
+	if err != nil {
+		t.Fatalf("Failed to setup repo dir")
+	}
+	defer os.RemoveAll(repoDir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repoDir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+	write := func(name, contents string) {
+		path := filepath.Join(repoDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to make dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	write("cppdep.yml", "srcdir: src\n")
+	write("src/a.h", "int a();\n")
+	write("src/a.cc", "int a() { return 1; }\n")
+	write(".gitignore", "build/\n")
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "initial")
+
+	write("src/a.h", "int a(); // changed\n")
+	write("src/new.cc", "int b() { return 2; }\n")
+	write("cppdep.yml", "srcdir: src\nbuilddir: build\n")
+	write("build/a.o", "ignored\n")
+
+	// the source root is reached through a symlink, as the paths of the source tree are
+	linkDir, err := ioutil.TempDir("", "cppdep_affected_link")
+	if err != nil {
+		t.Fatalf("Failed to setup link dir")
+	}
+	defer os.RemoveAll(linkDir)
+	srcRoot := filepath.Join(linkDir, "src")
+	if err := os.Symlink(filepath.Join(repoDir, "src"), srcRoot); err != nil {
+		t.Fatalf("Failed to symlink source root: %v", err)
+	}
+
+	paths, err := changedFiles(srcRoot, "HEAD")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	realRepoDir, _ := filepath.EvalSymlinks(repoDir)
+	sort.Strings(paths)
+	expected := []string{filepath.Join(linkDir, "src/a.h"), filepath.Join(linkDir, "src/new.cc"), filepath.Join(realRepoDir, "cppdep.yml")}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Unexpected changed files:\n%q\nexpected:\n%q", paths, expected)
+	}
+
+	if _, err := changedFiles(srcRoot, "nosuchrev"); err == nil {
+		t.Errorf("Expected an error for an unknown revision")
+	}
+}
+
+func TestAffectedFilesIncludesLibraries(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_affected_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	srcDir := filepath.Join(outputDir, "src")
+	files := map[string]string{
+		"main.cc":      "#include \"util/util.h\"\n\nint main(int argc, char** argv) { return util(); }\n",
+		"util/util.h":  "int util();\n",
+		"util/util.cc": "#include \"util.h\"\n\nint util() { return 0; }\n",
+		"lib/lib.h":    "int lib();\n",
+		"lib/lib.cc":   "#include \"lib.h\"\n\nint lib() { return 1; }\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to make dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	confPath := filepath.Join(outputDir, "cppdep.yml")
+	conf := "srcdir: " + srcDir + "\nbuilddir: " + filepath.Join(outputDir, "build") + "\n" +
+		"libraries:\n  mylib:\n    sources: [lib/lib.cc]\n"
+	if err := ioutil.WriteFile(confPath, []byte(conf), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	opts := newBuildOptions()
+	*opts.configPath = confPath
+	*opts.progress = "plain"
+	b := setupBuild(opts)
+	defer b.close()
+
+	affected := func(paths ...string) string {
+		var buf bytes.Buffer
+		printBinaryNames(&buf, b, affectedFiles(b, confPath, paths))
+		return buf.String()
+	}
+	if names := affected(filepath.Join(srcDir, "lib/lib.h")); names != "mylib.so\n" {
+		t.Errorf("Expected only the library to be affected by lib.h: %q", names)
+	}
+	if names := affected(filepath.Join(srcDir, "util/util.h")); names != "main\n" {
+		t.Errorf("Expected only main to be affected by util.h: %q", names)
+	}
+	if names := affected(confPath); names != "main\nmylib.so\n" {
+		t.Errorf("Expected everything to be affected by the config: %q", names)
+	}
+}
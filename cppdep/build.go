@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+
+	"github.com/cgilling/cppdep"
+	cli "github.com/jawher/mow.cli"
+)
+
+// buildOptions are the command line options that set up a build.
+type buildOptions struct {
+	configPath     *string
+	srcDir         *string
+	mode           *string
+	concurrency    *int
+	compileJobs    *int
+	linkJobs       *int
+	generateJobs   *int
+	scanJobs       *int
+	compileMemory  *string
+	linkMemory     *string
+	fast           *bool
+	unity          *bool
+	sandbox        *bool
+	dryRun         *bool
+	verboseFlag    *bool
+	compileWrapper *string
+	progress       *string
+	binaryNames    *[]string
+
+	cpuprofile      *string
+	tracePath       *string
+	timings         *bool
+	diagnosticsPath *string
+	sarifPath       *string
+}
+
+// newBuildOptions returns build options set to their defaults.
+func newBuildOptions() *buildOptions {
+	opts := &buildOptions{
+		configPath:      new(string),
+		srcDir:          new(string),
+		mode:            new(string),
+		concurrency:     new(int),
+		compileJobs:     new(int),
+		linkJobs:        new(int),
+		generateJobs:    new(int),
+		scanJobs:        new(int),
+		compileMemory:   new(string),
+		linkMemory:      new(string),
+		fast:            new(bool),
+		unity:           new(bool),
+		sandbox:         new(bool),
+		dryRun:          new(bool),
+		verboseFlag:     new(bool),
+		compileWrapper:  new(string),
+		progress:        new(string),
+		binaryNames:     new([]string),
+		cpuprofile:      new(string),
+		tracePath:       new(string),
+		timings:         new(bool),
+		diagnosticsPath: new(string),
+		sarifPath:       new(string),
+	}
+	*opts.mode = "default"
+	*opts.concurrency = 1
+	*opts.progress = "auto"
+	return opts
+}
+
+// addProjectOptions declares the options that select the config, source tree and mode
+// on cmd. They are declared on the app and again on each subcommand, defaulting to the
+// values given before the subcommand, so that they can be given on either side of it.
+func (opts *buildOptions) addProjectOptions(cmd *cli.Cmd) {
+	cmd.BoolOptPtr(opts.verboseFlag, "v verbose", *opts.verboseFlag, "enable verbose logging")
+	cmd.StringOptPtr(opts.configPath, "config", *opts.configPath, "path to yaml config")
+	cmd.StringOptPtr(opts.mode, "mode", *opts.mode, "select a build mode")
+	cmd.BoolOptPtr(opts.fast, "fast", *opts.fast, "Set to enable fast file scanning")
+	cmd.StringOptPtr(opts.srcDir, "src", *opts.srcDir, "path to the src directory")
+	cmd.BoolOptPtr(opts.unity, "unity", *opts.unity, "Compile batches of sources together as single translation units")
+}
+
+// addBuildOptions declares the options that control how binaries are built on cmd, in
+// the same way as addProjectOptions.
+func (opts *buildOptions) addBuildOptions(cmd *cli.Cmd) {
+	cmd.IntOptPtr(opts.concurrency, "c concurrency", *opts.concurrency, "How much concurrency to we want to allow")
+	cmd.IntOptPtr(opts.compileJobs, "compile-jobs", *opts.compileJobs, "maximum number of concurrent compiles (default: --concurrency)")
+	cmd.IntOptPtr(opts.linkJobs, "link-jobs", *opts.linkJobs, "maximum number of concurrent links (default: --concurrency)")
+	cmd.IntOptPtr(opts.generateJobs, "generate-jobs", *opts.generateJobs, "maximum number of concurrent generators (default: 1)")
+	cmd.IntOptPtr(opts.scanJobs, "scan-jobs", *opts.scanJobs, "number of files to scan for dependencies concurrently (default: --concurrency)")
+	cmd.StringOptPtr(opts.compileMemory, "compile-memory", *opts.compileMemory, "memory each compile needs, such as 1G, compiles wait until it is available")
+	cmd.StringOptPtr(opts.linkMemory, "link-memory", *opts.linkMemory, "memory each link needs, such as 4G, links wait until it is available")
+	cmd.StringOptPtr(opts.cpuprofile, "cpuprof", *opts.cpuprofile, "file to write the cpu profile to")
+	cmd.BoolOptPtr(opts.sandbox, "sandbox", *opts.sandbox, "Compile each object in a sandbox containing only its scanned dependencies, to find missed dependencies")
+	cmd.BoolOptPtr(opts.dryRun, "n dry-run", *opts.dryRun, "Print the compile and link commands that would be run, but do not run them")
+	cmd.StringOptPtr(opts.compileWrapper, "compile-wrapper", *opts.compileWrapper, "command (such as distcc) to prefix compile commands with, overrides compilewrapper in the config")
+	cmd.StringOptPtr(opts.tracePath, "trace", *opts.tracePath, "path to write a Chrome trace_event JSON timeline of the build to (default: trace.json in the mode's build dir)")
+	cmd.BoolOptPtr(opts.timings, "timings", *opts.timings, "print a summary of where build time was spent")
+	cmd.StringOptPtr(opts.diagnosticsPath, "diagnostics", *opts.diagnosticsPath, "path to write compiler errors and warnings to as JSON lines")
+	cmd.StringOptPtr(opts.sarifPath, "sarif", *opts.sarifPath, "path to write compiler errors and warnings to as a SARIF log")
+	cmd.StringOptPtr(opts.progress, "progress", *opts.progress, "how to show build progress: smart (redraw a status line in place), plain (a line per command) or auto (smart when writing to a terminal)")
+}
+
+// addBinaryNamesArg declares the BINARY_NAMES argument on cmd.
+func (opts *buildOptions) addBinaryNamesArg(cmd *cli.Cmd) {
+	cmd.StringsArgPtr(
+		opts.binaryNames,
+		"BINARY_NAMES",
+		nil,
+		"name of the binary to build, main source file should be BINARY_NAME.cc, this can be a globbing expression as well."+
+			" A '*' on its own means 'all autodetected main source files'",
+	)
+}
+
+// build is a build of binaries set up from the config and the command line options.
+type build struct {
+	opts   *buildOptions
+	ctx    context.Context
+	config *Config
+	st     *cppdep.SourceTree
+	c      *cppdep.Compiler
+	trace  *cppdep.Trace
+	local  *cppdep.LocalCache
+	files  []*cppdep.File
+}
+
+// setupBuild reads the config, processes the source tree and sets up the compiler for
+// the binaries named on the command line. close must be called once the build is done.
+func setupBuild(opts *buildOptions) *build {
+	config := loadConfig(opts.configPath)
+	ctx := cancelOnSignal()
+
+	limits, err := resolveJobLimits(config.Jobs, JobsConfig{
+		Compile:       *opts.compileJobs,
+		Link:          *opts.linkJobs,
+		Generate:      *opts.generateJobs,
+		Scan:          *opts.scanJobs,
+		CompileMemory: *opts.compileMemory,
+		LinkMemory:    *opts.linkMemory,
+	}, *opts.concurrency)
+	if err != nil {
+		log.Fatalf("Invalid job limits: %v", err)
+	}
+	js := jobserver(&limits)
+
+	err = os.MkdirAll(config.BuildDir, 0755)
+	if err != nil {
+		log.Fatalf("Failed to create build dir: %s (%v)", config.BuildDir, err)
+	}
+
+	if *opts.srcDir == "" && config.SrcDir == "" {
+		log.Fatalf("a source directory must be set through --src or config.srcdir")
+	} else if *opts.srcDir == "" {
+		if filepath.IsAbs(config.SrcDir) {
+			*opts.srcDir = config.SrcDir
+		} else {
+			*opts.srcDir = filepath.Join(filepath.Dir(*opts.configPath), config.SrcDir)
+		}
+	}
+
+	selectMode(config, *opts.mode)
+
+	if runtime.GOMAXPROCS(0) == 1 {
+		maxProcs := maxGoProcs
+		if runtime.NumCPU() < maxProcs {
+			maxProcs = runtime.NumCPU()
+		}
+		if *opts.concurrency < maxProcs {
+			maxProcs = *opts.concurrency
+		}
+		runtime.GOMAXPROCS(maxProcs)
+	}
+
+	var gens []cppdep.Generator
+	for _, gen := range config.TypeGenerators {
+		gens = append(gens, &cppdep.TypeGenerator{
+			InputExt:   gen.InputExt,
+			OutputExts: gen.OutputExts,
+			Command:    gen.Command,
+		})
+	}
+	for _, gen := range config.ShellGenerators {
+		gens = append(gens, &cppdep.ShellGenerator{
+			InputPaths:    gen.InputPaths,
+			OutputFiles:   gen.OutputFiles,
+			ShellFilePath: filepath.Join(*opts.srcDir, gen.Path),
+		})
+	}
+
+	libraries := make(map[string][]string)
+	for libname, libConf := range config.Libraries {
+		libraries[libname] = libConf.Sources
+	}
+
+	linkLibraries := make(map[string][]string)
+	pkgConfigLibraries := make(map[string]string)
+	for include, linkConf := range config.LinkLibraries {
+		if linkConf.PkgConfig != "" {
+			pkgConfigLibraries[include] = linkConf.PkgConfig
+		} else {
+			linkLibraries[include] = linkConf.Flags
+		}
+	}
+
+	buildDir := filepath.Join(config.BuildDir, platform)
+	trace := cppdep.NewTrace()
+	progress := newProgress(*opts.progress, os.Stdout)
+	if *opts.dryRun {
+		progress = nil
+	}
+
+	st := &cppdep.SourceTree{
+		SrcRoot:              *opts.srcDir,
+		AutoInclude:          config.AutoInclude,
+		IncludeDirs:          config.Includes,
+		ExcludeDirs:          config.Excludes,
+		LinkLibraries:        linkLibraries,
+		PkgConfigLibraries:   pkgConfigLibraries,
+		Libraries:            libraries,
+		SourceLibs:           config.SourceLibs,
+		Concurrency:          limits.scan,
+		GeneratorConcurrency: limits.generate,
+		Executor:             jobserverExecutor(js, nil),
+		UseFastScanning:      *opts.fast,
+		Generators:           gens,
+		BuildDir:             buildDir,
+		Trace:                trace,
+		Progress:             progress,
+	}
+	if err := st.ProcessDirectoryContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			exitInterrupted()
+		}
+		log.Fatalf("Failed to process source directory: %s (%v)", *opts.srcDir, err)
+	}
+
+	if err := st.Rename(config.Binary.Rename); err != nil {
+		log.Fatalf("Failed to rename files: %v", err)
+	}
+
+	flags, linkFlags := modeFlags(config, *opts.mode)
+
+	var linkPatterns []string
+	for pattern := range config.Binary.Link {
+		linkPatterns = append(linkPatterns, pattern)
+	}
+	sort.Strings(linkPatterns)
+	var binaryLinks []cppdep.BinaryLink
+	for _, pattern := range linkPatterns {
+		if _, err := filepath.Match(pattern, "testthis"); err != nil {
+			log.Fatalf("invalid binary link pattern: %q", pattern)
+		}
+		binaryLinks = append(binaryLinks, cppdep.BinaryLink{
+			Pattern: pattern,
+			Flags:   config.Binary.Link[pattern].LinkFlags,
+			Libs:    config.Binary.Link[pattern].Libs,
+		})
+	}
+
+	var pchs []cppdep.PrecompiledHeader
+	for _, pchConf := range config.PrecompiledHeaders {
+		header := st.FindFile(pchConf.Header)
+		if header == nil {
+			log.Fatalf("Unable to find precompiled header: %q", pchConf.Header)
+		}
+		var scope []string
+		for _, dir := range pchConf.Scope {
+			scope = append(scope, filepath.Join(st.SrcRoot, dir))
+		}
+		pchs = append(pchs, cppdep.PrecompiledHeader{Header: header, Scope: scope})
+	}
+
+	c := &cppdep.Compiler{
+		OutputDir:   modeOutputDir(config, *opts.mode),
+		IncludeDirs: st.IncludeDirs,
+		Flags:       flags,
+		LinkFlags:   linkFlags,
+		BinaryLinks: binaryLinks,
+		LinkDeps:    config.LinkDeps,
+		Concurrency: limits.total,
+		Verbose:     *opts.verboseFlag,
+
+		CompileConcurrency: limits.compile,
+		LinkConcurrency:    limits.link,
+		CompileMemory:      limits.compileMemory,
+		LinkMemory:         limits.linkMemory,
+		Sandbox:            *opts.sandbox,
+		Trace:              trace,
+		Diagnostics:        cppdep.NewDiagnostics(),
+		Progress:           progress,
+
+		PrecompiledHeaders: pchs,
+	}
+	cache, local, err := buildCache(config, *opts.configPath)
+	if err != nil {
+		log.Fatalf("Failed to setup build cache: %v", err)
+	}
+	c.Cache = cache
+	c.CacheRoots = []string{st.SrcRoot, config.BuildDir}
+
+	wrapper := config.CompileWrapper
+	if *opts.compileWrapper != "" {
+		wrapper = strings.Fields(*opts.compileWrapper)
+	}
+	if len(wrapper) > 0 {
+		c.Executor = &cppdep.WrapperExecutor{
+			Wrapper: wrapper,
+			Kinds:   []string{cppdep.CompileAction},
+		}
+	}
+	c.Executor = jobserverExecutor(js, c.Executor)
+	if *opts.dryRun {
+		c.Executor = &cppdep.DryRunExecutor{W: os.Stdout}
+		c.Cache = nil
+	}
+	if *opts.unity {
+		var excludes []string
+		for _, pattern := range config.Unity.Excludes {
+			if strings.Contains(pattern, "/") {
+				pattern = filepath.Join(st.SrcRoot, pattern)
+			}
+			excludes = append(excludes, pattern)
+		}
+		c.Unity = &cppdep.UnityBuild{
+			Dir:          filepath.Join(st.GenDir(), "unity"),
+			BatchSize:    config.Unity.BatchSize,
+			PerDirectory: config.Unity.PerDirectory,
+			Excludes:     excludes,
+		}
+	}
+
+	var files []*cppdep.File
+	if *opts.binaryNames == nil {
+		*opts.binaryNames = []string{"*"}
+	}
+
+	for _, binaryName := range *opts.binaryNames {
+		if binaryName == "*" {
+			files, err = st.FindMainFiles()
+			if err != nil {
+				log.Fatalf("failes to automatically find main files: %v", err)
+			}
+		} else {
+			f, err := st.FindSources(binaryName)
+			if err != nil {
+				log.Fatalf("invalid pattern: %q", binaryName)
+			}
+			files = append(files, f...)
+		}
+	}
+
+	return &build{
+		opts:   opts,
+		ctx:    ctx,
+		config: config,
+		st:     st,
+		c:      c,
+		trace:  trace,
+		local:  local,
+		files:  files,
+	}
+}
+
+// selectMode checks that mode is one of the modes of config, adding the default mode
+// if the config does not define it.
+func selectMode(config *Config, mode string) {
+	if config.Modes == nil {
+		config.Modes = make(map[string]ModeConfig)
+	}
+
+	if _, ok := config.Modes["default"]; !ok {
+		config.Modes["default"] = ModeConfig{}
+	}
+
+	if _, ok := config.Modes[mode]; !ok {
+		log.Fatalf("Cannot find requested mode %q", mode)
+	}
+}
+
+// modeOutputDir returns the directory that the objects and binaries of mode are
+// written to.
+func modeOutputDir(config *Config, mode string) string {
+	return filepath.Join(config.BuildDir, platform, mode)
+}
+
+// modeFlags returns the compile and link flags of the mode of config, which are added
+// to the flags that apply to all modes.
+func modeFlags(config *Config, mode string) (flags, linkFlags []string) {
+	flags = append(append(flags, config.Flags...), config.Modes[mode].Flags...)
+	linkFlags = append(append(linkFlags, config.LinkFlags...), config.Modes[mode].LinkFlags...)
+	return flags, linkFlags
+}
+
+// fatalf closes b, so that the statistics of the build cache are saved and it is kept
+// within its size even when the build fails, and then exits like log.Fatalf.
+func (b *build) fatalf(format string, v ...interface{}) {
+	b.close()
+	log.Fatalf(format, v...)
+}
+
+// libraryFiles returns the libraries defined by the config, sorted by name. They are
+// not main files, so they are only in files when named on the command line.
+func (b *build) libraryFiles() []*cppdep.File {
+	var names []string
+	for name := range b.st.Libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var files []*cppdep.File
+	for _, name := range names {
+		if file := b.st.FindSource(name); file != nil {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// close saves the statistics of the local build cache.
+func (b *build) close() {
+	if b.local != nil {
+		if err := b.local.Flush(); err != nil {
+			log.Printf("Failed to write build cache stats: %v", err)
+		}
+	}
+}
+
+// startCPUProfile starts writing a cpu profile to the path given by the cpuprof option,
+// if any, returning a function that stops it.
+func startCPUProfile(opts *buildOptions) func() {
+	if *opts.cpuprofile == "" {
+		return func() {}
+	}
+	f, err := os.Create(*opts.cpuprofile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pprof.StartCPUProfile(f)
+	return pprof.StopCPUProfile
+}
+
+// buildBinaries compiles the binaries of b and links them into the bin dir of the
+// build dir, returning their paths.
+func buildBinaries(b *build) []string {
+	ctx, config, st, c, trace, opts := b.ctx, b.config, b.st, b.c, b.trace, b.opts
+	binPaths, err := c.CompileAllContext(ctx, b.files)
+	if *opts.tracePath == "" {
+		*opts.tracePath = filepath.Join(c.OutputDir, "trace.json")
+	}
+	if err := writeTrace(trace, *opts.tracePath); err != nil {
+		log.Printf("Failed to write build trace: %v", err)
+	}
+	if *opts.timings {
+		trace.WriteSummary(os.Stdout, 10)
+	}
+	writeDiagnostics(c.Diagnostics, *opts.diagnosticsPath, *opts.sarifPath, st.SrcRoot)
+	if err != nil {
+		if ctx.Err() != nil {
+			b.close()
+			exitInterrupted()
+		}
+		b.fatalf("Compile returned error: %v", err)
+	}
+	if *opts.dryRun {
+		return binPaths
+	}
+	binDir := filepath.Join(config.BuildDir, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		b.fatalf("Failed to make directory: %q (%v)", binDir, err)
+	}
+	for _, path := range binPaths {
+		symPath := filepath.Join(binDir, filepath.Base(path))
+		relPath, err := filepath.Rel(binDir, path)
+		if err != nil {
+			b.fatalf("failed to get relative path of binary: %v", err)
+		}
+		linkPath, err := os.Readlink(symPath)
+		if err == nil && linkPath != relPath {
+			if err := os.Remove(symPath); err != nil {
+				b.fatalf("Failed to remove old symlink: %v", err)
+			}
+		}
+		if err != nil || linkPath != relPath {
+			if err := os.Symlink(relPath, symPath); err != nil {
+				b.fatalf("Failed to symlink file: %v", err)
+			}
+		}
+	}
+	return binPaths
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cgilling/cppdep"
+)
+
+type CacheConfig struct {
+	Dir     string
+	MaxSize string
+	Remote  RemoteCacheConfig
+}
+
+type RemoteCacheConfig struct {
+	URL     string
+	Mode    string // readwrite (the default) or readonly
+	Timeout string // for example "5s", parsed by time.ParseDuration
+}
+
+// buildCache returns the cache to be used for the build, combining the local and
+// remote caches if both are configured. The local cache is also returned (or nil if
+// not configured) so that its stats can be flushed at the end of the build.
+func buildCache(config *Config, configPath string) (cppdep.Cache, *cppdep.LocalCache, error) {
+	local, err := localCache(config, configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	remote, err := remoteCache(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case local != nil && remote != nil:
+		return cppdep.MultiCache{local, remote}, local, nil
+	case local != nil:
+		return local, local, nil
+	case remote != nil:
+		return remote, nil, nil
+	}
+	return nil, nil, nil
+}
+
+func remoteCache(config *Config) (*cppdep.RemoteCache, error) {
+	rconf := config.Cache.Remote
+	if rconf.URL == "" {
+		return nil, nil
+	}
+	rc := &cppdep.RemoteCache{URL: rconf.URL}
+	switch rconf.Mode {
+	case "", "readwrite":
+	case "readonly":
+		rc.ReadOnly = true
+	default:
+		return nil, fmt.Errorf("invalid remote cache mode: %q", rconf.Mode)
+	}
+	if rconf.Timeout != "" {
+		timeout, err := time.ParseDuration(rconf.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		rc.Timeout = timeout
+	}
+	return rc, nil
+}
+
+// localCache returns the local build cache defined in config, or nil if no cache
+// directory is configured. A relative cache dir is relative to the directory of the
+// config file, and a leading ~ is expanded to the home directory.
+func localCache(config *Config, configPath string) (*cppdep.LocalCache, error) {
+	if config.Cache.Dir == "" {
+		return nil, nil
+	}
+	dir := config.Cache.Dir
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, dir[1:])
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(configPath), dir)
+	}
+
+	var maxSize int64
+	if config.Cache.MaxSize != "" {
+		var err error
+		if maxSize, err = parseSize(config.Cache.MaxSize); err != nil {
+			return nil, err
+		}
+	}
+	return &cppdep.LocalCache{Dir: dir, MaxSize: maxSize}, nil
+}
+
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix (for example
+// "500M" or "10G").
+func parseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+	mult := int64(1)
+	for _, ss := range sizeSuffixes {
+		if strings.HasSuffix(str, ss.suffix) {
+			str = strings.TrimSuffix(str, ss.suffix)
+			mult = ss.mult
+			break
+		}
+	}
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(val * float64(mult)), nil
+}
+
+func formatSize(size int64) string {
+	for i := len(sizeSuffixes) - 1; i >= 0; i-- {
+		if size >= sizeSuffixes[i].mult {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(sizeSuffixes[i].mult), sizeSuffixes[i].suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+func printCacheStats(w io.Writer, cache *cppdep.LocalCache) error {
+	stats, err := cache.Stats()
+	if err != nil {
+		return err
+	}
+	hitRate := 0.0
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		hitRate = 100 * float64(stats.Hits) / float64(lookups)
+	}
+	maxSize := "unlimited"
+	if cache.MaxSize > 0 {
+		maxSize = formatSize(cache.MaxSize)
+	}
+	fmt.Fprintf(w, "cache directory: %s\n", cache.Dir)
+	fmt.Fprintf(w, "hits:            %d\n", stats.Hits)
+	fmt.Fprintf(w, "misses:          %d\n", stats.Misses)
+	fmt.Fprintf(w, "hit rate:        %.1f%%\n", hitRate)
+	fmt.Fprintf(w, "stores:          %d\n", stats.Stores)
+	fmt.Fprintf(w, "evictions:       %d\n", stats.Evictions)
+	fmt.Fprintf(w, "entries:         %d\n", stats.Entries)
+	fmt.Fprintf(w, "size:            %s\n", formatSize(stats.Size))
+	fmt.Fprintf(w, "max size:        %s\n", maxSize)
+	return nil
+}
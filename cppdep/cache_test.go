@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cgilling/cppdep"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp int64
+	}{
+		{"1024", 1024},
+		{"10K", 10 << 10},
+		{"500M", 500 << 20},
+		{"1.5G", 3 << 29},
+		{"2gb", 2 << 30},
+	}
+	for _, test := range tests {
+		if got, err := parseSize(test.in); err != nil || got != test.exp {
+			t.Errorf("parseSize(%q) = %d, %v; expected %d", test.in, got, err, test.exp)
+		}
+	}
+	if _, err := parseSize("lots"); err == nil {
+		t.Errorf("Expected error for invalid size")
+	}
+}
+
+func TestBuildCache(t *testing.T) {
+	config := &Config{Cache: CacheConfig{
+		Dir:    "cache",
+		Remote: RemoteCacheConfig{URL: "http://localhost:8080", Mode: "readonly", Timeout: "5s"},
+	}}
+	cache, local, err := buildCache(config, "/src/cppdep.yml")
+	if err != nil {
+		t.Fatalf("buildCache returned error: %v", err)
+	}
+	mc, ok := cache.(cppdep.MultiCache)
+	switch {
+	case !ok || len(mc) != 2:
+		t.Fatalf("Expected local and remote caches to be combined: %#v", cache)
+	case local == nil || local.Dir != "/src/cache":
+		t.Errorf("local cache not as expected: %#v", local)
+	}
+	remote := mc[1].(*cppdep.RemoteCache)
+	if !remote.ReadOnly || remote.Timeout != 5*time.Second {
+		t.Errorf("remote cache not as expected: %#v", remote)
+	}
+
+	config.Cache.Remote.Mode = "writeonly"
+	if _, _, err := buildCache(config, "/src/cppdep.yml"); err == nil {
+		t.Errorf("Expected error for invalid remote cache mode")
+	}
+}
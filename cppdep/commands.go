@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cgilling/cppdep"
+	"gopkg.in/yaml.v2"
+)
+
+// listBinaries writes the paths of the binaries of b that would be built.
+func listBinaries(w io.Writer, b *build) {
+	files := append([]*cppdep.File{}, b.files...)
+	sort.Sort(cppdep.ByBase(files))
+	for _, file := range files {
+		fmt.Fprintln(w, b.c.BinPath(file))
+	}
+}
+
+// findFile returns the file of st named by name, which is either a path, absolute or
+// relative to the source root, or the name of a binary.
+func findFile(st *cppdep.SourceTree, name string) (*cppdep.File, error) {
+	if file := st.FindFile(name); file != nil {
+		return file, nil
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		if file := st.FindFile(abs); file != nil {
+			return file, nil
+		}
+	}
+	if file := st.FindSource(name); file != nil {
+		return file, nil
+	}
+	return nil, fmt.Errorf("no file or binary named %q in the source tree", name)
+}
+
+// displayPath returns path relative to the source root if it is within it.
+func displayPath(st *cppdep.SourceTree, path string) string {
+	rel, err := filepath.Rel(st.SrcRoot, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
+}
+
+// printDeps writes the files that file depends on. If sources is set the sources that
+// implement the headers it includes, and their dependencies, are written too.
+func printDeps(w io.Writer, st *cppdep.SourceTree, file *cppdep.File, sources bool) {
+	deps := file.DepList()
+	if sources {
+		deps = file.DepListFollowSource()
+	}
+	var paths []string
+	for _, dep := range deps {
+		paths = append(paths, displayPath(st, dep.Path))
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintln(w, path)
+	}
+}
+
+// printRdeps writes the files that depend on file. If binaries is set, only the names
+// of the binaries of b that are built from file are written.
+func printRdeps(w io.Writer, b *build, file *cppdep.File, binaries bool) {
+	dependents := b.st.Dependents(file)
+	if !binaries {
+		for _, dep := range dependents {
+			fmt.Fprintln(w, displayPath(b.st, dep.Path))
+		}
+		return
+	}
+	printBinaryNames(w, b, filterBinaries(b.files, append(dependents, file)))
+}
+
+// writeGraph writes the dependency graph of the binaries of b in the Graphviz dot
+// format. Binaries are drawn as boxes, and the edges from headers to the sources that
+// implement them are dashed.
+func writeGraph(w io.Writer, b *build) {
+	nodes := make(map[*cppdep.File]bool)
+	for _, file := range b.files {
+		nodes[file] = true
+		for _, dep := range file.DepListFollowSource() {
+			nodes[dep] = true
+		}
+	}
+	var files []*cppdep.File
+	for file := range nodes {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	isBinary := make(map[*cppdep.File]bool)
+	for _, file := range b.files {
+		isBinary[file] = true
+	}
+
+	name := func(file *cppdep.File) string {
+		return fmt.Sprintf("%q", displayPath(b.st, file.Path))
+	}
+	fmt.Fprintln(w, "digraph cppdep {")
+	for _, file := range files {
+		if isBinary[file] {
+			fmt.Fprintf(w, "  %s [shape=box];\n", name(file))
+		}
+	}
+	for _, file := range files {
+		for _, dep := range file.Deps {
+			fmt.Fprintf(w, "  %s -> %s;\n", name(file), name(dep))
+		}
+		for _, source := range file.ImplFiles {
+			fmt.Fprintf(w, "  %s -> %s [style=dashed];\n", name(file), name(source))
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// explainBuild writes the outputs of b that would be built and why.
+func explainBuild(w io.Writer, b *build) error {
+	rebuilds, err := b.c.Explain(b.files)
+	if err != nil {
+		return err
+	}
+	if len(rebuilds) == 0 {
+		fmt.Fprintln(w, "Nothing to build, all outputs are up to date")
+	}
+	for _, rebuild := range rebuilds {
+		fmt.Fprintf(w, "%s: %s\n", rebuild.Output, rebuild.Reason)
+	}
+	return nil
+}
+
+// cleanMode removes the objects, binaries and other outputs of mode, or those of every
+// mode of the config along with the generated files if all is set. The links in the
+// bin dir of the build dir that are left dangling are removed too.
+func cleanMode(config *Config, mode string, all bool) error {
+	selectMode(config, mode)
+	dirs := []string{modeOutputDir(config, mode)}
+	if all {
+		dirs = []string{filepath.Join(config.BuildDir, platform, "gen")}
+		for name := range config.Modes {
+			dirs = append(dirs, modeOutputDir(config, name))
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	_, err := cppdep.PruneSymlinks(filepath.Join(config.BuildDir, "bin"), nil, false)
+	return err
+}
+
+// collectGarbage removes the files in the obj and bin dirs of the selected mode and in
+// the generated files dir that building the binaries of b and the libraries of the
+// config would not write, along with the dangling links in the bin dir of the build
+// dir, and writes the paths removed. If dryRun is set the paths are written but
+// nothing is removed.
+func collectGarbage(w io.Writer, b *build, dryRun bool) error {
+	outputs, err := b.c.Outputs(appendMissingFiles(b.files, b.libraryFiles()))
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool)
+	for _, path := range append(outputs, b.st.GeneratedFiles()...) {
+		keep[path] = true
+	}
+
+	var removed []string
+	for _, dir := range []string{filepath.Join(b.c.OutputDir, "obj"), filepath.Join(b.c.OutputDir, "bin"), b.st.GenDir()} {
+		paths, err := cppdep.RemoveStale(dir, keep, dryRun)
+		removed = append(removed, paths...)
+		if err != nil {
+			return err
+		}
+	}
+	removedPaths := make(map[string]bool)
+	for _, path := range removed {
+		removedPaths[path] = true
+	}
+	paths, err := cppdep.PruneSymlinks(filepath.Join(b.config.BuildDir, "bin"), removedPaths, dryRun)
+	removed = append(removed, paths...)
+	for _, path := range removed {
+		fmt.Fprintln(w, path)
+	}
+	if dryRun {
+		fmt.Fprintf(w, "Would remove %d files\n", len(removed))
+	} else {
+		fmt.Fprintf(w, "Removed %d files\n", len(removed))
+	}
+	return err
+}
+
+// printConfig writes config, after merging in the config of the current platform.
+func printConfig(w io.Writer, config *Config) error {
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
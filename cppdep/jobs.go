@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+
+	"github.com/cgilling/cppdep"
+)
+
+// JobsConfig limits the number of build jobs of each kind that run at the same time.
+// A limit of 0 means the --concurrency flag applies, except for generators which
+// run one at a time by default. CompileMemory and LinkMemory are sizes such as "4G".
+type JobsConfig struct {
+	Compile       int
+	Link          int
+	Generate      int
+	Scan          int
+	CompileMemory string
+	LinkMemory    string
+}
+
+type jobLimits struct {
+	// total is the number of compiles and links that run at the same time, which is
+	// the concurrency unless a compile or link limit is higher.
+	total                         int
+	compile, link, generate, scan int
+	compileMemory, linkMemory     uint64
+}
+
+// resolveJobLimits returns the job limits of config, overridden by the limits given
+// on the command line where those are set.
+func resolveJobLimits(config JobsConfig, flags JobsConfig, concurrency int) (jobLimits, error) {
+	pick := func(flag, conf, def int) int {
+		if flag > 0 {
+			return flag
+		}
+		if conf > 0 {
+			return conf
+		}
+		return def
+	}
+	size := func(flag, conf string) (uint64, error) {
+		s := flag
+		if s == "" {
+			s = conf
+		}
+		if s == "" {
+			return 0, nil
+		}
+		n, err := parseSize(s)
+		return uint64(n), err
+	}
+
+	limits := jobLimits{
+		compile:  pick(flags.Compile, config.Compile, 0),
+		link:     pick(flags.Link, config.Link, 0),
+		generate: pick(flags.Generate, config.Generate, 1),
+		scan:     pick(flags.Scan, config.Scan, concurrency),
+	}
+	limits.total = concurrency
+	if limits.compile > limits.total {
+		limits.total = limits.compile
+	}
+	if limits.link > limits.total {
+		limits.total = limits.link
+	}
+	var err error
+	if limits.compileMemory, err = size(flags.CompileMemory, config.CompileMemory); err != nil {
+		return jobLimits{}, err
+	}
+	if limits.linkMemory, err = size(flags.LinkMemory, config.LinkMemory); err != nil {
+		return jobLimits{}, err
+	}
+	return limits, nil
+}
+
+// jobserver returns the make jobserver that cppdep was run with, in which case the
+// total concurrency of limits is raised to the number of jobs of make, as tokens from
+// the jobserver limit the actions run. Otherwise a jobserver is created for the make
+// processes run by generators. nil is returned if there is no jobserver to use.
+func jobserver(limits *jobLimits) *cppdep.Jobserver {
+	js, err := cppdep.JobserverFromMakeflags(os.Getenv("MAKEFLAGS"))
+	if err != nil {
+		log.Printf("Not using the make jobserver: %v", err)
+	}
+	if js != nil {
+		jobs := js.Jobs()
+		if jobs == 0 {
+			jobs = runtime.NumCPU()
+		}
+		if jobs > limits.total {
+			limits.total = jobs
+		}
+		return js
+	}
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	jobs := limits.total
+	if limits.generate > jobs {
+		jobs = limits.generate
+	}
+	if js, err = cppdep.NewJobserver(jobs); err != nil {
+		log.Printf("Failed to create a jobserver: %v", err)
+		return nil
+	}
+	return js
+}
+
+// jobserverExecutor returns ex run with tokens from js, or ex if js is nil.
+func jobserverExecutor(js *cppdep.Jobserver, ex cppdep.Executor) cppdep.Executor {
+	if js == nil {
+		return ex
+	}
+	return &cppdep.JobserverExecutor{Jobserver: js, Executor: ex}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestResolveJobLimits(t *testing.T) {
+	config := JobsConfig{Link: 2, Generate: 4, LinkMemory: "4G"}
+	limits, err := resolveJobLimits(config, JobsConfig{Compile: 16, Link: 3}, 8)
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %v", err)
+	case limits.total != 16:
+		t.Errorf("Expected the total to be raised to the compile limit, got %d", limits.total)
+	case limits.compile != 16:
+		t.Errorf("Expected the compile limit from the flag, got %d", limits.compile)
+	case limits.link != 3:
+		t.Errorf("Expected the link flag to override the config, got %d", limits.link)
+	case limits.generate != 4:
+		t.Errorf("Expected the generate limit from the config, got %d", limits.generate)
+	case limits.scan != 8:
+		t.Errorf("Expected scans to default to the concurrency, got %d", limits.scan)
+	case limits.linkMemory != 4<<30 || limits.compileMemory != 0:
+		t.Errorf("Unexpected memory limits: compile %d, link %d", limits.compileMemory, limits.linkMemory)
+	}
+
+	limits, err = resolveJobLimits(JobsConfig{}, JobsConfig{}, 8)
+	if err != nil || limits.generate != 1 || limits.compile != 0 {
+		t.Errorf("Unexpected default limits: %+v, %v", limits, err)
+	}
+	if _, err := resolveJobLimits(JobsConfig{}, JobsConfig{LinkMemory: "lots"}, 8); err == nil {
+		t.Errorf("Expected error for invalid memory size")
+	}
+}
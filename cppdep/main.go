@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
-	"runtime/pprof"
-	"sort"
+	"syscall"
 
 	"github.com/cgilling/cppdep"
 	cli "github.com/jawher/mow.cli"
@@ -37,21 +39,77 @@ type Config struct {
 	Excludes        []string
 	Includes        []string
 	Flags           []string
+	LinkFlags       []string
 	Modes           map[string]ModeConfig
-	LinkLibraries   map[string][]string
+	LinkLibraries   map[string]LinkLibraryConfig
+	LinkDeps        map[string][]string
 	Platforms       map[string]PlatformConfig
 	Libraries       map[string]LibraryConfig
 	SourceLibs      map[string][]string
 	Binary          BinaryConfig
 	TypeGenerators  []TypeGeneratorConfig
 	ShellGenerators []ShellGeneratorConfig
+
+	PrecompiledHeaders []PrecompiledHeaderConfig
+	Unity              UnityConfig
+	Cache              CacheConfig
+	CompileWrapper     []string
+	Jobs               JobsConfig
+	Run                RunConfig
+	Test               TestConfig
 }
 
 type PlatformConfig struct {
 	Excludes      []string
 	Includes      []string
 	Flags         []string
-	LinkLibraries map[string][]string
+	LinkFlags     []string
+	LinkLibraries map[string]LinkLibraryConfig
+	LinkDeps      map[string][]string
+}
+
+// LinkLibraryConfig is either a list of linker statements, or a dictionary naming the
+// pkg-config package that provides the compile and link flags for the library.
+type LinkLibraryConfig struct {
+	Flags     []string
+	PkgConfig string
+}
+
+func (l *LinkLibraryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var flags []string
+	if err := unmarshal(&flags); err == nil {
+		l.Flags = flags
+		return nil
+	}
+	var pkgConf struct {
+		PkgConfig string
+	}
+	if err := unmarshal(&pkgConf); err != nil {
+		return err
+	}
+	if pkgConf.PkgConfig == "" {
+		return fmt.Errorf("linklibraries entry must be a list of flags or contain a pkgconfig key")
+	}
+	l.PkgConfig = pkgConf.PkgConfig
+	return nil
+}
+
+func (l LinkLibraryConfig) MarshalYAML() (interface{}, error) {
+	if l.PkgConfig != "" {
+		return map[string]string{"pkgconfig": l.PkgConfig}, nil
+	}
+	return l.Flags, nil
+}
+
+type PrecompiledHeaderConfig struct {
+	Header string
+	Scope  []string
+}
+
+type UnityConfig struct {
+	BatchSize    int
+	PerDirectory bool
+	Excludes     []string
 }
 
 type LibraryConfig struct {
@@ -71,11 +129,18 @@ type ShellGeneratorConfig struct {
 }
 
 type ModeConfig struct {
-	Flags []string
+	Flags     []string
+	LinkFlags []string
 }
 
 type BinaryConfig struct {
 	Rename []cppdep.RenameRule
+	Link   map[string]BinaryLinkConfig
+}
+
+type BinaryLinkConfig struct {
+	LinkFlags []string
+	Libs      []string
 }
 
 func (c *Config) ReadFile(path string) error {
@@ -107,6 +172,43 @@ func searchForConfigFile(dir string) string {
 	return path
 }
 
+// loadConfig reads the config found at *configPath, searching for it if *configPath
+// is empty (in which case *configPath is set to the path found), and merges in the
+// config for the current platform.
+func loadConfig(configPath *string) *Config {
+	config := &Config{}
+	if *configPath == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("Failed to get cwd: %v", err)
+		}
+		*configPath = searchForConfigFile(cwd)
+	}
+
+	if *configPath == "" {
+		log.Fatalf("No config file provided and no cppdep.yml found in path")
+	}
+
+	if err := config.ReadFile(*configPath); err != nil {
+		log.Fatalf("Failed to read config file: %q", err)
+	}
+
+	MergePlatformConfig(platform, config)
+
+	if config.BuildDir == "" {
+		log.Fatalf("BuildDir must be set")
+	}
+
+	if !filepath.IsAbs(config.BuildDir) {
+		config.BuildDir = filepath.Join(filepath.Dir(*configPath), config.BuildDir)
+	}
+	var err error
+	if config.BuildDir, err = filepath.Abs(config.BuildDir); err != nil {
+		log.Fatalf("Failed to get absolute path of build dir")
+	}
+	return config
+}
+
 func main() {
 	makeCommandAndRun(os.Args)
 }
@@ -114,224 +216,412 @@ func main() {
 func makeCommandAndRun(args []string) {
 	cmd := cli.App("cppdep", "dependency graph and easy compiles")
 	cmd.Spec = "[OPTIONS] [BINARY_NAMES]..."
+	versionFlag := cmd.BoolOpt("version", false, "print version string (same as the version command)")
 	platformFlag := cmd.BoolOpt("platform", false, "print out the name of the platform currently being run on")
-	versionFlag := cmd.BoolOpt("version", false, "print version string")
-	verboseFlag := cmd.BoolOpt("v verbose", false, "enable verbose logging")
-	configPath := cmd.StringOpt("config", "", "path to yaml config")
-	concurrency := cmd.IntOpt("c concurrency", 1, "How much concurrency to we want to allow")
-	mode := cmd.StringOpt("mode", "default", "select a build mode")
-	fast := cmd.BoolOpt("fast", false, "Set to enable fast file scanning")
-	list := cmd.BoolOpt("list", false, "Lists paths of all binaries that would be generated, but does not compile them")
-	cpuprofile := cmd.StringOpt("cpuprof", "", "file to write the cpu profile to")
-	srcDir := cmd.StringOpt("src", "", "path to the src directory")
-	binaryNames := cmd.StringsArg(
-		"BINARY_NAMES",
-		nil,
-		"name of the binary to build, main source file should be BINARY_NAME.cc, this can be a globbing expression as well."+
-			" A '*' on its own means 'all autodetected main source files'",
-	)
-
-	cmd.Action = func() {
-		var err error
+	list := cmd.BoolOpt("list", false, "Lists paths of all binaries that would be generated, but does not compile them (same as the list command)")
+	opts := newBuildOptions()
+	opts.addProjectOptions(cmd.Cmd)
+	opts.addBuildOptions(cmd.Cmd)
+	opts.addBinaryNamesArg(cmd.Cmd)
+
+	// running cppdep without a command builds, as it did before there were commands
+	build := func() {
+		defer startCPUProfile(opts)()
+		b := setupBuild(opts)
+		defer b.close()
+		buildBinaries(b)
+	}
 
-		if *versionFlag {
-			fmt.Println(version)
-			return
+	cmd.Command("build", "build binaries, the default when no command is given", func(buildCmd *cli.Cmd) {
+		buildCmd.Spec = "[OPTIONS] [BINARY_NAMES]..."
+		opts.addProjectOptions(buildCmd)
+		opts.addBuildOptions(buildCmd)
+		opts.addBinaryNamesArg(buildCmd)
+		buildCmd.Action = build
+	})
+
+	cmd.Command("list", "list the paths of the binaries that would be built, without building them", func(listCmd *cli.Cmd) {
+		listCmd.Spec = "[OPTIONS] [BINARY_NAMES]..."
+		opts.addProjectOptions(listCmd)
+		opts.addBinaryNamesArg(listCmd)
+		listCmd.Action = func() {
+			b := setupBuild(opts)
+			defer b.close()
+			listBinaries(os.Stdout, b)
 		}
-
-		if *platformFlag {
-			fmt.Printf("%s\n", platform)
-			return
+	})
+
+	cmd.Command("deps", "list the files that a file or binary depends on", func(depsCmd *cli.Cmd) {
+		depsCmd.Spec = "[OPTIONS] [-s] FILE"
+		opts.addProjectOptions(depsCmd)
+		sources := depsCmd.BoolOpt("s sources", false, "include the sources that implement included headers, as linked into a binary")
+		name := depsCmd.StringArg("FILE", "", "path of the file, relative to the source root, or name of the binary")
+		depsCmd.Action = func() {
+			b := setupBuild(opts)
+			defer b.close()
+			file, err := findFile(b.st, *name)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			printDeps(os.Stdout, b.st, file, *sources)
 		}
-
-		if *cpuprofile != "" {
-			f, err := os.Create(*cpuprofile)
+	})
+
+	cmd.Command("rdeps", "list the files that depend on a file", func(rdepsCmd *cli.Cmd) {
+		rdepsCmd.Spec = "[OPTIONS] [-b] FILE"
+		opts.addProjectOptions(rdepsCmd)
+		binaries := rdepsCmd.BoolOpt("b binaries", false, "list only the names of the binaries built from the file")
+		name := rdepsCmd.StringArg("FILE", "", "path of the file, relative to the source root")
+		rdepsCmd.Action = func() {
+			b := setupBuild(opts)
+			defer b.close()
+			file, err := findFile(b.st, *name)
 			if err != nil {
-				log.Fatal(err)
+				log.Fatalf("%v", err)
 			}
-			pprof.StartCPUProfile(f)
-			defer pprof.StopCPUProfile()
+			printRdeps(os.Stdout, b, file, *binaries)
 		}
-
-		config := &Config{}
-		if *configPath == "" {
-			cwd, err := os.Getwd()
+	})
+
+	cmd.Command("affected", "list or build the binaries affected by the changes since a git revision", func(affectedCmd *cli.Cmd) {
+		affectedCmd.Spec = "[OPTIONS] [BINARY_NAMES]..."
+		opts.addProjectOptions(affectedCmd)
+		opts.addBuildOptions(affectedCmd)
+		since := affectedCmd.StringOpt("since", "", "git revision to compare the working tree with, such as origin/master")
+		buildAffected := affectedCmd.BoolOpt("build", false, "build the affected binaries instead of listing them")
+		opts.addBinaryNamesArg(affectedCmd)
+		affectedCmd.Action = func() {
+			if *since == "" {
+				log.Fatalf("--since must name the git revision to compare with")
+			}
+			b := setupBuild(opts)
+			defer b.close()
+			paths, err := changedFiles(b.st.SrcRoot, *since)
 			if err != nil {
-				log.Fatalf("Failed to get cwd: %v", err)
+				log.Fatalf("Failed to find changed files: %v", err)
+			}
+			b.files = affectedFiles(b, *opts.configPath, paths)
+			switch {
+			case !*buildAffected:
+				printBinaryNames(os.Stdout, b, b.files)
+			case len(b.files) == 0:
+				fmt.Println("No binaries affected")
+			default:
+				buildBinaries(b)
 			}
-			*configPath = searchForConfigFile(cwd)
 		}
-
-		if *configPath == "" {
-			log.Fatalf("No config file provided and no cppdep.yml found in path")
+	})
+
+	cmd.Command("graph", "write the dependency graph of the binaries in the Graphviz dot format", func(graphCmd *cli.Cmd) {
+		graphCmd.Spec = "[OPTIONS] [BINARY_NAMES]..."
+		opts.addProjectOptions(graphCmd)
+		opts.addBinaryNamesArg(graphCmd)
+		graphCmd.Action = func() {
+			b := setupBuild(opts)
+			defer b.close()
+			writeGraph(os.Stdout, b)
 		}
-
-		if err := config.ReadFile(*configPath); err != nil {
-			log.Fatalf("Failed to read config file: %q", err)
-		}
-
-		MergePlatformConfig(platform, config)
-
-		if config.BuildDir == "" {
-			log.Fatalf("BuildDir must be set")
+	})
+
+	cmd.Command("clean", "remove the objects and binaries of the selected mode, or of all modes", func(cleanCmd *cli.Cmd) {
+		cleanCmd.Spec = "[OPTIONS]"
+		opts.addProjectOptions(cleanCmd)
+		all := cleanCmd.BoolOpt("a all", false, "remove the outputs of every mode and the generated files")
+		cleanCmd.Action = func() {
+			config := loadConfig(opts.configPath)
+			if err := cleanMode(config, *opts.mode, *all); err != nil {
+				log.Fatalf("Failed to clean: %v", err)
+			}
 		}
-
-		if !filepath.IsAbs(config.BuildDir) {
-			config.BuildDir = filepath.Join(filepath.Dir(*configPath), config.BuildDir)
+	})
+
+	cmd.Command("gc", "remove the outputs of the selected mode that the current sources no longer build", func(gcCmd *cli.Cmd) {
+		gcCmd.Spec = "[OPTIONS] [BINARY_NAMES]..."
+		opts.addProjectOptions(gcCmd)
+		gcCmd.BoolOptPtr(opts.dryRun, "n dry-run", *opts.dryRun, "print the files that would be removed, but do not remove them")
+		opts.addBinaryNamesArg(gcCmd)
+		gcCmd.Action = func() {
+			b := setupBuild(opts)
+			defer b.close()
+			if err := collectGarbage(os.Stdout, b, *opts.dryRun); err != nil {
+				log.Fatalf("Failed to remove stale outputs: %v", err)
+			}
 		}
-
-		err = os.MkdirAll(config.BuildDir, 0755)
-		if err != nil {
-			log.Fatalf("Failed to create build dir: %s (%v)", config.BuildDir, err)
+	})
+
+	cmd.Command("run", "build a binary and run it with the given arguments", func(runCmd *cli.Cmd) {
+		runCmd.Spec = "[OPTIONS] BINARY_NAME [ARGS...]"
+		opts.addProjectOptions(runCmd)
+		opts.addBuildOptions(runCmd)
+		gdb := runCmd.BoolOpt("gdb", false, "run the binary under gdb")
+		valgrind := runCmd.BoolOpt("valgrind", false, "run the binary under valgrind")
+		dir := runCmd.StringOpt("C dir", "", "directory to run the binary in (default: run.dir in the config, or the current directory)")
+		name := runCmd.StringArg("BINARY_NAME", "", "name of the binary to build and run")
+		runArgs := runCmd.StringsArg("ARGS", nil, "arguments to run the binary with, after -- if any start with -")
+		runCmd.Action = func() {
+			if *gdb && *valgrind {
+				log.Fatalf("--gdb and --valgrind cannot be used together")
+			}
+			// the binary is looked up once the source tree has been processed
+			*opts.binaryNames = []string{}
+			b := setupBuild(opts)
+			file, err := runTarget(b.st, *name)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			b.files = []*cppdep.File{file}
+			// the output of the binary on stdout is kept apart from that of the build
+			if b.c.Progress != nil {
+				b.c.Progress = newProgress(*opts.progress, os.Stderr)
+			}
+			binPaths := buildBinaries(b)
+			b.close()
+			if *opts.dryRun {
+				return
+			}
+			argv := runCommand(b.config.Run, binPaths[0], *runArgs, *gdb, *valgrind)
+			runBinary(argv, runDir(b.config, *opts.configPath, *dir))
 		}
+	})
+
+	cmd.Command("test", "build test binaries, run them and write a JUnit report", func(testCmd *cli.Cmd) {
+		testCmd.Spec = "[OPTIONS] [PATTERNS...]"
+		opts.addProjectOptions(testCmd)
+		opts.addBuildOptions(testCmd)
+		jobs := testCmd.IntOpt("j jobs", runtime.NumCPU(), "number of test binaries to run at the same time")
+		timeout := testCmd.StringOpt("timeout", "", "how long a test binary may run before it is killed, such as 5m (default: test.timeout in the config)")
+		dir := testCmd.StringOpt("C dir", "", "directory to run the test binaries in (default: test.dir in the config, or the current directory)")
+		reportPath := testCmd.StringOpt("report", "", "path of the JUnit XML report (default: test-report.xml in the output directory)")
+		patterns := testCmd.StringsArg("PATTERNS", nil, "patterns of the test binaries to run (default: test.patterns and test.includes in the config)")
+		testCmd.Action = func() {
+			// the test binaries are looked up once the source tree has been processed
+			*opts.binaryNames = []string{}
+			b := setupBuild(opts)
+			testTimeout, err := testTimeout(b.config, *timeout)
+			if err != nil {
+				log.Fatalf("Invalid test timeout: %v", err)
+			}
+			files, err := findTests(b.st, b.config.Test, *patterns)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			if len(files) == 0 {
+				log.Fatalf("No test binaries found")
+			}
+			b.files = files
+			binPaths := buildBinaries(b)
+			b.close()
+			if *opts.dryRun {
+				return
+			}
 
-		if *srcDir == "" && config.SrcDir == "" {
-			log.Fatalf("a source directory must be set through --src or config.srcdir")
-		} else if *srcDir == "" {
-			if filepath.IsAbs(config.SrcDir) {
-				*srcDir = config.SrcDir
-			} else {
-				*srcDir = filepath.Join(filepath.Dir(*configPath), config.SrcDir)
+			tr := &cppdep.TestRunner{
+				Concurrency: *jobs,
+				Timeout:     testTimeout,
+				Dir:         testDir(b.config, *opts.configPath, *dir),
+				OutputDir:   filepath.Join(b.c.OutputDir, "test"),
+			}
+			if b.c.Progress != nil {
+				tr.Progress = newProgress(*opts.progress, os.Stderr)
+			}
+			results, err := tr.Run(b.ctx, binPaths)
+			if err != nil {
+				if b.ctx.Err() != nil {
+					exitInterrupted()
+				}
+				log.Fatalf("Failed to run tests: %v", err)
+			}
+			writeTestSummary(os.Stdout, results)
+			if *reportPath == "" {
+				*reportPath = filepath.Join(b.c.OutputDir, "test-report.xml")
+			}
+			if err := writeTestReport(*reportPath, results); err != nil {
+				log.Fatalf("Failed to write test report: %v", err)
+			}
+			for _, result := range results {
+				if !result.Passed {
+					os.Exit(1)
+				}
 			}
 		}
-
-		if config.Modes == nil {
-			config.Modes = make(map[string]ModeConfig)
+	})
+
+	cmd.Command("explain", "list the outputs that would be built, and why", func(explainCmd *cli.Cmd) {
+		explainCmd.Spec = "[OPTIONS] [BINARY_NAMES]..."
+		opts.addProjectOptions(explainCmd)
+		opts.addBinaryNamesArg(explainCmd)
+		explainCmd.Action = func() {
+			b := setupBuild(opts)
+			defer b.close()
+			if err := explainBuild(os.Stdout, b); err != nil {
+				log.Fatalf("Failed to explain build: %v", err)
+			}
 		}
-
-		if _, ok := config.Modes["default"]; !ok {
-			config.Modes["default"] = ModeConfig{}
+	})
+
+	cmd.Command("config", "print the config, with the config of the current platform merged in", func(configCmd *cli.Cmd) {
+		configCmd.Spec = "[--config]"
+		configCmd.StringOptPtr(opts.configPath, "config", *opts.configPath, "path to yaml config")
+		configCmd.Action = func() {
+			if err := printConfig(os.Stdout, loadConfig(opts.configPath)); err != nil {
+				log.Fatalf("Failed to print config: %v", err)
+			}
 		}
+	})
 
-		if _, ok := config.Modes[*mode]; !ok {
-			log.Fatalf("Cannot find requested mode %q", *mode)
+	cmd.Command("version", "print the version and the platform", func(versionCmd *cli.Cmd) {
+		versionCmd.Action = func() {
+			fmt.Printf("cppdep %s (%s)\n", version, platform)
 		}
-
-		if runtime.GOMAXPROCS(0) == 1 {
-			maxProcs := maxGoProcs
-			if runtime.NumCPU() < maxProcs {
-				maxProcs = runtime.NumCPU()
+	})
+
+	cmd.Command("cache", "manage the local build cache", func(cacheCmd *cli.Cmd) {
+		cacheCmd.Command("stats", "print statistics for the local build cache", func(statsCmd *cli.Cmd) {
+			statsCmd.StringOptPtr(opts.configPath, "config", *opts.configPath, "path to yaml config")
+			statsCmd.Action = func() {
+				config := loadConfig(opts.configPath)
+				cache, err := localCache(config, *opts.configPath)
+				if err != nil {
+					log.Fatalf("Failed to setup build cache: %v", err)
+				} else if cache == nil {
+					log.Fatalf("No build cache configured")
+				}
+				if err := printCacheStats(os.Stdout, cache); err != nil {
+					log.Fatalf("Failed to read build cache stats: %v", err)
+				}
 			}
-			if *concurrency < maxProcs {
-				maxProcs = *concurrency
+		})
+	})
+
+	cmd.Command("ninja", "write a Ninja build file for the binaries using the settings of the selected mode", func(ninjaCmd *cli.Cmd) {
+		ninjaCmd.Spec = "[OPTIONS] [-o] [BINARY_NAMES]..."
+		opts.addProjectOptions(ninjaCmd)
+		opts.addBuildOptions(ninjaCmd)
+		output := ninjaCmd.StringOpt("o output", "", "path to write the build file to (default: build.ninja in the mode's build dir)")
+		opts.addBinaryNamesArg(ninjaCmd)
+		ninjaCmd.Action = func() {
+			b := setupBuild(opts)
+			defer b.close()
+			if err := writeNinja(b, *output, args); err != nil {
+				log.Fatalf("Failed to write build.ninja: %v", err)
 			}
-			runtime.GOMAXPROCS(maxProcs)
 		}
-
-		var gens []cppdep.Generator
-		for _, gen := range config.TypeGenerators {
-			gens = append(gens, &cppdep.TypeGenerator{
-				InputExt:   gen.InputExt,
-				OutputExts: gen.OutputExts,
-				Command:    gen.Command,
-			})
-		}
-		for _, gen := range config.ShellGenerators {
-			gens = append(gens, &cppdep.ShellGenerator{
-				InputPaths:    gen.InputPaths,
-				OutputFiles:   gen.OutputFiles,
-				ShellFilePath: filepath.Join(*srcDir, gen.Path),
-			})
-		}
-
-		if config.BuildDir, err = filepath.Abs(config.BuildDir); err != nil {
-			log.Fatalf("Failed to get absolute path of build dir")
+	})
+
+	cmd.Command("makefile", "write a GNU Makefile for the binaries that builds any of the modes", func(makeCmd *cli.Cmd) {
+		makeCmd.Spec = "[OPTIONS] [-o] [BINARY_NAMES]..."
+		opts.addProjectOptions(makeCmd)
+		output := makeCmd.StringOpt("o output", "", "path to write the Makefile to (default: Makefile in the build dir)")
+		opts.addBinaryNamesArg(makeCmd)
+		makeCmd.Action = func() {
+			b := setupBuild(opts)
+			defer b.close()
+			if err := writeMakefile(b, *output); err != nil {
+				log.Fatalf("Failed to write Makefile: %v", err)
+			}
 		}
+	})
 
-		libraries := make(map[string][]string)
-		for libname, libConf := range config.Libraries {
-			libraries[libname] = libConf.Sources
+	cmd.Action = func() {
+		if *versionFlag {
+			fmt.Println(version)
+			return
 		}
 
-		buildDir := filepath.Join(config.BuildDir, platform)
-
-		st := &cppdep.SourceTree{
-			SrcRoot:         *srcDir,
-			AutoInclude:     config.AutoInclude,
-			IncludeDirs:     config.Includes,
-			ExcludeDirs:     config.Excludes,
-			LinkLibraries:   config.LinkLibraries,
-			Libraries:       libraries,
-			SourceLibs:      config.SourceLibs,
-			Concurrency:     *concurrency,
-			UseFastScanning: *fast,
-			Generators:      gens,
-			BuildDir:        buildDir,
+		if *platformFlag {
+			fmt.Printf("%s\n", platform)
+			return
 		}
-		if err := st.ProcessDirectory(); err != nil {
-			log.Fatalf("Failed to process source directory: %s (%v)", *srcDir, err)
+		if *list {
+			b := setupBuild(opts)
+			defer b.close()
+			listBinaries(os.Stdout, b)
+			return
 		}
+		build()
+	}
 
-		if err := st.Rename(config.Binary.Rename); err != nil {
-			log.Fatalf("Failed to rename files: %v", err)
-		}
+	cmd.Run(args)
+}
 
-		flags := make([]string, len(config.Flags))
-		copy(flags, config.Flags)
-		flags = append(flags, config.Modes[*mode].Flags...)
+func writeTrace(trace *cppdep.Trace, path string) error {
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := trace.WriteChromeJSON(fp); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
 
-		c := &cppdep.Compiler{
-			OutputDir:   filepath.Join(buildDir, *mode),
-			IncludeDirs: st.IncludeDirs,
-			Flags:       flags,
-			Concurrency: *concurrency,
-			Verbose:     *verboseFlag,
+// writeDiagnostics writes the diagnostics of a build to the requested files and prints
+// the number of warnings and errors found.
+func writeDiagnostics(diags *cppdep.Diagnostics, jsonPath, sarifPath, srcRoot string) {
+	write := func(path string, writeFunc func(w io.Writer) error) {
+		fp, err := os.Create(path)
+		if err == nil {
+			err = writeFunc(fp)
+			if cerr := fp.Close(); err == nil {
+				err = cerr
+			}
 		}
-		var files []*cppdep.File
-		if *binaryNames == nil {
-			*binaryNames = []string{"*"}
+		if err != nil {
+			log.Printf("Failed to write diagnostics: %v", err)
 		}
+	}
+	if jsonPath != "" {
+		write(jsonPath, diags.WriteJSONLines)
+	}
+	if sarifPath != "" {
+		write(sarifPath, func(w io.Writer) error { return diags.WriteSARIF(w, srcRoot) })
+	}
+	if warnings, errors := diags.Counts(); warnings > 0 || errors > 0 {
+		fmt.Fprintln(os.Stderr, diags.Summary())
+	}
+}
 
-		for _, binaryName := range *binaryNames {
-			if binaryName == "*" {
-				files, err = st.FindMainFiles()
-				if err != nil {
-					log.Fatalf("failes to automatically find main files: %v", err)
-				}
-			} else {
-				f, err := st.FindSources(binaryName)
-				if err != nil {
-					log.Fatalf("invalid pattern: %q", binaryName)
-				}
-				files = append(files, f...)
-			}
+// newProgress returns the progress display for mode, which is one of smart, plain or
+// auto, written to f.
+func newProgress(mode string, f *os.File) *cppdep.Progress {
+	width := terminalWidth(f)
+	switch mode {
+	case "smart":
+		if width == 0 {
+			width = 80
 		}
-
-		if *list {
-			sort.Sort(cppdep.ByBase(files))
-			for _, file := range files {
-				fmt.Println(c.BinPath(file))
-			}
-		} else {
-			binPaths, err := c.CompileAll(files)
-			if err != nil {
-				log.Fatalf("Compile returned error: %v", err)
-			}
-			binDir := filepath.Join(config.BuildDir, "bin")
-			if err := os.MkdirAll(binDir, 0755); err != nil {
-				log.Fatalf("Failed to make directory: %q (%v)", binDir, err)
-			}
-			for _, path := range binPaths {
-				symPath := filepath.Join(binDir, filepath.Base(path))
-				relPath, err := filepath.Rel(binDir, path)
-				if err != nil {
-					log.Fatalf("failed to get relative path of binary: %v", err)
-				}
-				linkPath, err := os.Readlink(symPath)
-				if err == nil && linkPath != relPath {
-					if err := os.Remove(symPath); err != nil {
-						log.Fatalf("Failed to remove old symlink: %v", err)
-					}
-				}
-				if err != nil || linkPath != relPath {
-					if err := os.Symlink(relPath, symPath); err != nil {
-						log.Fatalf("Failed to symlink file: %v", err)
-					}
-				}
-			}
-
+	case "plain":
+		width = 0
+	case "auto":
+		if os.Getenv("TERM") == "dumb" {
+			width = 0
 		}
+	default:
+		log.Fatalf("Unknown progress mode %q, expected smart, plain or auto", mode)
 	}
+	p := cppdep.NewProgress(f, width > 0)
+	p.Width = width
+	return p
+}
 
-	cmd.Run(args)
+// cancelOnSignal returns a context that is cancelled on the first SIGINT or SIGTERM,
+// which stops the build and kills running commands. A second signal exits at once.
+func cancelOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		fmt.Fprintln(os.Stderr, "Interrupted, stopping build")
+		cancel()
+		<-sigCh
+		exitInterrupted()
+	}()
+	return ctx
+}
+
+func exitInterrupted() {
+	fmt.Fprintln(os.Stderr, "Build interrupted")
+	os.Exit(130)
 }
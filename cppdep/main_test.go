@@ -6,8 +6,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"text/template"
+
+	"gopkg.in/yaml.v2"
 )
 
 func TestMain(t *testing.T) {
@@ -17,45 +21,7 @@ func TestMain(t *testing.T) {
 	}
 	defer os.RemoveAll(outputDir)
 
-	pwd, err := os.Getwd()
-	if err != nil {
-		t.Fatalf("Failed to Getwd(): %v", err)
-	}
-	srcDir := filepath.Join(pwd, "test_files")
-
-	confPath := filepath.Join(outputDir, "cppdep.yml")
-	confFile, err := os.Create(confPath)
-	if err != nil {
-		t.Fatalf("Failed to open config file for writing: %q (%v)", confPath, err)
-	}
-	confTmpl, err := template.New("config").Parse(`
-srcdir: {{.SourceDir}}
-builddir: {{.BuildDir}}
-autoinclude: true
-linklibraries:
-  "zlib.h": ["-lz"]
-modes:
-  hello:
-    flags: ["-DHELLO"]
-typegenerators:
-  -
-    inputext: ".txtcc"
-    outputexts: [".cc"]
-    command: ["cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.cc"]
-  -
-    inputext: ".txth"
-    outputexts: [".h"]
-    command: ["cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.h"]`)
-	if err != nil {
-		t.Fatalf("Failed to compile template: %v", err)
-	}
-	tmplParams := map[string]string{
-		"BuildDir":  outputDir,
-		"SourceDir": srcDir,
-	}
-	if err = confTmpl.Execute(confFile, tmplParams); err != nil {
-		t.Fatalf("Failed to write template: %v", err)
-	}
+	confPath := writeTestConfig(t, outputDir)
 	defaultArgs := []string{
 		"cppdep",
 		"--fast",
@@ -107,3 +73,231 @@ typegenerators:
 		t.Errorf("root binary not linked to correct file: %q != %q", path, defaultPath)
 	}
 }
+
+func TestSubcommands(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_subcommand_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+	confPath := writeTestConfig(t, outputDir)
+
+	// options can be given before or after the command
+	makeCommandAndRun([]string{"cppdep", "--fast", "build", "--config", confPath, "--mode", "hello"})
+	helloDir := filepath.Join(outputDir, platform, "hello")
+	if _, err := os.Stat(filepath.Join(helloDir, "bin/main")); err != nil {
+		t.Errorf("Expected build command to build main: %v", err)
+	}
+
+	opts := newBuildOptions()
+	*opts.configPath = confPath
+	*opts.mode = "hello"
+	*opts.progress = "plain"
+	b := setupBuild(opts)
+	defer b.close()
+	genDir := b.st.GenDir()
+
+	var buf bytes.Buffer
+	listBinaries(&buf, b)
+	if exp := filepath.Join(helloDir, "bin/main") + "\n"; buf.String() != exp {
+		t.Errorf("Unexpected list output:\ngot: %q\nexp: %q", buf.String(), exp)
+	}
+
+	mainFile, err := findFile(b.st, "main")
+	if err != nil {
+		t.Fatalf("Failed to find main: %v", err)
+	}
+	buf.Reset()
+	printDeps(&buf, b.st, mainFile, true)
+	if exp := filepath.Join(genDir, "alib.cc") + "\n" + filepath.Join(genDir, "alib.h") + "\n"; buf.String() != exp {
+		t.Errorf("Unexpected deps output:\ngot: %q\nexp: %q", buf.String(), exp)
+	}
+
+	header, err := findFile(b.st, filepath.Join(genDir, "alib.h"))
+	if err != nil {
+		t.Fatalf("Failed to find alib.h: %v", err)
+	}
+	buf.Reset()
+	printRdeps(&buf, b, header, true)
+	if buf.String() != "main\n" {
+		t.Errorf("Unexpected rdeps output: %q", buf.String())
+	}
+
+	buf.Reset()
+	writeGraph(&buf, b)
+	for _, exp := range []string{
+		"  \"main.cc\" [shape=box];\n",
+		"  \"main.cc\" -> \"" + filepath.Join(genDir, "alib.h") + "\";\n",
+	} {
+		if !strings.Contains(buf.String(), exp) {
+			t.Errorf("Expected graph to contain %q:\n%s", exp, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := explainBuild(&buf, b); err != nil {
+		t.Fatalf("Failed to explain build: %v", err)
+	} else if buf.String() != "Nothing to build, all outputs are up to date\n" {
+		t.Errorf("Unexpected explain output: %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := printConfig(&buf, b.config); err != nil {
+		t.Fatalf("Failed to print config: %v", err)
+	}
+	var printed Config
+	if err := yaml.Unmarshal(buf.Bytes(), &printed); err != nil {
+		t.Fatalf("Failed to read printed config: %v", err)
+	} else if flags := printed.LinkLibraries["zlib.h"].Flags; !reflect.DeepEqual(flags, []string{"-lz"}) {
+		t.Errorf("Unexpected link library flags in printed config: %v", flags)
+	}
+
+	// outputs of sources, binaries and generators that no longer exist
+	stale := []string{
+		filepath.Join(helloDir, "obj/removed.o"),
+		filepath.Join(helloDir, "obj/old/removed.d"),
+		filepath.Join(helloDir, "bin/removed"),
+		filepath.Join(genDir, "removed.h"),
+	}
+	for _, path := range stale {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to make dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	danglingLink := filepath.Join(outputDir, "bin/removed")
+	if err := os.Symlink(filepath.Join(helloDir, "bin/removed"), danglingLink); err != nil {
+		t.Fatalf("Failed to symlink: %v", err)
+	}
+	buf.Reset()
+	if err := collectGarbage(&buf, b, true); err != nil {
+		t.Fatalf("Failed to collect garbage: %v", err)
+	} else if !strings.HasSuffix(buf.String(), "Would remove 5 files\n") {
+		t.Errorf("Unexpected gc dry run output:\n%s", buf.String())
+	}
+	if err := collectGarbage(&buf, b, false); err != nil {
+		t.Fatalf("Failed to collect garbage: %v", err)
+	}
+	for _, path := range append(stale, danglingLink, filepath.Join(helloDir, "obj/old")) {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected gc to remove %s: %v", path, err)
+		}
+	}
+	for _, path := range []string{filepath.Join(helloDir, "bin/main"), filepath.Join(helloDir, "obj/main.o"), filepath.Join(genDir, "alib.h"), filepath.Join(outputDir, "bin/main")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected gc to keep %s: %v", path, err)
+		}
+	}
+
+	makeCommandAndRun([]string{"cppdep", "clean", "--config", confPath, "--mode", "hello"})
+	if _, err := os.Stat(helloDir); !os.IsNotExist(err) {
+		t.Errorf("Expected clean to remove the mode's build dir: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outputDir, "bin/main")); !os.IsNotExist(err) {
+		t.Errorf("Expected clean to remove the link to the mode's binary: %v", err)
+	}
+
+	makeCommandAndRun([]string{"cppdep", "build", "--config", confPath})
+	makeCommandAndRun([]string{"cppdep", "clean", "--all", "--config", confPath})
+	for _, dir := range []string{filepath.Join(outputDir, platform, "default"), genDir} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("Expected clean --all to remove %s: %v", dir, err)
+		}
+	}
+}
+
+func TestCollectGarbageKeepsLibraries(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_subcommand_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	srcDir := filepath.Join(outputDir, "src")
+	files := map[string]string{
+		"main.cc":    "int main(int argc, char** argv) { return 0; }\n",
+		"lib/lib.h":  "int lib();\n",
+		"lib/lib.cc": "#include \"lib.h\"\n\nint lib() { return 1; }\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to make dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	confPath := filepath.Join(outputDir, "cppdep.yml")
+	conf := "srcdir: " + srcDir + "\nbuilddir: " + filepath.Join(outputDir, "build") + "\n" +
+		"libraries:\n  mylib:\n    sources: [lib/lib.cc]\n"
+	if err := ioutil.WriteFile(confPath, []byte(conf), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	makeCommandAndRun([]string{"cppdep", "build", "--config", confPath, "main", "mylib"})
+
+	opts := newBuildOptions()
+	*opts.configPath = confPath
+	*opts.progress = "plain"
+	b := setupBuild(opts)
+	defer b.close()
+	var buf bytes.Buffer
+	if err := collectGarbage(&buf, b, false); err != nil {
+		t.Fatalf("Failed to collect garbage: %v", err)
+	} else if buf.String() != "Removed 0 files\n" {
+		t.Errorf("Expected gc to remove nothing:\n%s", buf.String())
+	}
+	for _, path := range []string{filepath.Join(b.c.OutputDir, "bin/mylib.so"), filepath.Join(b.c.OutputDir, "obj/lib.o")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected gc to keep %s: %v", path, err)
+		}
+	}
+}
+
+// writeTestConfig writes a config for the sources in test_files that builds to
+// outputDir, returning its path.
+func writeTestConfig(t *testing.T, outputDir string) string {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to Getwd(): %v", err)
+	}
+	srcDir := filepath.Join(pwd, "test_files")
+
+	confPath := filepath.Join(outputDir, "cppdep.yml")
+	confFile, err := os.Create(confPath)
+	if err != nil {
+		t.Fatalf("Failed to open config file for writing: %q (%v)", confPath, err)
+	}
+	confTmpl, err := template.New("config").Parse(`
+srcdir: {{.SourceDir}}
+builddir: {{.BuildDir}}
+autoinclude: true
+linklibraries:
+  "zlib.h": ["-lz"]
+modes:
+  hello:
+    flags: ["-DHELLO"]
+typegenerators:
+  -
+    inputext: ".txtcc"
+    outputexts: [".cc"]
+    command: ["cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.cc"]
+  -
+    inputext: ".txth"
+    outputexts: [".h"]
+    command: ["cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.h"]`)
+	if err != nil {
+		t.Fatalf("Failed to compile template: %v", err)
+	}
+	tmplParams := map[string]string{
+		"BuildDir":  outputDir,
+		"SourceDir": srcDir,
+	}
+	if err = confTmpl.Execute(confFile, tmplParams); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+	confFile.Close()
+	return confPath
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cgilling/cppdep"
+)
+
+// writeMakefile writes a Makefile for the binaries of b to path, or Makefile in the
+// build dir if path is empty. Every mode of the config can be built with it, the mode
+// of b being the default one.
+func writeMakefile(b *build, path string) error {
+	buildDir := filepath.Join(b.config.BuildDir, platform)
+	if path == "" {
+		path = filepath.Join(buildDir, "Makefile")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	names := []string{*b.opts.mode}
+	var others []string
+	for name := range b.config.Modes {
+		if name != *b.opts.mode {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	var modes []cppdep.MakefileMode
+	for _, name := range append(names, others...) {
+		flags, linkFlags := modeFlags(b.config, name)
+		modes = append(modes, cppdep.MakefileMode{Name: name, Flags: flags, LinkFlags: linkFlags})
+	}
+
+	var buf bytes.Buffer
+	if err := b.c.WriteMakefile(&buf, b.st, b.files, buildDir, modes); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, build with: make -f %s [MODE=%s]\n", path, path, modes[0].Name)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cgilling/cppdep"
+)
+
+// writeNinja writes a Ninja build file for the binaries of b to path, or build.ninja in
+// the build dir of the mode if path is empty. The build file reruns cppdep with args,
+// the arguments it was run with, when the config or the source tree changes.
+func writeNinja(b *build, path string, args []string) error {
+	if path == "" {
+		path = filepath.Join(b.c.OutputDir, "build.ninja")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	configPath, err := filepath.Abs(*b.opts.configPath)
+	if err != nil {
+		return err
+	}
+	regen := &cppdep.NinjaRegenerate{
+		Path:    path,
+		Command: append([]string{exe}, args[1:]...),
+		Dir:     cwd,
+		Inputs:  []string{configPath},
+	}
+
+	var buf bytes.Buffer
+	if err := b.c.WriteNinja(&buf, b.st, b.files, regen); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, build with: ninja -f %s\n", path, path)
+	return nil
+}
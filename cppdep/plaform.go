@@ -16,7 +16,14 @@ func MergePlatformConfig(platform string, config *Config) {
 	config.Excludes = append(config.Excludes, pfConfig.Excludes...)
 	config.Includes = append(config.Includes, pfConfig.Includes...)
 	config.Flags = append(config.Flags, pfConfig.Flags...)
+	config.LinkFlags = append(config.LinkFlags, pfConfig.LinkFlags...)
 	for key, val := range pfConfig.LinkLibraries {
 		config.LinkLibraries[key] = val
 	}
+	if config.LinkDeps == nil && len(pfConfig.LinkDeps) > 0 {
+		config.LinkDeps = make(map[string][]string)
+	}
+	for key, val := range pfConfig.LinkDeps {
+		config.LinkDeps[key] = val
+	}
 }
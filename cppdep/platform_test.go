@@ -16,6 +16,7 @@ includes: ["include_base"]
 linklibraries:
   "base.h": ["-lbase"]
 flags: ["-DBASE"]
+linkflags: ["-pthread"]
 platforms:
   myplatform:
     excludes: ["exclude_myplatform"]
@@ -29,7 +30,11 @@ platforms:
     linklibraries:
       "base.h": ["-lcustomBase"]
       "platform2.h": ["-lmyplatform2"]
+      "libpq-fe.h": {pkgconfig: libpq}
     flags: ["-DMYPLATFORM2"]
+    linkflags: ["-static-libstdc++"]
+    linkdeps:
+      "-lpq": ["-lssl"]
   other:
     myplatform:
     excludes: ["exclude_other"]
@@ -59,7 +64,8 @@ func TestMergePlatformConfigNoMatch(t *testing.T) {
 	expExcludes := []string{"exclude_base"}
 	expIncludes := []string{"include_base"}
 	expFlags := []string{"-DBASE"}
-	expLinkLibs := map[string][]string{"base.h": {"-lbase"}}
+	expLinkFlags := []string{"-pthread"}
+	expLinkLibs := map[string]LinkLibraryConfig{"base.h": {Flags: []string{"-lbase"}}}
 
 	if exp, got := expExcludes, conf.Excludes; !seteq(exp, got) {
 		t.Errorf("excludes not as expected:\nexp: %v\ngot: %v", exp, got)
@@ -70,6 +76,9 @@ func TestMergePlatformConfigNoMatch(t *testing.T) {
 	if exp, got := expFlags, conf.Flags; !seteq(exp, got) {
 		t.Errorf("flags not as expected:\nexp: %v\ngot: %v", exp, got)
 	}
+	if exp, got := expLinkFlags, conf.LinkFlags; !seteq(exp, got) {
+		t.Errorf("link flags not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
 	if exp, got := expLinkLibs, conf.LinkLibraries; !reflect.DeepEqual(exp, got) {
 		t.Errorf("link libs not as expected:\nexp: %v\ngot: %v", exp, got)
 	}
@@ -86,10 +95,13 @@ func TestMergePlatformConfigFullVersion(t *testing.T) {
 	expExcludes := []string{"exclude_base", "exclude_myplatform2"}
 	expIncludes := []string{"include_base", "include_myplatform2"}
 	expFlags := []string{"-DBASE", "-DMYPLATFORM2"}
-	expLinkLibs := map[string][]string{
-		"base.h":      {"-lcustomBase"},
-		"platform2.h": {"-lmyplatform2"},
+	expLinkFlags := []string{"-pthread", "-static-libstdc++"}
+	expLinkLibs := map[string]LinkLibraryConfig{
+		"base.h":      {Flags: []string{"-lcustomBase"}},
+		"platform2.h": {Flags: []string{"-lmyplatform2"}},
+		"libpq-fe.h":  {PkgConfig: "libpq"},
 	}
+	expLinkDeps := map[string][]string{"-lpq": {"-lssl"}}
 
 	if exp, got := expExcludes, conf.Excludes; !seteq(exp, got) {
 		t.Errorf("excludes not as expected:\nexp: %v\ngot: %v", exp, got)
@@ -100,9 +112,15 @@ func TestMergePlatformConfigFullVersion(t *testing.T) {
 	if exp, got := expFlags, conf.Flags; !seteq(exp, got) {
 		t.Errorf("flags not as expected:\nexp: %v\ngot: %v", exp, got)
 	}
+	if exp, got := expLinkFlags, conf.LinkFlags; !seteq(exp, got) {
+		t.Errorf("link flags not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
 	if exp, got := expLinkLibs, conf.LinkLibraries; !reflect.DeepEqual(exp, got) {
 		t.Errorf("link libs not as expected:\nexp: %v\ngot: %v", exp, got)
 	}
+	if exp, got := expLinkDeps, conf.LinkDeps; !reflect.DeepEqual(exp, got) {
+		t.Errorf("link deps not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
 }
 
 func TestMergePlatformConfigPartialMatch(t *testing.T) {
@@ -116,9 +134,10 @@ func TestMergePlatformConfigPartialMatch(t *testing.T) {
 	expExcludes := []string{"exclude_base", "exclude_myplatform"}
 	expIncludes := []string{"include_base", "include_myplatform"}
 	expFlags := []string{"-DBASE", "-DMYPLATFORM"}
-	expLinkLibs := map[string][]string{
-		"base.h":     {"-lbase"},
-		"platform.h": {"-lmyplatform"},
+	expLinkFlags := []string{"-pthread"}
+	expLinkLibs := map[string]LinkLibraryConfig{
+		"base.h":     {Flags: []string{"-lbase"}},
+		"platform.h": {Flags: []string{"-lmyplatform"}},
 	}
 
 	if exp, got := expExcludes, conf.Excludes; !seteq(exp, got) {
@@ -130,6 +149,9 @@ func TestMergePlatformConfigPartialMatch(t *testing.T) {
 	if exp, got := expFlags, conf.Flags; !seteq(exp, got) {
 		t.Errorf("flags not as expected:\nexp: %v\ngot: %v", exp, got)
 	}
+	if exp, got := expLinkFlags, conf.LinkFlags; !seteq(exp, got) {
+		t.Errorf("link flags not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
 	if exp, got := expLinkLibs, conf.LinkLibraries; !reflect.DeepEqual(exp, got) {
 		t.Errorf("link libs not as expected:\nexp: %v\ngot: %v", exp, got)
 	}
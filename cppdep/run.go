@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/cgilling/cppdep"
+)
+
+// RunConfig configures how the run command runs binaries.
+type RunConfig struct {
+	// Dir is the working directory binaries are run in, relative to the config file.
+	// The current directory is used if it is empty.
+	Dir string
+
+	// Gdb and Valgrind are the commands that run a binary under gdb or valgrind, followed
+	// by the binary and its arguments.
+	Gdb      []string
+	Valgrind []string
+}
+
+var (
+	defaultGdbCommand      = []string{"gdb", "--args"}
+	defaultValgrindCommand = []string{"valgrind"}
+)
+
+// runTarget returns the main file of the binary named name, which is matched as with
+// the names of binaries to build.
+func runTarget(st *cppdep.SourceTree, name string) (*cppdep.File, error) {
+	files, err := st.FindSources(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %q", name)
+	}
+	switch len(files) {
+	case 0:
+		return nil, fmt.Errorf("no binary named %q", name)
+	case 1:
+		return files[0], nil
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file.Path))
+	}
+	return nil, fmt.Errorf("%q names more than one binary: %s", name, strings.Join(names, ", "))
+}
+
+// runCommand returns the command line that runs the binary at path with args, under
+// gdb or valgrind if requested.
+func runCommand(config RunConfig, path string, args []string, gdb, valgrind bool) []string {
+	var argv []string
+	switch {
+	case gdb && len(config.Gdb) > 0:
+		argv = append(argv, config.Gdb...)
+	case gdb:
+		argv = append(argv, defaultGdbCommand...)
+	case valgrind && len(config.Valgrind) > 0:
+		argv = append(argv, config.Valgrind...)
+	case valgrind:
+		argv = append(argv, defaultValgrindCommand...)
+	}
+	argv = append(argv, path)
+	return append(argv, args...)
+}
+
+// runDir returns the working directory to run binaries in: dir if set, otherwise the
+// run.dir config key, relative to the config file at configPath.
+func runDir(config *Config, configPath, dir string) string {
+	if dir != "" || config.Run.Dir == "" {
+		return dir
+	}
+	if filepath.IsAbs(config.Run.Dir) {
+		return config.Run.Dir
+	}
+	return filepath.Join(filepath.Dir(configPath), config.Run.Dir)
+}
+
+// runBinary runs argv in dir, or the current directory if dir is empty, and exits with
+// its exit code. Ctrl-C is left to the command, which gets it from the terminal, and
+// SIGTERM is passed on to it.
+func runBinary(argv []string, dir string) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// stop cancelling the build on a signal, so that a Ctrl-C meant for the command, or
+	// a debugger running it, does not stop cppdep
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Failed to run %s: %v", argv[0], err)
+	}
+	go func() {
+		for sig := range sigCh {
+			if sig == syscall.SIGTERM {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code := exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			// as shells report a command killed by a signal
+			code = 128 + int(status.Signal())
+		}
+		os.Exit(code)
+	} else if err != nil {
+		log.Fatalf("Failed to run %s: %v", argv[0], err)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	args := []string{"-x", "a b"}
+	if argv := runCommand(RunConfig{}, "bin/main", args, false, false); !reflect.DeepEqual(argv, []string{"bin/main", "-x", "a b"}) {
+		t.Errorf("Unexpected command: %q", argv)
+	}
+	if argv := runCommand(RunConfig{}, "bin/main", args, true, false); !reflect.DeepEqual(argv, []string{"gdb", "--args", "bin/main", "-x", "a b"}) {
+		t.Errorf("Unexpected gdb command: %q", argv)
+	}
+	config := RunConfig{Valgrind: []string{"valgrind", "--leak-check=full"}}
+	if argv := runCommand(config, "bin/main", nil, false, true); !reflect.DeepEqual(argv, []string{"valgrind", "--leak-check=full", "bin/main"}) {
+		t.Errorf("Unexpected valgrind command: %q", argv)
+	}
+}
+
+func TestRunDir(t *testing.T) {
+	config := &Config{}
+	if dir := runDir(config, "/src/cppdep.yml", ""); dir != "" {
+		t.Errorf("Expected the current directory by default, got %q", dir)
+	}
+	config.Run.Dir = "data"
+	if dir := runDir(config, "/src/cppdep.yml", ""); dir != "/src/data" {
+		t.Errorf("Expected run.dir relative to the config file, got %q", dir)
+	}
+	if dir := runDir(config, "/src/cppdep.yml", "/tmp"); dir != "/tmp" {
+		t.Errorf("Expected the --dir flag to override run.dir, got %q", dir)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// terminalWidth always returns 0 on windows, so the status line is not redrawn in place.
+func terminalWidth(f *os.File) int {
+	return 0
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cgilling/cppdep"
+)
+
+// TestConfig configures how the test command finds and runs test binaries.
+type TestConfig struct {
+	// Patterns match the names of test binaries, as with the names of binaries to build,
+	// for example "*_test".
+	Patterns []string
+
+	// Includes find test binaries by the headers their main files include, for example
+	// "gtest/gtest.h", as written in the include statement.
+	Includes []string
+
+	// Timeout is how long a test binary may run before it is killed, for example "5m",
+	// parsed by time.ParseDuration. There is no limit if it is empty.
+	Timeout string
+
+	// Dir is the working directory test binaries are run in, relative to the config
+	// file. The current directory is used if it is empty.
+	Dir string
+}
+
+// testDir returns the working directory to run test binaries in: dir if set, otherwise
+// the test.dir config key, relative to the config file at configPath.
+func testDir(config *Config, configPath, dir string) string {
+	if dir != "" || config.Test.Dir == "" {
+		return dir
+	}
+	if filepath.IsAbs(config.Test.Dir) {
+		return config.Test.Dir
+	}
+	return filepath.Join(filepath.Dir(configPath), config.Test.Dir)
+}
+
+// testTimeout returns the timeout of test binaries: timeout if set, otherwise the
+// test.timeout config key.
+func testTimeout(config *Config, timeout string) (time.Duration, error) {
+	if timeout == "" {
+		timeout = config.Test.Timeout
+	}
+	if timeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(timeout)
+}
+
+// findTests returns the main files of the test binaries of st, those named by patterns
+// if any are given, otherwise those matched by the patterns or includes of config.
+func findTests(st *cppdep.SourceTree, config TestConfig, patterns []string) ([]*cppdep.File, error) {
+	includes := config.Includes
+	if len(patterns) > 0 {
+		includes = nil
+	} else {
+		patterns = config.Patterns
+	}
+	if len(patterns) == 0 && len(includes) == 0 {
+		return nil, fmt.Errorf("no test binaries configured, set test.patterns or test.includes in the config, or name them on the command line")
+	}
+
+	found := make(map[*cppdep.File]bool)
+	var files []*cppdep.File
+	add := func(matches []*cppdep.File) {
+		for _, file := range matches {
+			if !found[file] {
+				found[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	for _, pattern := range patterns {
+		matches, err := st.FindSources(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %q", pattern)
+		}
+		add(matches)
+	}
+	if len(includes) > 0 {
+		matches, err := st.FindSourcesIncluding(includes)
+		if err != nil {
+			return nil, err
+		}
+		add(matches)
+	}
+	sort.Sort(cppdep.ByBase(files))
+	return files, nil
+}
+
+// writeTestSummary writes a line for each test binary run, followed by the failed test
+// cases and the output of each binary that failed, and the number that passed.
+func writeTestSummary(w io.Writer, results []*cppdep.TestResult) {
+	passed := 0
+	for _, result := range results {
+		status := "PASS"
+		switch {
+		case result.TimedOut:
+			status = "TIMEOUT"
+		case !result.Passed:
+			status = "FAIL"
+		default:
+			passed++
+		}
+		fmt.Fprintf(w, "%-7s %s (%v)\n", status, result.Name, result.Duration.Round(time.Millisecond))
+	}
+	for _, result := range results {
+		if result.Passed {
+			continue
+		}
+		fmt.Fprintf(w, "\n--- %s: %s\n", result.Name, result.Err)
+		for _, name := range result.FailedCases() {
+			fmt.Fprintf(w, "    failed: %s\n", name)
+		}
+		if output := strings.TrimRight(string(result.Output), "\n"); output != "" {
+			fmt.Fprintln(w, output)
+		}
+	}
+	fmt.Fprintf(w, "\n%d of %d test binaries passed\n", passed, len(results))
+}
+
+// writeTestReport writes the JUnit XML report of results to path.
+func writeTestReport(path string, results []*cppdep.TestResult) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := cppdep.WriteJUnit(fp, results); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
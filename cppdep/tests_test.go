@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cgilling/cppdep"
+)
+
+func TestFindTests(t *testing.T) {
+	st := &cppdep.SourceTree{SrcRoot: "../test_files/simple"}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+	names := func(files []*cppdep.File) string {
+		var names []string
+		for _, file := range files {
+			names = append(names, filepath.Base(file.Path))
+		}
+		return strings.Join(names, ",")
+	}
+
+	if _, err := findTests(st, TestConfig{}, nil); err == nil {
+		t.Errorf("Expected an error when no test binaries are configured")
+	}
+	config := TestConfig{Patterns: []string{"mainb"}, Includes: []string{"stdio.h"}}
+	if files, err := findTests(st, config, nil); err != nil || names(files) != "main.cc,mainb.cc" {
+		t.Errorf("Unexpected test binaries: %s (%v)", names(files), err)
+	}
+	if files, err := findTests(st, config, []string{"a*"}); err != nil || names(files) != "a.cc" {
+		t.Errorf("Expected patterns to override the config: %s (%v)", names(files), err)
+	}
+}
+
+func TestWriteTestSummary(t *testing.T) {
+	results := []*cppdep.TestResult{
+		{Name: "a_test", Passed: true, Duration: time.Millisecond},
+		{Name: "b_test", Err: errors.New("exit status 1"), Output: []byte("b failed\n")},
+		{Name: "c_test", TimedOut: true, Err: errors.New("timed out after 1s")},
+	}
+	var buf bytes.Buffer
+	writeTestSummary(&buf, results)
+	summary := buf.String()
+	expected := []string{
+		"PASS    a_test (1ms)\n",
+		"FAIL    b_test (0s)\n",
+		"TIMEOUT c_test (0s)\n",
+		"--- b_test: exit status 1\nb failed\n",
+		"--- c_test: timed out after 1s\n",
+		"1 of 3 test binaries passed\n",
+	}
+	for _, exp := range expected {
+		if !strings.Contains(summary, exp) {
+			t.Errorf("Expected summary to contain %q:\n%s", exp, summary)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package cppdep
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -36,6 +38,13 @@ type SourceTree struct {
 	// to be added, which would look something like this: {"libpq-fe.h": ["-L/usr/pgsql-9.2/lib", "-lpq"]}
 	LinkLibraries map[string][]string
 
+	// PkgConfigLibraries is a map of library header includes to the pkg-config package
+	// that provides them. For example {"libpq-fe.h": "libpq"}. pkg-config is run once
+	// per package, the resulting compile flags are used when compiling any file that
+	// includes the header and the resulting link flags are used when linking any binary
+	// that depends on it.
+	PkgConfigLibraries map[string]string
+
 	// SourceLibs are a way of defining a relationship where a single.h file is implemented by multiple
 	// source files in the source tree. The key is the path to the header file relative to the root of the
 	// source tree and the key is the list of source file paths relative to the root of the source tree.
@@ -43,6 +52,15 @@ type SourceTree struct {
 
 	Generators []Generator
 
+	// Executor runs the Generators. LocalExecutor is used if nil.
+	Executor Executor
+
+	// Trace when set records the time spent walking, generating and scanning.
+	Trace *Trace
+
+	// Progress when set shows the Generators that run on its status line.
+	Progress *Progress
+
 	// BuildDir is the directory where build files will be places. This is used
 	// for a place to put output from the Generators.
 	BuildDir string
@@ -51,6 +69,10 @@ type SourceTree struct {
 	// process dependencies. Default is 1.
 	Concurrency int
 
+	// GeneratorConcurrency is the number of generators run at the same time.
+	// Default is 1.
+	GeneratorConcurrency int
+
 	// UseFastScanning will use the NewFastScanner function for scanning documents rather
 	// than the standard one. See the documention for Scanner for more information.
 	UseFastScanning bool
@@ -60,8 +82,12 @@ type SourceTree struct {
 	// be excluded.
 	AutoInclude bool
 
-	mu      sync.Mutex
-	sources []*File
+	mu        sync.Mutex
+	sources   []*File
+	files     map[string]*File
+	dirs      []string
+	genFiles  []*genFile
+	pkgConfig pkgConfigCache
 }
 
 func (st *SourceTree) GenDir() string {
@@ -131,6 +157,9 @@ func (st *SourceTree) setup() error {
 	if st.Concurrency == 0 {
 		st.Concurrency = 1
 	}
+	if st.GeneratorConcurrency == 0 {
+		st.GeneratorConcurrency = 1
+	}
 	if len(st.Generators) > 0 && st.BuildDir == "" {
 		return fmt.Errorf("Build dir must be set if Generators are used")
 	}
@@ -138,6 +167,13 @@ func (st *SourceTree) setup() error {
 }
 
 func (st *SourceTree) ProcessDirectory() error {
+	return st.ProcessDirectoryContext(context.Background())
+}
+
+// ProcessDirectoryContext is like ProcessDirectory, but stops processing when ctx is
+// done, killing any running generator and removing its outputs. The error of ctx is
+// returned.
+func (st *SourceTree) ProcessDirectoryContext(ctx context.Context) error {
 	if err := st.setup(); err != nil {
 		return err
 	}
@@ -146,6 +182,8 @@ func (st *SourceTree) ProcessDirectory() error {
 
 	var genFiles []*genFile
 	seen := make(map[string]*File)
+	st.files = seen
+	st.dirs = nil
 	allExtsMap := make(map[string]struct{})
 	for _, ext := range st.HeaderExts {
 		allExtsMap[ext] = struct{}{}
@@ -158,12 +196,16 @@ func (st *SourceTree) ProcessDirectory() error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if info.IsDir() {
 			for _, dir := range st.ExcludeDirs {
 				if path == dir {
 					return filepath.SkipDir
 				}
 			}
+			st.dirs = append(st.dirs, path)
 			if st.AutoInclude {
 				st.IncludeDirs = append(st.IncludeDirs, path)
 			}
@@ -207,19 +249,28 @@ func (st *SourceTree) ProcessDirectory() error {
 		return nil
 	}
 
+	endWalk := st.Trace.Begin(PhaseCategory, "walk")
 	filepath.Walk(st.SrcRoot, walkFunc)
+	endWalk()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// We need to run the generator here and add the output files to seen so they
 	// can be picked up in the dependency graph
 
-	// NOTE: for generators that take more than one file for input, this will do
-	// 		 a bunch of extra os.Stat calls but shouldn't generate multiple times.
-
 	genDir := st.GenDir()
 	if err := os.MkdirAll(genDir, 0755); err != nil {
 		return err
 	}
 	st.IncludeDirs = append(st.IncludeDirs, genDir)
+	endGenerate := st.Trace.Begin(PhaseCategory, "generate")
+	ex := st.Executor
+	if ex == nil {
+		ex = LocalExecutor{}
+	}
+	var genJobs []*job
+	generating := make(map[string]bool)
 	for _, genFile := range genFiles {
 		outModTime := time.Now()
 		outputPaths := genFile.gen.OutputPaths(genFile.path, genDir)
@@ -231,17 +282,37 @@ func (st *SourceTree) ProcessDirectory() error {
 				outModTime = info.ModTime()
 			}
 		}
-		if outModTime.Before(genFile.modTime) {
-			genFile.gen.Generate(genFile.path, genDir)
-		}
-		for _, outPath := range outputPaths {
+		// a generator that takes more than one input file is only run once for
+		// the same outputs
+		key := strings.Join(outputPaths, "\x00")
+		if outModTime.Before(genFile.modTime) && !generating[key] {
+			generating[key] = true
+			genFile := genFile
+			genJobs = append(genJobs, &job{
+				name: genFile.path,
+				run: func() error {
+					runGenerator(ctx, ex, st.Progress, st.Trace, genFile.gen, genFile.path, genDir)
+					return nil
+				},
+			})
+		}
+	}
+	if err := runJobs(ctx, genJobs, st.GeneratorConcurrency); err != nil {
+		endGenerate()
+		return err
+	}
+	for _, genFile := range genFiles {
+		for _, outPath := range genFile.gen.OutputPaths(genFile.path, genDir) {
 			info, err := os.Stat(outPath)
 			if err != nil {
+				endGenerate()
 				return err
 			}
 			walkFunc(outPath, info, nil)
 		}
 	}
+	endGenerate()
+	st.genFiles = genFiles
 
 	for libname, sources := range st.Libraries {
 		var depList []*File
@@ -316,6 +387,15 @@ func (st *SourceTree) ProcessDirectory() error {
 				if libs, ok := st.LinkLibraries[scan.Text()]; ok {
 					file.Libs = append(file.Libs, libs...)
 				}
+				if pkg, ok := st.PkgConfigLibraries[scan.Text()]; ok {
+					cflags, libs, err := st.pkgConfig.lookup(pkg)
+					if err != nil {
+						fp.Close()
+						return err
+					}
+					file.CFlags = append(file.CFlags, cflags...)
+					file.Libs = append(file.Libs, libs...)
+				}
 			}
 
 			for _, dir := range searchPath {
@@ -332,15 +412,28 @@ func (st *SourceTree) ProcessDirectory() error {
 		return nil
 	}
 
+	endScan := st.Trace.Begin(PhaseCategory, "scan")
+	defer endScan()
 	ch := make(chan *File)
 	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var processErr error
 
 	for i := 0; i < st.Concurrency; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for file := range ch {
-				processFile(file)
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := processFile(file); err != nil {
+					errMu.Lock()
+					if processErr == nil {
+						processErr = err
+					}
+					errMu.Unlock()
+				}
 			}
 		}()
 	}
@@ -350,7 +443,10 @@ func (st *SourceTree) ProcessDirectory() error {
 	}
 	close(ch)
 	wg.Wait()
-	return nil
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return processErr
 }
 
 func removeExt(path string) string {
@@ -361,6 +457,44 @@ func removeExt(path string) string {
 	return path[:extPos]
 }
 
+// Dirs returns the directories of the source tree that were walked. The modification
+// time of a directory changes when files are added to or removed from it.
+func (st *SourceTree) Dirs() []string {
+	return st.dirs
+}
+
+// GeneratorActions returns the Actions of the generators that matched files in the
+// source tree, whether or not they needed to run, in the order they were found. A
+// generator that matched more than one input file for the same outputs has a single
+// Action with all of them as Inputs. The Actions of generators that are not
+// ActionGenerators have no Argv.
+func (st *SourceTree) GeneratorActions() []*Action {
+	var actions []*Action
+	byOutputs := make(map[string]*Action)
+	for _, gf := range st.genFiles {
+		outputs := gf.gen.OutputPaths(gf.path, st.GenDir())
+		key := strings.Join(outputs, "\x00")
+		if action, ok := byOutputs[key]; ok {
+			action.Inputs = appendMissing(action.Inputs, []string{gf.path})
+			continue
+		}
+		action := generatorAction(gf.gen, gf.path, st.GenDir())
+		byOutputs[key] = action
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// FindFile returns the header or source file found while processing the source tree
+// at path, which is either absolute or relative to the root of the source tree. nil
+// is returned if no such file was found.
+func (st *SourceTree) FindFile(path string) *File {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(st.SrcRoot, path)
+	}
+	return st.files[filepath.Clean(path)]
+}
+
 func (st *SourceTree) FindSource(name string) *File {
 	for _, file := range st.sources {
 		if file.BinaryName == name {
@@ -429,6 +563,49 @@ func (st *SourceTree) FindSources(pattern string) ([]*File, error) {
 	return sources, nil
 }
 
+// FindSourcesIncluding returns the sources that include one of includes directly, as
+// written in their include statements (for example "gtest/gtest.h"), sorted by path.
+// Sources that implement a header are left out, as they are compiled into binaries
+// rather than being the main files of binaries themselves.
+func (st *SourceTree) FindSourcesIncluding(includes []string) ([]*File, error) {
+	wanted := make(map[string]bool)
+	for _, include := range includes {
+		wanted[include] = true
+	}
+	impls := make(map[*File]bool)
+	for _, file := range st.files {
+		for _, source := range file.ImplFiles {
+			impls[source] = true
+		}
+	}
+
+	var sources []*File
+	for _, file := range st.sources {
+		if impls[file] || file.IsSourceLib {
+			continue
+		}
+		fp, err := os.Open(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		var scan *Scanner
+		if st.UseFastScanning {
+			scan = NewFastScanner(fp)
+		} else {
+			scan = NewScanner(fp)
+		}
+		for scan.Scan() {
+			if wanted[scan.Text()] {
+				sources = append(sources, file)
+				break
+			}
+		}
+		fp.Close()
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Path < sources[j].Path })
+	return sources, nil
+}
+
 type inVectorValue struct {
 	file  *File
 	count int
@@ -493,12 +670,113 @@ func (st *SourceTree) FindMainFiles() ([]*File, error) {
 	return files, readErr
 }
 
+// Dependents returns the files of the source tree that depend on file, directly or
+// through other files, sorted by path. As with DepListFollowSource, a file that
+// includes a header depends on the ImplFiles of the header too.
+func (st *SourceTree) Dependents(file *File) []*File {
+	dependents := st.dependents([]*File{file})
+	sort.Slice(dependents, func(i, j int) bool { return dependents[i].Path < dependents[j].Path })
+	return dependents
+}
+
+// Affected returns the files of the source tree affected by changes to the files at
+// paths: the changed files, the outputs of the generators they are inputs of, the
+// files that depend on either and the libraries built from any of these. Paths that
+// are not in the source tree, such as those of deleted files, are ignored. The files
+// are sorted by path, with libraries sorted by name after them.
+func (st *SourceTree) Affected(paths []string) []*File {
+	changed := make(map[string]bool)
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(st.SrcRoot, path)
+		}
+		changed[filepath.Clean(path)] = true
+	}
+	var files []*File
+	add := func(path string) {
+		if file := st.files[path]; file != nil {
+			files = append(files, file)
+		}
+	}
+	for path := range changed {
+		add(path)
+	}
+	for _, action := range st.GeneratorActions() {
+		for _, input := range action.Inputs {
+			if changed[filepath.Clean(input)] {
+				for _, output := range action.Outputs {
+					add(output)
+				}
+				break
+			}
+		}
+	}
+
+	affected := make(map[*File]bool)
+	for _, file := range append(files, st.dependents(files)...) {
+		affected[file] = true
+	}
+	var libs []*File
+	for _, source := range st.sources {
+		if source.Type != LibType {
+			continue
+		}
+		for _, dep := range source.Deps {
+			if affected[dep] {
+				libs = append(libs, source)
+				break
+			}
+		}
+	}
+	files = files[:0]
+	for file := range affected {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	sort.Slice(libs, func(i, j int) bool { return libs[i].BinaryName < libs[j].BinaryName })
+	return append(files, libs...)
+}
+
+// dependents returns the files that depend on any of roots, directly or through other
+// files, excluding roots themselves, in no particular order.
+func (st *SourceTree) dependents(roots []*File) []*File {
+	reverse := make(map[*File][]*File)
+	for _, f := range st.files {
+		for _, dep := range f.Deps {
+			reverse[dep] = append(reverse[dep], f)
+		}
+		for _, source := range f.ImplFiles {
+			reverse[source] = append(reverse[source], f)
+		}
+	}
+
+	seen := make(map[*File]bool)
+	for _, root := range roots {
+		seen[root] = true
+	}
+	queue := append([]*File{}, roots...)
+	var dependents []*File
+	for len(queue) > 0 {
+		f := queue[0]
+		queue = queue[1:]
+		for _, dependent := range reverse[f] {
+			if !seen[dependent] {
+				seen[dependent] = true
+				dependents = append(dependents, dependent)
+				queue = append(queue, dependent)
+			}
+		}
+	}
+	return dependents
+}
+
 type File struct {
 	Path        string
 	Deps        []*File
 	Type        int
 	ImplFiles   []*File // the list of files that implement the functionality defined in this file
 	Libs        []string
+	CFlags      []string // compile flags needed by any file that includes this file
 	ModTime     time.Time
 	BinaryName  string
 	IsSourceLib bool
@@ -507,6 +785,9 @@ type File struct {
 	// tree at any one time.
 	stMu    *sync.Mutex
 	visited bool
+
+	// unitySources are the sources included by a generated unity build source file.
+	unitySources []*File
 }
 
 type genFile struct {
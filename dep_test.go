@@ -1,12 +1,15 @@
 package cppdep
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var cwd string
@@ -46,6 +49,105 @@ func TestDepSimple(t *testing.T) {
 	}
 }
 
+func TestDependents(t *testing.T) {
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+
+	paths := func(files []*File) []string {
+		var paths []string
+		for _, file := range files {
+			rel, _ := filepath.Rel(st.SrcRoot, file.Path)
+			paths = append(paths, rel)
+		}
+		return paths
+	}
+	// main.cc and mainb.cc include a.h, which is implemented by a.cc, and mainb.h is
+	// implemented by mainb.cc
+	if got := paths(st.Dependents(st.FindFile("a.cc"))); !reflect.DeepEqual(got, []string{"a.h", "main.cc", "mainb.cc", "mainb.h"}) {
+		t.Errorf("Unexpected dependents of a.cc: %v", got)
+	}
+	if got := paths(st.Dependents(st.FindFile("mainb.h"))); !reflect.DeepEqual(got, []string{"mainb.cc"}) {
+		t.Errorf("Unexpected dependents of mainb.h: %v", got)
+	}
+	if got := st.Dependents(st.FindFile("main.cc")); len(got) != 0 {
+		t.Errorf("Expected no dependents of main.cc, got %v", paths(got))
+	}
+}
+
+func TestAffected(t *testing.T) {
+	st := SourceTree{
+		SrcRoot:   "test_files/library",
+		Libraries: map[string][]string{"mylib": {"lib.cc"}},
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+	names := func(files []*File) []string {
+		var names []string
+		for _, file := range files {
+			if file.Type == LibType {
+				names = append(names, file.BinaryName)
+			} else {
+				names = append(names, filepath.Base(file.Path))
+			}
+		}
+		return names
+	}
+	// lib.cc includes a.h, which is implemented by a.cc
+	if got := names(st.Affected([]string{"a.cc", "deleted.cc"})); !reflect.DeepEqual(got, []string{"a.cc", "a.h", "lib.cc", "lib.h", "mylib"}) {
+		t.Errorf("Unexpected files affected by a.cc: %v", got)
+	}
+	if got := st.Affected([]string{"/elsewhere/a.cc"}); len(got) != 0 {
+		t.Errorf("Expected no files affected by a file outside the tree, got %v", names(got))
+	}
+
+	outputDir, err := ioutil.TempDir("", "cppdep_affected_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+	st = SourceTree{
+		SrcRoot: "test_files/generator_compile",
+		Generators: []Generator{
+			&TypeGenerator{InputExt: ".txtc", OutputExts: []string{".cc"}, Command: []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.cc"}},
+			&TypeGenerator{InputExt: ".txth", OutputExts: []string{".h"}, Command: []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.h"}},
+		},
+		BuildDir: outputDir,
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+	// the header generated from a.txth is included by both generated sources
+	if got := names(st.Affected([]string{"a.txth"})); !reflect.DeepEqual(got, []string{"a.cc", "a.h", "main.cc"}) {
+		t.Errorf("Unexpected files affected by a.txth: %v", got)
+	}
+}
+
+func TestFindSourcesIncluding(t *testing.T) {
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+
+	// mainb.cc includes stdio.h too, but implements mainb.h
+	sources, err := st.FindSourcesIncluding([]string{"stdio.h", "missing.h"})
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %v", err)
+	case len(sources) != 1 || sources[0] != st.FindFile("main.cc"):
+		t.Errorf("Expected to find only main.cc, found %d sources", len(sources))
+	}
+	if sources, err := st.FindSourcesIncluding([]string{"missing.h"}); err != nil || len(sources) != 0 {
+		t.Errorf("Expected to find no sources: %v, %v", sources, err)
+	}
+}
+
 func TestExcludeDirs(t *testing.T) {
 	st := &SourceTree{
 		SrcRoot:     "test_files/exclude_dir",
@@ -181,6 +283,69 @@ func TestUsingTypeGenerator(t *testing.T) {
 	// 			 for other to include
 }
 
+// countingExecutor runs actions with LocalExecutor, recording the highest number of
+// actions that ran at the same time.
+type countingExecutor struct {
+	mu      sync.Mutex
+	running int
+	max     int
+	count   int
+}
+
+func (ce *countingExecutor) Execute(a *Action) error {
+	ce.mu.Lock()
+	ce.running++
+	ce.count++
+	if ce.running > ce.max {
+		ce.max = ce.running
+	}
+	ce.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	err := LocalExecutor{}.Execute(a)
+	ce.mu.Lock()
+	ce.running--
+	ce.mu.Unlock()
+	return err
+}
+
+func TestGeneratorConcurrency(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	cg := &TypeGenerator{
+		InputExt:   ".txtc",
+		OutputExts: []string{".cc"},
+		Command:    []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.cc"},
+	}
+	hg := &TypeGenerator{
+		InputExt:   ".txth",
+		OutputExts: []string{".h"},
+		Command:    []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.h"},
+	}
+	ex := &countingExecutor{}
+	st := &SourceTree{
+		SrcRoot:              "test_files/generator_compile",
+		Generators:           []Generator{cg, hg},
+		BuildDir:             outputDir,
+		Executor:             ex,
+		GeneratorConcurrency: 3,
+	}
+	err = st.ProcessDirectory()
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %v", err)
+	case ex.count != 3:
+		t.Errorf("Expected 3 generators to run, got %d", ex.count)
+	case ex.max != 3:
+		t.Errorf("Expected the generators to run at the same time, at most %d did", ex.max)
+	case st.FindSource("main") == nil:
+		t.Errorf("Unable to find generated main file")
+	}
+}
+
 func TestFindSources(t *testing.T) {
 	st := SourceTree{
 		SrcRoot: "test_files",
@@ -388,3 +553,50 @@ func TestFileDepList(t *testing.T) {
 		t.Errorf("Expected DepList to contain b.h once, found %d times", countEntries(depList, "b.h"))
 	}
 }
+
+func TestDepPkgConfigLibrary(t *testing.T) {
+	origRunPkgConfig := runPkgConfig
+	defer func() { runPkgConfig = origRunPkgConfig }()
+	runCount := 0
+	runPkgConfig = func(pkg string) ([]byte, error) {
+		runCount++
+		if pkg != "zlib" {
+			t.Errorf("pkg-config run for unexpected package: %q", pkg)
+		}
+		return []byte("-DPKG_CONFIG_CFLAGS -L/opt/zlib/lib -lz\n"), nil
+	}
+
+	st := &SourceTree{
+		SrcRoot:            "test_files/pkg_config",
+		PkgConfigLibraries: map[string]string{"zlib.h": "zlib"},
+		Concurrency:        4,
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+	mainFile := st.FindSource("main")
+	switch {
+	case runCount != 1:
+		t.Errorf("Expected pkg-config to be run once, was run %d times", runCount)
+	case !reflect.DeepEqual(mainFile.CFlags, []string{"-DPKG_CONFIG_CFLAGS"}):
+		t.Errorf("main CFlags not as expected: %v", mainFile.CFlags)
+	case !reflect.DeepEqual(mainFile.Libs, []string{"-L/opt/zlib/lib", "-lz"}):
+		t.Errorf("main Libs not as expected: %v", mainFile.Libs)
+	}
+}
+
+func TestDepPkgConfigLibraryError(t *testing.T) {
+	origRunPkgConfig := runPkgConfig
+	defer func() { runPkgConfig = origRunPkgConfig }()
+	runPkgConfig = func(pkg string) ([]byte, error) {
+		return nil, fmt.Errorf("package %q not found", pkg)
+	}
+
+	st := &SourceTree{
+		SrcRoot:            "test_files/pkg_config",
+		PkgConfigLibraries: map[string]string{"zlib.h": "zlib"},
+	}
+	if err := st.ProcessDirectory(); err == nil {
+		t.Errorf("Expected ProcessDirectory to return pkg-config error")
+	}
+}
@@ -0,0 +1,211 @@
+package cppdep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// parseDepFile parses a make style dependency file as written by the compiler when
+// given -MMD or -MD, and returns all prerequisites of all rules in the file.
+func parseDepFile(r io.Reader) ([]string, error) {
+	// join continued lines first, since a single rule is usually split over many lines
+	var contents strings.Builder
+	scan := bufio.NewScanner(r)
+	scan.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scan.Scan() {
+		line := scan.Text()
+		if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") {
+			contents.WriteString(line[:len(line)-1])
+			contents.WriteByte(' ')
+			continue
+		}
+		contents.WriteString(line)
+		contents.WriteByte('\n')
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	var deps []string
+	for _, rule := range strings.Split(contents.String(), "\n") {
+		words := splitDepFileWords(rule)
+		for i, word := range words {
+			if strings.HasSuffix(word, ":") {
+				deps = append(deps, words[i+1:]...)
+				break
+			}
+		}
+	}
+	return deps, nil
+}
+
+// splitDepFileWords splits a line of a dependency file on unescaped whitespace,
+// removing the escaping of spaces, '#' and '$'.
+func splitDepFileWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == '\\' && i+1 < len(line) && (line[i+1] == ' ' || line[i+1] == '#' || line[i+1] == '\\'):
+			word.WriteByte(line[i+1])
+			i++
+		case ch == '$' && i+1 < len(line) && line[i+1] == '$':
+			word.WriteByte('$')
+			i++
+		case ch == ' ' || ch == '\t':
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteByte(ch)
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+func (c *Compiler) depFilePath(objectPath string) string {
+	return strings.TrimSuffix(objectPath, ".o") + ".d"
+}
+
+// depFileDeps returns the dependencies recorded in the dependency file written by the
+// last compile of an object. If any of the dependencies no longer exist, missing is
+// true and the object should be rebuilt.
+func (c *Compiler) depFileDeps(objectPath string) (deps []string, missing bool) {
+	deps, problem := c.readDepFile(objectPath)
+	return deps, problem != ""
+}
+
+// readDepFile returns the dependencies recorded in the dependency file for objectPath,
+// or a description of why they can not be used, such as a dependency that has since
+// been deleted. A dependency file that does not exist is not a problem, as there is
+// nothing recorded for an object that has not been compiled.
+func (c *Compiler) readDepFile(objectPath string) (deps []string, problem string) {
+	fp, err := os.Open(c.depFilePath(objectPath))
+	if err != nil {
+		return nil, ""
+	}
+	defer fp.Close()
+	paths, err := parseDepFile(fp)
+	if err != nil {
+		return nil, fmt.Sprintf("its dependency file can not be read (%v)", err)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Sprintf("%s, a recorded dependency, no longer exists", path)
+		}
+		deps = append(deps, filepath.Clean(path))
+	}
+	return deps, ""
+}
+
+// depFileCovered returns true if every dependency in the dependency file for objectPath
+// is one of paths. An object whose dependencies are not all known is not stored in the
+// cache, as its key would not change when the other dependencies do.
+func (c *Compiler) depFileCovered(objectPath string, paths []string) bool {
+	deps, missing := c.depFileDeps(objectPath)
+	if missing {
+		return false
+	}
+	known := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		known[absPath(path)] = struct{}{}
+	}
+	for _, dep := range deps {
+		if _, ok := known[absPath(dep)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// compareDepFile compares the dependencies found by the compiler with the dependencies
+// found while scanning the source tree. missed are the dependencies that scanning
+// did not find, and unused are the dependencies that scanning found but the compiler
+// did not use (for example because of conditional includes). Outputs of the build (such
+// as precompiled headers) and the dependencies of precompiled headers are ignored, and all
+// paths are compared and returned in absolute form.
+func (c *Compiler) compareDepFile(file *File, scanned []string, pchs []*PrecompiledHeader) (missed, unused []string, err error) {
+	fp, err := os.Open(c.depFilePath(c.objectPath(file)))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fp.Close()
+	paths, err := parseDepFile(fp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ignore := map[string]struct{}{absPath(file.Path): {}}
+	for _, pch := range pchs {
+		ignore[absPath(pch.Header.Path)] = struct{}{}
+		for _, dep := range pch.Header.DepList() {
+			ignore[absPath(dep.Path)] = struct{}{}
+		}
+	}
+	outputDir := absPath(c.OutputDir) + string(filepath.Separator)
+	ignored := func(path string) bool {
+		_, ok := ignore[path]
+		return ok || strings.HasPrefix(path, outputDir)
+	}
+
+	found := make(map[string]struct{})
+	for _, path := range paths {
+		path = absPath(path)
+		if ignored(path) {
+			continue
+		}
+		found[path] = struct{}{}
+	}
+	scannedSet := make(map[string]struct{})
+	for _, path := range scanned {
+		path = absPath(path)
+		if ignored(path) {
+			continue
+		}
+		scannedSet[path] = struct{}{}
+		if _, ok := found[path]; !ok {
+			unused = append(unused, path)
+		}
+	}
+	for path := range found {
+		if _, ok := scannedSet[path]; !ok {
+			missed = append(missed, path)
+		}
+	}
+	sort.Strings(missed)
+	sort.Strings(unused)
+	return missed, unused, nil
+}
+
+// absPath returns the absolute form of path, or the cleaned path if that is not possible.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// appendMissing appends the paths in extra that are not already in paths.
+func appendMissing(paths, extra []string) []string {
+	seen := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		seen[path] = struct{}{}
+	}
+	for _, path := range extra {
+		if _, ok := seen[path]; !ok {
+			seen[path] = struct{}{}
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,25 @@
+package cppdep
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDepFile(t *testing.T) {
+	contents := `obj/main.o: src/main.cc src/a.h \
+ src/dir\ with\ space/b.h \
+  src/cost$$.h
+src/a.h:
+
+other.o: src/other.h
+`
+	deps, err := parseDepFile(strings.NewReader(contents))
+	expected := []string{"src/main.cc", "src/a.h", "src/dir with space/b.h", "src/cost$.h", "src/other.h"}
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %v", err)
+	case !reflect.DeepEqual(deps, expected):
+		t.Errorf("deps not as expected:\n%q\n%q", deps, expected)
+	}
+}
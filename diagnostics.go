@@ -0,0 +1,269 @@
+package cppdep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Severities of a Diagnostic. Fatal errors are reported as SeverityError.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityNote    = "note"
+)
+
+var (
+	diagnosticRegex   = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)? (fatal error|error|warning|note): (.*)$`)
+	toolMessageRegex  = regexp.MustCompile(`^([^\s:]+): (fatal error|error|warning|note): (.*)$`)
+	optionSuffixRegex = regexp.MustCompile(` \[(-W[^\]]+)\]$`)
+)
+
+// Diagnostic is an error, warning or note from the compiler. Notes that follow an
+// error or warning are attached to it.
+type Diagnostic struct {
+	// Source is the translation unit being compiled when the diagnostic was reported.
+	Source   string `json:"source"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+
+	// Option is the warning option that enabled the diagnostic, e.g. -Wunused-variable.
+	Option string       `json:"option,omitempty"`
+	Notes  []Diagnostic `json:"notes,omitempty"`
+}
+
+// ParseDiagnostics parses the diagnostics from the output of g++ or clang compiling
+// source. Lines that are not diagnostics, such as source excerpts, carets and include
+// stacks, are ignored.
+func ParseDiagnostics(source string, output []byte) []Diagnostic {
+	var diags []Diagnostic
+	scan := bufio.NewScanner(bytes.NewReader(output))
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scan.Scan() {
+		var d Diagnostic
+		if m := diagnosticRegex.FindStringSubmatch(scan.Text()); m != nil {
+			d.File = m[1]
+			d.Line, _ = strconv.Atoi(m[2])
+			d.Column, _ = strconv.Atoi(m[3])
+			d.Severity, d.Message = m[4], m[5]
+		} else if m := toolMessageRegex.FindStringSubmatch(scan.Text()); m != nil {
+			// a diagnostic without a location, e.g. "cc1plus: warning: ..."
+			d.Severity, d.Message = m[2], m[3]
+		} else {
+			continue
+		}
+		d.Source = source
+		if d.Severity == "fatal error" {
+			d.Severity = SeverityError
+		}
+		if m := optionSuffixRegex.FindStringSubmatch(d.Message); m != nil {
+			d.Option = m[1]
+			d.Message = d.Message[:len(d.Message)-len(m[0])]
+		}
+		if d.Severity == SeverityNote && len(diags) > 0 {
+			last := &diags[len(diags)-1]
+			last.Notes = append(last.Notes, d)
+			continue
+		}
+		diags = append(diags, d)
+	}
+	return diags
+}
+
+// Diagnostics collects the diagnostics of all compiles of a build. A nil *Diagnostics
+// is valid and collects nothing.
+type Diagnostics struct {
+	mu    sync.Mutex
+	diags []Diagnostic
+}
+
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{}
+}
+
+func (d *Diagnostics) Add(diags ...Diagnostic) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.diags = append(d.diags, diags...)
+	d.mu.Unlock()
+}
+
+// All returns all diagnostics collected, in the order they were added.
+func (d *Diagnostics) All() []Diagnostic {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Diagnostic(nil), d.diags...)
+}
+
+// Counts returns the number of warnings and errors collected.
+func (d *Diagnostics) Counts() (warnings, errors int) {
+	for _, diag := range d.All() {
+		switch diag.Severity {
+		case SeverityWarning:
+			warnings++
+		case SeverityError:
+			errors++
+		}
+	}
+	return warnings, errors
+}
+
+// Summary returns the counts of warnings and errors in the form "2 warnings, 1 error".
+func (d *Diagnostics) Summary() string {
+	warnings, errors := d.Counts()
+	return fmt.Sprintf("%s, %s", plural(warnings, "warning"), plural(errors, "error"))
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// WriteJSONLines writes each diagnostic as a JSON object on its own line.
+func (d *Diagnostics) WriteJSONLines(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, diag := range d.All() {
+		if err := enc.Encode(diag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool               sarifTool                   `json:"tool"`
+	OriginalURIBaseIDs map[string]sarifArtifactLoc `json:"originalUriBaseIds,omitempty"`
+	Results            []sarifResult               `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name           string `json:"name"`
+		InformationURI string `json:"informationUri"`
+	} `json:"driver"`
+}
+
+type sarifResult struct {
+	RuleID           string          `json:"ruleId,omitempty"`
+	Level            string          `json:"level"`
+	Message          sarifMessage    `json:"message"`
+	Locations        []sarifLocation `json:"locations,omitempty"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation *sarifPhysicalLocation `json:"physicalLocation,omitempty"`
+	Message          *sarifMessage          `json:"message,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLoc `json:"artifactLocation"`
+	Region           *sarifRegion     `json:"region,omitempty"`
+}
+
+type sarifArtifactLoc struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// WriteSARIF writes the diagnostics as a SARIF 2.1.0 log. Paths below srcRoot are
+// written relative to it, using the SRCROOT base id, so that the log does not depend
+// on where the source tree was checked out.
+func (d *Diagnostics) WriteSARIF(w io.Writer, srcRoot string) error {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "cppdep"
+	run.Tool.Driver.InformationURI = "https://github.com/cgilling/cppdep"
+	if srcRoot != "" {
+		srcRoot = absPath(srcRoot)
+		run.OriginalURIBaseIDs = map[string]sarifArtifactLoc{
+			"SRCROOT": {URI: fileURI(srcRoot + string(filepath.Separator))},
+		}
+	}
+
+	location := func(diag Diagnostic) *sarifPhysicalLocation {
+		file := diag.File
+		if file == "" {
+			file = diag.Source
+		}
+		loc := &sarifPhysicalLocation{}
+		path := absPath(file)
+		if rel, err := filepath.Rel(srcRoot, path); srcRoot != "" && err == nil && !strings.HasPrefix(rel, "..") {
+			loc.ArtifactLocation = sarifArtifactLoc{URI: filepath.ToSlash(rel), URIBaseID: "SRCROOT"}
+		} else {
+			loc.ArtifactLocation = sarifArtifactLoc{URI: fileURI(path)}
+		}
+		if diag.Line > 0 {
+			loc.Region = &sarifRegion{StartLine: diag.Line, StartColumn: diag.Column}
+		}
+		return loc
+	}
+
+	for _, diag := range d.All() {
+		result := sarifResult{
+			RuleID:    diag.Option,
+			Level:     diag.Severity,
+			Message:   sarifMessage{Text: diag.Message},
+			Locations: []sarifLocation{{PhysicalLocation: location(diag)}},
+		}
+		for _, note := range diag.Notes {
+			result.RelatedLocations = append(result.RelatedLocations, sarifLocation{
+				PhysicalLocation: location(note),
+				Message:          &sarifMessage{Text: note.Message},
+			})
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	})
+}
+
+func fileURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// collectDiagnostics adds the diagnostics in the compiler output of compiling source
+// to c.Diagnostics.
+func (c *Compiler) collectDiagnostics(source string, output []byte) {
+	if len(output) > 0 {
+		c.Diagnostics.Add(ParseDiagnostics(source, output)...)
+	}
+}
@@ -0,0 +1,162 @@
+package cppdep
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sampleCompilerOutput = `cc1plus: warning: command-line option '-Wstrict-prototypes' is valid for C/ObjC but not for C++
+In file included from src/main.cc:3:
+src/util.h: In function 'void g()':
+src/util.h:2:12: error: too few arguments to function 'void f(int)'
+    2 | void g(){ f(); }
+      |           ~^~
+src/util.h:1:6: note: declared here
+    1 | void f(int);
+      |      ^
+src/main.cc:6:9: warning: comparison of integer expressions of different signedness: 'int' and 'unsigned int' [-Wsign-compare]
+    6 |   if (i == ui) {
+      |       ~~^~~~~
+src/main.cc:9:10: fatal error: nope.h: No such file or directory
+compilation terminated.
+`
+
+func TestParseDiagnostics(t *testing.T) {
+	diags := ParseDiagnostics("src/main.cc", []byte(sampleCompilerOutput))
+	expected := []Diagnostic{
+		{
+			Source:   "src/main.cc",
+			Severity: SeverityWarning,
+			Message:  "command-line option '-Wstrict-prototypes' is valid for C/ObjC but not for C++",
+		},
+		{
+			Source:   "src/main.cc",
+			File:     "src/util.h",
+			Line:     2,
+			Column:   12,
+			Severity: SeverityError,
+			Message:  "too few arguments to function 'void f(int)'",
+			Notes: []Diagnostic{{
+				Source:   "src/main.cc",
+				File:     "src/util.h",
+				Line:     1,
+				Column:   6,
+				Severity: SeverityNote,
+				Message:  "declared here",
+			}},
+		},
+		{
+			Source:   "src/main.cc",
+			File:     "src/main.cc",
+			Line:     6,
+			Column:   9,
+			Severity: SeverityWarning,
+			Message:  "comparison of integer expressions of different signedness: 'int' and 'unsigned int'",
+			Option:   "-Wsign-compare",
+		},
+		{
+			Source:   "src/main.cc",
+			File:     "src/main.cc",
+			Line:     9,
+			Column:   10,
+			Severity: SeverityError,
+			Message:  "nope.h: No such file or directory",
+		},
+	}
+	if !reflect.DeepEqual(diags, expected) {
+		t.Errorf("diagnostics not as expected:\n%+v\n%+v", diags, expected)
+	}
+
+	d := NewDiagnostics()
+	d.Add(diags...)
+	if warnings, errors := d.Counts(); warnings != 2 || errors != 2 {
+		t.Errorf("Expected 2 warnings and 2 errors: %d, %d", warnings, errors)
+	} else if summary := d.Summary(); summary != "2 warnings, 2 errors" {
+		t.Errorf("summary not as expected: %q", summary)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := d.WriteJSONLines(buf); err != nil {
+		t.Fatalf("Failed to write JSON lines: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var first Diagnostic
+	if len(lines) != 4 {
+		t.Errorf("Expected a line per diagnostic: %d", len(lines))
+	} else if err := json.Unmarshal([]byte(lines[1]), &first); err != nil || !reflect.DeepEqual(first, expected[1]) {
+		t.Errorf("JSON line not as expected (%v): %s", err, lines[1])
+	}
+}
+
+func TestDiagnosticsSARIF(t *testing.T) {
+	srcRoot, _ := filepath.Abs("src")
+	d := NewDiagnostics()
+	d.Add(ParseDiagnostics("src/main.cc", []byte(sampleCompilerOutput))...)
+
+	buf := &bytes.Buffer{}
+	if err := d.WriteSARIF(buf, "src"); err != nil {
+		t.Fatalf("Failed to write SARIF: %v", err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatalf("Failed to parse SARIF: %v", err)
+	}
+	if len(log.Runs) != 1 || len(log.Runs[0].Results) != 4 {
+		t.Fatalf("Expected a single run with 4 results: %s", buf.String())
+	}
+	run := log.Runs[0]
+	errResult := run.Results[1]
+	warnResult := run.Results[2]
+	switch {
+	case log.Version != "2.1.0":
+		t.Errorf("Unexpected SARIF version: %q", log.Version)
+	case run.OriginalURIBaseIDs["SRCROOT"].URI != "file://"+srcRoot+"/":
+		t.Errorf("SRCROOT not as expected: %v", run.OriginalURIBaseIDs)
+	case errResult.Level != "error" || errResult.Locations[0].PhysicalLocation.ArtifactLocation.URI != "util.h":
+		t.Errorf("error result not as expected: %+v", errResult)
+	case errResult.Locations[0].PhysicalLocation.ArtifactLocation.URIBaseID != "SRCROOT":
+		t.Errorf("Expected location relative to SRCROOT: %+v", errResult.Locations[0].PhysicalLocation)
+	case len(errResult.RelatedLocations) != 1 || errResult.RelatedLocations[0].Message.Text != "declared here":
+		t.Errorf("Expected note as related location: %+v", errResult.RelatedLocations)
+	case warnResult.RuleID != "-Wsign-compare" || warnResult.Locations[0].PhysicalLocation.Region.StartLine != 6:
+		t.Errorf("warning result not as expected: %+v", warnResult)
+	}
+}
+
+func TestCompileCollectsDiagnostics(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot: "test_files/compiler_warning",
+	}
+	st.ProcessDirectory()
+	mainFile := st.FindSource("main")
+
+	c := &Compiler{
+		Flags:       []string{"-Wsign-compare"},
+		OutputDir:   outputDir,
+		Diagnostics: NewDiagnostics(),
+	}
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	diags := c.Diagnostics.All()
+	switch {
+	case len(diags) != 1:
+		t.Fatalf("Expected a single diagnostic: %+v", diags)
+	case diags[0].Source != mainFile.Path || diags[0].File != mainFile.Path || diags[0].Line != 6:
+		t.Errorf("diagnostic location not as expected: %+v", diags[0])
+	case diags[0].Severity != SeverityWarning || diags[0].Option != "-Wsign-compare":
+		t.Errorf("diagnostic not as expected: %+v", diags[0])
+	}
+}
@@ -0,0 +1,246 @@
+package cppdep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of Actions run during a build.
+const (
+	CompileAction  = "compile"
+	LinkAction     = "link"
+	GenerateAction = "generate"
+	TestAction     = "test"
+)
+
+// Action describes a single command that is run as part of a build.
+type Action struct {
+	Kind        string   // one of CompileAction, LinkAction, GenerateAction or TestAction
+	Description string   // short human readable description, such as "Compiling: main.o"
+	Argv        []string // the command and its arguments
+	Env         []string // the environment of the command, if nil the current environment is used
+	Dir         string   // the working directory of the command, if empty the current directory is used
+	Inputs      []string // paths of the files read by the command
+	Outputs     []string // paths of the files written by the command
+
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// ExtraFiles are open files inherited by the command in addition to stdin, stdout
+	// and stderr, the first being file descriptor 3.
+	ExtraFiles []*os.File
+
+	// Context when set cancels the Action when it is done. Executors should stop the
+	// command, including any processes it started, and return the error of Context.
+	Context context.Context
+
+	// CPUTime is set by the Executor once the command has finished to the user and
+	// system CPU time it used, when that is known.
+	CPUTime time.Duration
+}
+
+// Executor runs the Actions of a build.
+type Executor interface {
+	Execute(a *Action) error
+}
+
+// LocalExecutor runs Actions as processes on the local machine.
+type LocalExecutor struct{}
+
+// Execute runs the command of a and waits for it to finish. If the Action has a
+// Context, the command is run in its own process group, and the whole group is killed
+// when the Context is done, so that no processes started by the command are left
+// running.
+func (LocalExecutor) Execute(a *Action) error {
+	cmd := exec.Command(a.Argv[0], a.Argv[1:]...)
+	cmd.Env = a.Env
+	cmd.Dir = a.Dir
+	cmd.Stdout = a.Stdout
+	cmd.Stderr = a.Stderr
+	cmd.ExtraFiles = a.ExtraFiles
+	if a.Context == nil {
+		err := cmd.Run()
+		a.CPUTime = processCPUTime(cmd)
+		return err
+	}
+	if err := a.Context.Err(); err != nil {
+		return err
+	}
+
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	exited := false
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-a.Context.Done():
+			mu.Lock()
+			if !exited {
+				killProcessGroup(cmd)
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	a.CPUTime = processCPUTime(cmd)
+	mu.Lock()
+	exited = true
+	mu.Unlock()
+	close(done)
+	if ctxErr := a.Context.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// processCPUTime returns the user and system CPU time used by the finished process of
+// cmd, which includes that of its children that it waited for.
+func processCPUTime(cmd *exec.Cmd) time.Duration {
+	if cmd.ProcessState == nil {
+		return 0
+	}
+	return cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+}
+
+// WrapperExecutor prefixes the command of every Action with Wrapper before passing it
+// on to Executor. This can be used to run compiles through tools such as distcc or
+// icecc, or to apply resource limits with tools such as prlimit.
+type WrapperExecutor struct {
+	Wrapper []string
+
+	// Kinds limits the Actions that are wrapped to those of the given kinds. If empty
+	// all Actions are wrapped.
+	Kinds []string
+
+	// Executor runs the wrapped Actions, LocalExecutor is used if nil.
+	Executor Executor
+}
+
+func (we *WrapperExecutor) Execute(a *Action) error {
+	ex := we.Executor
+	if ex == nil {
+		ex = LocalExecutor{}
+	}
+	wrap := len(we.Kinds) == 0
+	for _, kind := range we.Kinds {
+		if kind == a.Kind {
+			wrap = true
+			break
+		}
+	}
+	if !wrap {
+		return ex.Execute(a)
+	}
+	wrapped := *a
+	wrapped.Argv = append(append([]string{}, we.Wrapper...), a.Argv...)
+	err := ex.Execute(&wrapped)
+	a.CPUTime = wrapped.CPUTime
+	return err
+}
+
+// DryRunExecutor writes the command of every Action to W rather than running it.
+// Outputs are not created, so any Action depending on the outputs of an earlier
+// Action is assumed to need running.
+type DryRunExecutor struct {
+	W io.Writer
+}
+
+func (de *DryRunExecutor) Execute(a *Action) error {
+	_, err := fmt.Fprintln(de.W, commandLine(a))
+	return err
+}
+
+// commandLine returns the command of a as it would be typed into a shell.
+func commandLine(a *Action) string {
+	var prefix string
+	if a.Dir != "" {
+		prefix = fmt.Sprintf("cd %s && ", shellQuote(a.Dir))
+	}
+	var args []string
+	for _, arg := range a.Argv {
+		args = append(args, shellQuote(arg))
+	}
+	return prefix + strings.Join(args, " ")
+}
+
+// syncWriter serializes writes to W, so that it can be shared by the standard output
+// and error of a process.
+type syncWriter struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.W.Write(p)
+}
+
+// runCaptured runs a on ex and returns its standard output and error combined. Any
+// writers already set on a receive the output as well. If none are set the output is
+// in the order it was written, as both are then written to the same pipe.
+func runCaptured(ex Executor, a *Action) ([]byte, error) {
+	output := &bytes.Buffer{}
+	sw := &syncWriter{W: output}
+	stdout, stderr := io.Writer(sw), io.Writer(sw)
+	if a.Stdout != nil {
+		stdout = io.MultiWriter(a.Stdout, sw)
+	}
+	if a.Stderr != nil {
+		stderr = io.MultiWriter(a.Stderr, sw)
+	}
+	run := *a
+	run.Stdout, run.Stderr = stdout, stderr
+	err := ex.Execute(&run)
+	a.CPUTime = run.CPUTime
+	return output.Bytes(), err
+}
+
+// writeActionOutput writes the output captured from a finished action to w. The output
+// of a failed action is always written, preceded by the command, if it has one, so
+// that it can be run again by hand. The output of an action that succeeded is only written if it contains
+// warnings, or if verbose is set.
+func writeActionOutput(w io.Writer, a *Action, output []byte, err error, verbose bool) {
+	if !hasActionOutput(output, err, verbose) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(w, "FAILED: %s\n", a.Description)
+		if len(a.Argv) > 0 {
+			fmt.Fprintln(w, commandLine(a))
+		}
+	}
+	w.Write(output)
+}
+
+// hasActionOutput returns whether writeActionOutput writes anything.
+func hasActionOutput(output []byte, err error, verbose bool) bool {
+	if err != nil {
+		return true
+	}
+	return len(output) > 0 && (verbose || bytes.Contains(output, []byte("warning:")))
+}
+
+// shellQuote quotes s so that it can be used as a single argument in a shell command.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=+,:@%", r))
+	}) == -1 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,178 @@
+package cppdep
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrapperExecutor(t *testing.T) {
+	ex := &WrapperExecutor{
+		Wrapper: []string{"env", "CPPDEP_WRAPPED=yes"},
+		Kinds:   []string{CompileAction},
+	}
+
+	buf := &bytes.Buffer{}
+	a := &Action{
+		Kind:   CompileAction,
+		Argv:   []string{"sh", "-c", "echo $CPPDEP_WRAPPED"},
+		Stdout: buf,
+	}
+	if err := ex.Execute(a); err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	} else if buf.String() != "yes\n" {
+		t.Errorf("Expected compile action to be wrapped: %q", buf.String())
+	}
+	if len(a.Argv) != 3 {
+		t.Errorf("Expected the original action to be unmodified: %v", a.Argv)
+	}
+
+	buf.Reset()
+	a.Kind = LinkAction
+	if err := ex.Execute(a); err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	} else if buf.String() != "\n" {
+		t.Errorf("Expected link action to not be wrapped: %q", buf.String())
+	}
+}
+
+func TestDryRunExecutor(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	st.ProcessDirectory()
+
+	buf := &bytes.Buffer{}
+	c := &Compiler{
+		OutputDir: outputDir,
+		Executor:  &DryRunExecutor{W: buf},
+	}
+	if _, err := c.Compile(st.FindSource("main")); err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	switch {
+	case len(lines) != 3:
+		t.Errorf("Expected 2 compiles and a link to be printed:\n%s", buf.String())
+	case !strings.HasPrefix(lines[2], "g++ -o "+filepath.Join(outputDir, "bin/main")):
+		t.Errorf("Expected link to be printed last: %q", lines[2])
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "obj/main.o")); !os.IsNotExist(err) {
+		t.Errorf("Expected no object files to be created")
+	}
+}
+
+func TestRunCaptured(t *testing.T) {
+	a := &Action{
+		Argv: []string{"sh", "-c", "echo out; echo err >&2; echo out2; exit 3"},
+	}
+	output, err := runCaptured(LocalExecutor{}, a)
+	switch {
+	case err == nil:
+		t.Errorf("Expected error from failed command")
+	case string(output) != "out\nerr\nout2\n":
+		t.Errorf("Expected output to be captured in order: %q", output)
+	case a.Stdout != nil || a.Stderr != nil:
+		t.Errorf("Expected the original action to be unmodified")
+	}
+
+	stderr := &bytes.Buffer{}
+	a.Stderr = stderr
+	output, _ = runCaptured(LocalExecutor{}, a)
+	if len(output) != len("out\nerr\nout2\n") {
+		t.Errorf("Expected all output to be captured: %q", output)
+	} else if stderr.String() != "err\n" {
+		t.Errorf("Expected stderr to also go to the writer set on the action: %q", stderr.String())
+	}
+}
+
+func TestWriteActionOutput(t *testing.T) {
+	a := &Action{
+		Description: "Compiling: main.o",
+		Argv:        []string{"g++", "-c", "my file.cc"},
+	}
+	buf := &bytes.Buffer{}
+
+	writeActionOutput(buf, a, []byte("main.cc:1:1: error: oops\n"), errors.New("exit status 1"), false)
+	if expected := "FAILED: Compiling: main.o\ng++ -c 'my file.cc'\nmain.cc:1:1: error: oops\n"; buf.String() != expected {
+		t.Errorf("failed output not as expected:\n%q\n%q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	writeActionOutput(buf, a, []byte("some noise\n"), nil, false)
+	if buf.Len() != 0 {
+		t.Errorf("Expected output of successful action without warnings to be hidden: %q", buf.String())
+	}
+	writeActionOutput(buf, a, []byte("some noise\n"), nil, true)
+	if buf.String() != "some noise\n" {
+		t.Errorf("Expected output of successful action to be shown when verbose: %q", buf.String())
+	}
+
+	buf.Reset()
+	writeActionOutput(buf, a, []byte("main.cc:1:1: warning: hmm\n"), nil, false)
+	if buf.String() != "main.cc:1:1: warning: hmm\n" {
+		t.Errorf("Expected warnings of successful action to be shown: %q", buf.String())
+	}
+}
+
+func TestLocalExecutorCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cppdep_executor_test")
+	if err != nil {
+		t.Fatalf("Failed to setup dir")
+	}
+	defer os.RemoveAll(dir)
+	pidPath := filepath.Join(dir, "pid")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Action{
+		// the background sleep is in the same process group, and has to be killed too
+		Argv:    []string{"sh", "-c", "sleep 30 & echo $! > " + pidPath + "; wait"},
+		Context: ctx,
+	}
+	go func() {
+		for i := 0; i < 100; i++ {
+			if data, _ := ioutil.ReadFile(pidPath); strings.HasSuffix(string(data), "\n") {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+
+	start := time.Now()
+	err = LocalExecutor{}.Execute(a)
+	switch {
+	case err != context.Canceled:
+		t.Errorf("Expected context.Canceled: %v", err)
+	case time.Since(start) > 10*time.Second:
+		t.Errorf("Expected command to be killed when the context was cancelled")
+	}
+
+	pidBytes, _ := ioutil.ReadFile(pidPath)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if err != nil {
+		t.Fatalf("Failed to read pid of background process: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// a killed process that has not been reaped yet shows up as a zombie
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	if err == nil && !strings.HasPrefix(strings.TrimSpace(string(out)), "Z") {
+		exec.Command("kill", strconv.Itoa(pid)).Run()
+		t.Errorf("Expected background process to be killed with its process group")
+	}
+}
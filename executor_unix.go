@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package cppdep
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	// a negative pid signals every process in the group
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
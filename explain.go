@@ -0,0 +1,99 @@
+package cppdep
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Rebuild is an output that CompileAll would build, and the reason it is built.
+type Rebuild struct {
+	Output string
+	Reason string
+}
+
+// Explain returns the precompiled headers, objects and binaries that CompileAll would
+// build for the binaries whose main functions are defined by files, in the order they
+// are built, along with the reason each is built: its output does not exist, one of
+// its inputs is newer than it, or one of its inputs is built first. Outputs that would
+// be restored from the Cache are included, as the Cache is not consulted.
+func (c *Compiler) Explain(files []*File) ([]Rebuild, error) {
+	plan, err := c.planBuild(files)
+	if err != nil {
+		return nil, err
+	}
+	var rebuilds []Rebuild
+	rebuilt := make(map[string]bool)
+	check := func(output string, inputs []string, depFileProblem string) error {
+		reason, err := rebuildReason(output, inputs, rebuilt)
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			reason = depFileProblem
+		}
+		if reason != "" {
+			rebuilt[output] = true
+			rebuilds = append(rebuilds, Rebuild{Output: output, Reason: reason})
+		}
+		return nil
+	}
+
+	for _, pch := range plan.pchs {
+		_, depPaths := pchInputs(pch)
+		if err := check(c.pchPath(pch), depPaths, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, source := range plan.sources {
+		_, depPaths, _ := c.objectInputs(source)
+		objectPath := c.objectPath(source)
+		recorded, problem := c.readDepFile(objectPath)
+		if err := check(objectPath, appendMissing(depPaths, recorded), problem); err != nil {
+			return nil, err
+		}
+	}
+	for _, binInfo := range plan.binaries {
+		var objectPaths []string
+		for _, source := range binInfo.sources {
+			objectPaths = append(objectPaths, c.objectPath(source))
+		}
+		if err := check(c.BinPath(binInfo.file), objectPaths, ""); err != nil {
+			return nil, err
+		}
+	}
+	return rebuilds, nil
+}
+
+// rebuildReason returns why output needs to be built from inputs, or an empty string
+// if it is up to date. Inputs in rebuilt are built before output.
+func rebuildReason(output string, inputs []string, rebuilt map[string]bool) (string, error) {
+	info, err := os.Stat(output)
+	if os.IsNotExist(err) {
+		return "it does not exist", nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, input := range inputs {
+		if rebuilt[input] {
+			return fmt.Sprintf("%s is built first", input), nil
+		}
+	}
+	var newest string
+	var newestModTime time.Time
+	for _, input := range inputs {
+		inputInfo, err := os.Stat(input)
+		if os.IsNotExist(err) {
+			return fmt.Sprintf("%s does not exist", input), nil
+		} else if err != nil {
+			return "", err
+		}
+		if inputInfo.ModTime().After(info.ModTime()) && inputInfo.ModTime().After(newestModTime) {
+			newest, newestModTime = input, inputInfo.ModTime()
+		}
+	}
+	if newest != "" {
+		return fmt.Sprintf("%s is newer", newest), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,110 @@
+package cppdep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_explain_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+	mainFile := st.FindSource("main")
+	c := &Compiler{OutputDir: outputDir}
+
+	objDir := filepath.Join(outputDir, "obj")
+	binPath := filepath.Join(outputDir, "bin", "main")
+	rebuilds, err := c.Explain([]*File{mainFile})
+	expected := []Rebuild{
+		{Output: filepath.Join(objDir, "a.o"), Reason: "it does not exist"},
+		{Output: filepath.Join(objDir, "main.o"), Reason: "it does not exist"},
+		{Output: binPath, Reason: "it does not exist"},
+	}
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %v", err)
+	case !reflect.DeepEqual(rebuilds, expected):
+		t.Errorf("Unexpected rebuilds before compiling:\ngot: %v\nexp: %v", rebuilds, expected)
+	}
+
+	if _, err := c.Compile(mainFile); err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	if rebuilds, err := c.Explain([]*File{mainFile}); err != nil || len(rebuilds) != 0 {
+		t.Errorf("Expected nothing to rebuild after compiling: %v, %v", rebuilds, err)
+	}
+
+	if err := os.Remove(filepath.Join(objDir, "a.o")); err != nil {
+		t.Fatalf("Failed to remove object: %v", err)
+	}
+	rebuilds, err = c.Explain([]*File{mainFile})
+	expected = []Rebuild{
+		{Output: filepath.Join(objDir, "a.o"), Reason: "it does not exist"},
+		{Output: binPath, Reason: filepath.Join(objDir, "a.o") + " is built first"},
+	}
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %v", err)
+	case !reflect.DeepEqual(rebuilds, expected):
+		t.Errorf("Unexpected rebuilds after removing an object:\ngot: %v\nexp: %v", rebuilds, expected)
+	}
+}
+
+func TestExplainDeletedHeader(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_explain_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	srcDir := filepath.Join(outputDir, "src")
+	os.Mkdir(srcDir, 0755)
+	header := filepath.Join(srcDir, "value.h")
+	files := map[string]string{
+		"main.cc": "#include \"value.h\"\nint main() { return VALUE; }\n",
+		"value.h": "#define VALUE 1\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	st := SourceTree{SrcRoot: srcDir}
+	st.ProcessDirectory()
+	c := &Compiler{OutputDir: filepath.Join(outputDir, "build")}
+	if _, err := c.Compile(st.FindSource("main")); err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+
+	// the include is no longer found by scanning, so only the dependency file knows
+	// about the header
+	if err := os.Remove(header); err != nil {
+		t.Fatalf("Failed to remove header: %v", err)
+	}
+	st = SourceTree{SrcRoot: srcDir}
+	st.ProcessDirectory()
+	rebuilds, err := c.Explain([]*File{st.FindSource("main")})
+	objPath := filepath.Join(c.OutputDir, "obj", "main.o")
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %v", err)
+	case len(rebuilds) == 0 || rebuilds[0].Output != objPath:
+		t.Fatalf("Expected main.o to be rebuilt: %v", rebuilds)
+	case !strings.Contains(rebuilds[0].Reason, "value.h, a recorded dependency, no longer exists"):
+		t.Errorf("Expected the deleted header to be the reason: %q", rebuilds[0].Reason)
+	}
+}
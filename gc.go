@@ -0,0 +1,119 @@
+package cppdep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Outputs returns the paths of the files that CompileAll writes for the binaries whose
+// main functions are defined by files: the precompiled headers, objects, dependency
+// files and binaries, along with the unity sources of unity builds. As with
+// CompileAll, the unity sources are written.
+func (c *Compiler) Outputs(files []*File) ([]string, error) {
+	plan, err := c.planBuild(files)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []string
+	for _, pch := range plan.pchs {
+		outputs = append(outputs, c.pchIncludePath(pch), c.pchPath(pch))
+	}
+	for _, source := range plan.sources {
+		objectPath := c.objectPath(source)
+		outputs = append(outputs, objectPath, c.depFilePath(objectPath))
+		if len(source.unitySources) > 0 {
+			outputs = append(outputs, source.Path)
+		}
+	}
+	for _, binInfo := range plan.binaries {
+		outputs = append(outputs, c.BinPath(binInfo.file))
+	}
+	return outputs, nil
+}
+
+// GeneratedFiles returns the paths of the files written by the generators of st.
+func (st *SourceTree) GeneratedFiles() []string {
+	var paths []string
+	for _, action := range st.GeneratorActions() {
+		paths = append(paths, action.Outputs...)
+	}
+	return paths
+}
+
+// RemoveStale removes the files under dir whose paths are not in keep, and the
+// directories left empty by doing so, and returns the paths of the files removed in
+// lexical order. If dryRun is set, the paths are returned but nothing is removed. A
+// dir that does not exist has nothing to remove.
+func RemoveStale(dir string, keep map[string]bool, dryRun bool) ([]string, error) {
+	var removed, dirs []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path != dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if keep[path] {
+			return nil
+		}
+		removed = append(removed, path)
+		if dryRun {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if err != nil || dryRun {
+		return removed, err
+	}
+	// deepest first, so that a directory is emptied before its parent is tried
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		// fails, and is left alone, if d is not empty
+		os.Remove(d)
+	}
+	return removed, nil
+}
+
+// PruneSymlinks removes the symlinks in dir whose targets do not exist or are in
+// removed, and returns their paths. If dryRun is set, the paths are returned but
+// nothing is removed, and removed names the files that would have been removed first.
+func PruneSymlinks(dir string, removed map[string]bool, dryRun bool) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return pruned, err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dir, target)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) && !removed[target] {
+			continue
+		}
+		pruned = append(pruned, path)
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				return pruned, err
+			}
+		}
+	}
+	return pruned, nil
+}
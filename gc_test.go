@@ -0,0 +1,65 @@
+package cppdep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cppdep_gc_test")
+	if err != nil {
+		t.Fatalf("Failed to setup dir")
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"obj/a.o", "obj/b.o", "obj/sub/c.o", "bin/a", "bin/b"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	linkDir := filepath.Join(dir, "links")
+	os.Mkdir(linkDir, 0755)
+	for _, name := range []string{"a", "b", "missing"} {
+		if err := os.Symlink(filepath.Join("..", "bin", name), filepath.Join(linkDir, name)); err != nil {
+			t.Fatalf("Failed to symlink: %v", err)
+		}
+	}
+
+	keep := map[string]bool{filepath.Join(dir, "obj/a.o"): true, filepath.Join(dir, "bin/a"): true}
+	expected := []string{filepath.Join(dir, "obj/b.o"), filepath.Join(dir, "obj/sub/c.o")}
+	if removed, err := RemoveStale(filepath.Join(dir, "obj"), keep, true); err != nil || !reflect.DeepEqual(removed, expected) {
+		t.Errorf("Unexpected dry run result: %v, %v", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "obj/b.o")); err != nil {
+		t.Errorf("Expected dry run to remove nothing: %v", err)
+	}
+	if removed, err := RemoveStale(filepath.Join(dir, "obj"), keep, false); err != nil || !reflect.DeepEqual(removed, expected) {
+		t.Errorf("Unexpected result: %v, %v", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "obj/sub")); !os.IsNotExist(err) {
+		t.Errorf("Expected the emptied directory to be removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "obj/a.o")); err != nil {
+		t.Errorf("Expected kept file to remain: %v", err)
+	}
+	if removed, err := RemoveStale(filepath.Join(dir, "nothere"), keep, false); err != nil || len(removed) != 0 {
+		t.Errorf("Expected nothing to remove from a missing dir: %v, %v", removed, err)
+	}
+
+	// b is dangling once bin/b is removed
+	removed := map[string]bool{filepath.Join(dir, "bin/b"): true}
+	if pruned, err := PruneSymlinks(linkDir, removed, true); err != nil || !reflect.DeepEqual(pruned, []string{filepath.Join(linkDir, "b"), filepath.Join(linkDir, "missing")}) {
+		t.Errorf("Unexpected dry run pruned links: %v, %v", pruned, err)
+	}
+	if pruned, err := PruneSymlinks(linkDir, nil, false); err != nil || !reflect.DeepEqual(pruned, []string{filepath.Join(linkDir, "missing")}) {
+		t.Errorf("Unexpected pruned links: %v, %v", pruned, err)
+	}
+	if _, err := os.Lstat(filepath.Join(linkDir, "a")); err != nil {
+		t.Errorf("Expected link to existing file to remain: %v", err)
+	}
+}
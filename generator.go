@@ -1,9 +1,9 @@
 package cppdep
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -20,6 +20,71 @@ type Generator interface {
 	Generate(inputFile, outputDir string) error
 }
 
+// ActionGenerator is a Generator that can describe how it is run as an Action, which
+// lets it be run by an Executor and written to the build files of other build tools.
+type ActionGenerator interface {
+	Generator
+
+	// Action returns the Action that executes the generator on a given input file.
+	Action(inputFile, outputDir string) *Action
+}
+
+// generatorAction returns the Action of gen for inputFile. Generators that are not
+// ActionGenerators have an Action with their inputs and outputs but no command.
+func generatorAction(gen Generator, inputFile, outputDir string) *Action {
+	if ag, ok := gen.(ActionGenerator); ok {
+		return ag.Action(inputFile, outputDir)
+	}
+	return &Action{
+		Kind:        GenerateAction,
+		Description: fmt.Sprintf("Generating: %s", filepath.Base(inputFile)),
+		Inputs:      []string{inputFile},
+		Outputs:     gen.OutputPaths(inputFile, outputDir),
+	}
+}
+
+// runGenerator executes the Action of gen for inputFile using ex, or calls its Generate
+// method if it is not an ActionGenerator. What it is doing is shown on the status line
+// of p when set, and it is recorded in trace. If ctx is done before the generator
+// finishes, its outputs are removed, as they may only be partially written.
+func runGenerator(ctx context.Context, ex Executor, p *Progress, trace *Trace, gen Generator, inputFile, outputDir string) error {
+	action := generatorAction(gen, inputFile, outputDir)
+	action.Context = ctx
+	if !supressLogging {
+		if p != nil {
+			p.status(action.Description)
+		} else {
+			fmt.Println(action.Description)
+		}
+	}
+	var output []byte
+	var err error
+	endTrace := trace.BeginAction(GenerateAction, inputFile)
+	if _, ok := gen.(ActionGenerator); ok {
+		output, err = runCaptured(ex, action)
+	} else if err = gen.Generate(inputFile, outputDir); err != nil {
+		output = []byte(err.Error() + "\n")
+	}
+	endTrace(action.CPUTime)
+	if ctx.Err() != nil {
+		for _, path := range gen.OutputPaths(inputFile, outputDir) {
+			os.Remove(path)
+		}
+		return err
+	}
+	// unlike the compiler, a generator's output is always shown, in one piece once it
+	// has finished so that it is not mixed up with the output of other actions
+	if supressLogging || !hasActionOutput(output, err, true) {
+		return err
+	}
+	if p != nil {
+		p.print(func() { writeActionOutput(os.Stderr, action, output, err, true) })
+	} else {
+		writeActionOutput(os.Stderr, action, output, err, true)
+	}
+	return err
+}
+
 type TypeGenerator struct {
 	InputExt   string
 	OutputExts []string
@@ -65,7 +130,7 @@ func createEnvVarMap(inputFile, outputDir string) map[string]string {
 	}
 }
 
-func (g *TypeGenerator) Generate(inputFile, outputDir string) error {
+func (g *TypeGenerator) Action(inputFile, outputDir string) *Action {
 	td := createEnvVarMap(inputFile, outputDir)
 	var transformedArgs []string
 	for _, arg := range g.Command[1:] {
@@ -79,19 +144,24 @@ func (g *TypeGenerator) Generate(inputFile, outputDir string) error {
 		transformedArgs = append(transformedArgs, arg)
 	}
 
-	if !supressLogging {
-		fmt.Printf("Generating:")
-		for _, fn := range g.OutputPaths(inputFile, outputDir) {
-			fmt.Printf(" %s", filepath.Base(fn))
-		}
-		fmt.Print("\n")
+	outputPaths := g.OutputPaths(inputFile, outputDir)
+	description := "Generating:"
+	for _, fn := range outputPaths {
+		description += " " + filepath.Base(fn)
 	}
 
-	cmd := exec.Command(g.Command[0])
-	cmd.Args = append(cmd.Args, transformedArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return &Action{
+		Kind:        GenerateAction,
+		Description: description,
+		Argv:        append([]string{g.Command[0]}, transformedArgs...),
+		Inputs:      []string{inputFile},
+		Outputs:     outputPaths,
+	}
+}
+
+// Generate runs the generator on inputFile using a LocalExecutor.
+func (g *TypeGenerator) Generate(inputFile, outputDir string) error {
+	return runGenerator(context.Background(), LocalExecutor{}, nil, nil, g, inputFile, outputDir)
 }
 
 // ShellGenerator defines a generator that depends on the files listed in InputPaths, and by running the
@@ -122,17 +192,27 @@ func (g *ShellGenerator) OutputPaths(inputFile, outputDir string) []string {
 	return outputPaths
 }
 
-func (g *ShellGenerator) Generate(inputFile, outputDir string) error {
-	cmd := exec.Command("sh", g.ShellFilePath)
-	cmd.Env = os.Environ()
+func (g *ShellGenerator) Action(inputFile, outputDir string) *Action {
+	inputs := []string{g.ShellFilePath}
+	if inputFile != "" {
+		inputs = append(inputs, inputFile)
+	}
+	env := os.Environ()
 	for evar, val := range createEnvVarMap(g.ShellFilePath, outputDir) {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", evar[1:], val))
+		env = append(env, fmt.Sprintf("%s=%s", evar[1:], val))
 	}
-	cmd.Dir = filepath.Dir(g.ShellFilePath)
-	if !supressLogging {
-		fmt.Printf("Running Generate Script: %s\n", g.ShellFilePath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+	return &Action{
+		Kind:        GenerateAction,
+		Description: fmt.Sprintf("Running Generate Script: %s", g.ShellFilePath),
+		Argv:        []string{"sh", g.ShellFilePath},
+		Env:         env,
+		Dir:         filepath.Dir(g.ShellFilePath),
+		Inputs:      inputs,
+		Outputs:     g.OutputPaths(inputFile, outputDir),
 	}
-	return cmd.Run()
+}
+
+// Generate runs the shell script using a LocalExecutor.
+func (g *ShellGenerator) Generate(inputFile, outputDir string) error {
+	return runGenerator(context.Background(), LocalExecutor{}, nil, nil, g, inputFile, outputDir)
 }
@@ -1,10 +1,14 @@
 package cppdep
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -34,6 +38,35 @@ func TestTypeGenerator(t *testing.T) {
 	}
 }
 
+func TestGeneratorShownOnProgress(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_generator_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	g := &TypeGenerator{
+		InputExt:   ".txt",
+		OutputExts: []string{".cc"},
+		Command:    []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.cc"},
+	}
+	input := "test_files/simple_generate/test.txt"
+	if action := g.Action(input, outputDir); action.Stdout != nil || action.Stderr != nil {
+		t.Errorf("Expected the output of the generator to only be captured")
+	}
+
+	supressLogging = false
+	defer func() { supressLogging = true }()
+	buf := &bytes.Buffer{}
+	p := NewProgress(buf, false)
+	if err := runGenerator(context.Background(), LocalExecutor{}, p, nil, g, input, outputDir); err != nil {
+		t.Fatalf("Failed to generate files: %v", err)
+	}
+	if buf.String() != "Generating: test.cc\n" {
+		t.Errorf("Expected the generator to be shown on the status line: %q", buf.String())
+	}
+}
+
 func TestShellGenerator(t *testing.T) {
 	outputDir, err := ioutil.TempDir("", "cppdep_generator_test")
 	if err != nil {
@@ -87,3 +120,67 @@ func TestShellGenerator(t *testing.T) {
 	}
 
 }
+
+// copyGenerator is a Generator that is not an ActionGenerator, as those written before
+// ActionGenerator was added are.
+type copyGenerator struct{}
+
+func (copyGenerator) Match(path string) bool {
+	return strings.HasSuffix(path, ".txth")
+}
+
+func (copyGenerator) OutputPaths(inputFile, outputDir string) []string {
+	return []string{outputPrefix(inputFile, outputDir) + ".h"}
+}
+
+func (g copyGenerator) Generate(inputFile, outputDir string) error {
+	contents, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(g.OutputPaths(inputFile, outputDir)[0], contents, 0644)
+}
+
+func TestGeneratorWithoutAction(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_generator_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := &SourceTree{
+		SrcRoot: "test_files/generator_compile",
+		Generators: []Generator{
+			&TypeGenerator{InputExt: ".txtc", OutputExts: []string{".cc"}, Command: []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.cc"}},
+			copyGenerator{},
+		},
+		BuildDir: outputDir,
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+	header := st.FindFile(filepath.Join(st.GenDir(), "a.h"))
+	if header == nil {
+		t.Fatalf("Expected the header to be generated")
+	}
+	if len(st.FindFile(filepath.Join(st.GenDir(), "main.cc")).Deps) == 0 {
+		t.Errorf("Expected main.cc to depend on the generated header")
+	}
+
+	var found bool
+	for _, action := range st.GeneratorActions() {
+		if reflect.DeepEqual(action.Outputs, []string{header.Path}) {
+			found = true
+			if len(action.Argv) != 0 {
+				t.Errorf("Expected no command for a generator without an Action: %v", action.Argv)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected an Action for the generator without an Action")
+	}
+	c := &Compiler{OutputDir: filepath.Join(outputDir, "default")}
+	if err := c.WriteNinja(ioutil.Discard, st, nil, nil); err == nil {
+		t.Errorf("Expected an error writing a build file for a generator without an Action")
+	}
+}
@@ -5,6 +5,6 @@ go 1.12
 require (
 	github.com/jawher/mow.cli v1.1.0
 	github.com/shirou/gopsutil v2.19.9+incompatible
-	golang.org/x/sys v0.0.0-20191010194322-b09406accb47 // indirect
+	golang.org/x/sys v0.0.0-20191010194322-b09406accb47
 	gopkg.in/yaml.v2 v2.2.4
 )
@@ -0,0 +1,263 @@
+package cppdep
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Jobserver limits the number of jobs run at the same time by cppdep and by the make
+// processes it is run from or runs itself, using the GNU make jobserver protocol. Every
+// job needs a token: a process always owns one implicit token, and takes any others
+// by reading a byte from the jobserver pipe, writing it back once the job is done.
+type Jobserver struct {
+	r, w *os.File
+	fifo string // the path of the pipe when it is a named pipe
+	jobs int    // the total number of tokens, 0 if not known
+	own  bool   // whether the pipe was created by NewJobserver
+
+	mu              sync.Mutex
+	implicitInUse   bool
+	implicitWaiters []chan struct{}
+}
+
+// NewJobserver creates a jobserver that allows jobs jobs to run at the same time.
+func NewJobserver(jobs int) (*Jobserver, error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	// the implicit token is the one not in the pipe
+	if _, err := w.Write([]byte(strings.Repeat("+", jobs-1))); err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	return &Jobserver{r: r, w: w, jobs: jobs, own: true}, nil
+}
+
+// JobserverFromMakeflags connects to the jobserver described by makeflags, the value
+// of the MAKEFLAGS environment variable set by make for the commands it runs. It
+// returns nil if makeflags does not describe a jobserver. Make only passes the
+// jobserver on to commands of recursive make rules, such as those that start with +
+// or use $(MAKE), otherwise an error is returned.
+func JobserverFromMakeflags(makeflags string) (*Jobserver, error) {
+	var auth string
+	jobs := 0
+	for _, flag := range strings.Fields(makeflags) {
+		switch {
+		case strings.HasPrefix(flag, "--jobserver-auth="):
+			auth = strings.TrimPrefix(flag, "--jobserver-auth=")
+		case strings.HasPrefix(flag, "--jobserver-fds="):
+			auth = strings.TrimPrefix(flag, "--jobserver-fds=")
+		case strings.HasPrefix(flag, "-j"):
+			jobs, _ = strconv.Atoi(strings.TrimPrefix(flag, "-j"))
+		}
+	}
+	if auth == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(auth, "fifo:") {
+		path := strings.TrimPrefix(auth, "fifo:")
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open jobserver fifo: %v", err)
+		}
+		return &Jobserver{r: f, w: f, fifo: path, jobs: jobs}, nil
+	}
+	fds := strings.Split(auth, ",")
+	if len(fds) != 2 {
+		return nil, fmt.Errorf("invalid jobserver auth: %q", auth)
+	}
+	rfd, err1 := strconv.Atoi(fds[0])
+	wfd, err2 := strconv.Atoi(fds[1])
+	if err1 != nil || err2 != nil || rfd < 0 || wfd < 0 {
+		return nil, fmt.Errorf("invalid jobserver auth: %q", auth)
+	}
+	r, w, err := openJobserverFDs(rfd, wfd)
+	if err != nil {
+		return nil, err
+	}
+	return &Jobserver{r: r, w: w, jobs: jobs}, nil
+}
+
+// Jobs returns the total number of jobs the jobserver allows to run at the same time,
+// or 0 if it is not known.
+func (js *Jobserver) Jobs() int {
+	return js.jobs
+}
+
+// Acquire waits for a token and returns a function that gives it back. If ctx is done
+// first its error is returned.
+func (js *Jobserver) Acquire(ctx context.Context) (release func(), err error) {
+	js.mu.Lock()
+	if !js.implicitInUse {
+		js.implicitInUse = true
+		js.mu.Unlock()
+		return js.releaseImplicit, nil
+	}
+	// whichever comes first of the implicit token being released and a token being
+	// read from the pipe is used
+	implicit := make(chan struct{})
+	js.implicitWaiters = append(js.implicitWaiters, implicit)
+	js.mu.Unlock()
+
+	tokens := make(chan byte, 1)
+	readErr := make(chan error, 1)
+	go func() {
+		var buf [1]byte
+		for {
+			n, err := js.r.Read(buf[:])
+			if n == 1 {
+				tokens <- buf[0]
+				return
+			} else if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	// a token read after Acquire has given up waiting goes straight back
+	giveBack := func() {
+		go func() {
+			select {
+			case token := <-tokens:
+				js.w.Write([]byte{token})
+			case <-readErr:
+			}
+		}()
+	}
+
+	select {
+	case token := <-tokens:
+		if !js.stopWaiting(implicit) {
+			// the implicit token was handed to us at the same time
+			js.w.Write([]byte{token})
+			return js.releaseImplicit, nil
+		}
+		var once sync.Once
+		return func() { once.Do(func() { js.w.Write([]byte{token}) }) }, nil
+	case <-implicit:
+		giveBack()
+		return js.releaseImplicit, nil
+	case err := <-readErr:
+		if !js.stopWaiting(implicit) {
+			return js.releaseImplicit, nil
+		}
+		return nil, fmt.Errorf("failed to read from jobserver: %v", err)
+	case <-ctx.Done():
+		giveBack()
+		if !js.stopWaiting(implicit) {
+			js.releaseImplicit()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// stopWaiting removes a waiter for the implicit token, returning false if the implicit
+// token has already been handed to it.
+func (js *Jobserver) stopWaiting(waiter chan struct{}) bool {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for i, w := range js.implicitWaiters {
+		if w == waiter {
+			js.implicitWaiters = append(js.implicitWaiters[:i], js.implicitWaiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (js *Jobserver) releaseImplicit() {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.implicitWaiters) > 0 {
+		close(js.implicitWaiters[0])
+		js.implicitWaiters = js.implicitWaiters[1:]
+		return
+	}
+	js.implicitInUse = false
+}
+
+// Close closes the jobserver pipe.
+func (js *Jobserver) Close() error {
+	if js.r == js.w {
+		return js.r.Close()
+	}
+	js.w.Close()
+	return js.r.Close()
+}
+
+// attach returns a copy of a that passes the jobserver on to the command, so that a
+// make run by it takes its tokens from the same jobserver.
+func (js *Jobserver) attach(a *Action) *Action {
+	attached := *a
+	env := a.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	var makeflags []string
+	var newEnv []string
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "MAKEFLAGS=") {
+			newEnv = append(newEnv, kv)
+			continue
+		}
+		for _, flag := range strings.Fields(strings.TrimPrefix(kv, "MAKEFLAGS=")) {
+			if !strings.HasPrefix(flag, "--jobserver-") && !strings.HasPrefix(flag, "-j") {
+				makeflags = append(makeflags, flag)
+			}
+		}
+	}
+	if js.jobs > 0 {
+		makeflags = append(makeflags, fmt.Sprintf("-j%d", js.jobs))
+	}
+	if js.fifo != "" {
+		makeflags = append(makeflags, "--jobserver-auth=fifo:"+js.fifo)
+	} else {
+		// the pipe is inherited as the next two file descriptors after stdin, stdout,
+		// stderr and any other extra files of the action
+		fd := 3 + len(a.ExtraFiles)
+		attached.ExtraFiles = append(append([]*os.File{}, a.ExtraFiles...), js.r, js.w)
+		makeflags = append(makeflags, fmt.Sprintf("--jobserver-auth=%d,%d", fd, fd+1))
+	}
+	attached.Env = append(newEnv, "MAKEFLAGS="+strings.Join(makeflags, " "))
+	return &attached
+}
+
+// JobserverExecutor takes a token from Jobserver before running each Action with
+// Executor, and gives it back when the Action has finished. The jobserver is passed on
+// to the command of the Action, so that it can be used by a make run by a generator.
+type JobserverExecutor struct {
+	Jobserver *Jobserver
+
+	// Executor runs the Actions, LocalExecutor is used if nil.
+	Executor Executor
+}
+
+func (je *JobserverExecutor) Execute(a *Action) error {
+	ex := je.Executor
+	if ex == nil {
+		ex = LocalExecutor{}
+	}
+	ctx := a.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	release, err := je.Jobserver.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	attached := je.Jobserver.attach(a)
+	err = ex.Execute(attached)
+	a.CPUTime = attached.CPUTime
+	return err
+}
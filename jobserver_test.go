@@ -0,0 +1,192 @@
+//go:build !windows
+// +build !windows
+
+package cppdep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestJobserverTokens(t *testing.T) {
+	js, err := NewJobserver(3)
+	if err != nil {
+		t.Fatalf("Failed to create jobserver: %v", err)
+	}
+	defer js.Close()
+
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		release, err := js.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error acquiring token %d: %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := js.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected acquiring a fourth token to wait until cancelled: %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := js.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("Expected the token to be acquired only once one is released")
+	case <-time.After(20 * time.Millisecond):
+	}
+	releases[0]()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the token to be acquired once one is released")
+	}
+	for _, release := range releases[1:] {
+		release()
+	}
+
+	// all tokens are back, including the one read after the cancelled acquire gave up
+	releases = nil
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		release, err := js.Acquire(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Expected all tokens to have been given back: %v", err)
+		}
+		releases = append(releases, release)
+	}
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestJobserverFromMakeflags(t *testing.T) {
+	if js, err := JobserverFromMakeflags("-k -j4"); js != nil || err != nil {
+		t.Errorf("Expected no jobserver without --jobserver-auth: %v, %v", js, err)
+	}
+	if _, err := JobserverFromMakeflags("-j4 --jobserver-auth=x,y"); err == nil {
+		t.Errorf("Expected error for invalid jobserver auth")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	w.Write([]byte("++"))
+	// the jobserver takes ownership of the descriptors, as it would of the ones
+	// inherited from make
+	rfd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to dup pipe: %v", err)
+	}
+	wfd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to dup pipe: %v", err)
+	}
+	makeflags := fmt.Sprintf(" -j3 --jobserver-auth=%d,%d", rfd, wfd)
+	js, err := JobserverFromMakeflags(makeflags)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer js.Close()
+	if js.Jobs() != 3 {
+		t.Errorf("Expected 3 jobs from -j3, got %d", js.Jobs())
+	}
+
+	// the implicit token and the two in the pipe
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := js.Acquire(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Failed to acquire token %d: %v", i, err)
+		}
+	}
+
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	defer devNull.Close()
+	makeflags = fmt.Sprintf("--jobserver-auth=%d,%d", devNull.Fd(), devNull.Fd())
+	if _, err := JobserverFromMakeflags(makeflags); err == nil {
+		t.Errorf("Expected error for jobserver file descriptors that are not pipes")
+	}
+}
+
+func TestJobserverExecutorRunsMake(t *testing.T) {
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make is not installed")
+	}
+	dir, err := ioutil.TempDir("", "cppdep_jobserver_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	// each target waits for the other to start, which only finishes if the make run
+	// by the action gets a second token from the jobserver
+	makefile := "all: a b\n" +
+		"a:\n\ttouch a.started; while [ ! -e b.started ]; do sleep 0.01; done\n" +
+		"b:\n\ttouch b.started; while [ ! -e a.started ]; do sleep 0.01; done\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "Makefile"), []byte(makefile), 0644); err != nil {
+		t.Fatalf("Failed to write Makefile: %v", err)
+	}
+
+	js, err := NewJobserver(2)
+	if err != nil {
+		t.Fatalf("Failed to create jobserver: %v", err)
+	}
+	defer js.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var output bytes.Buffer
+	action := &Action{
+		Kind:    GenerateAction,
+		Argv:    []string{"make", "-s"},
+		Env:     append(os.Environ(), "MAKEFLAGS=-k"),
+		Dir:     dir,
+		Stdout:  &output,
+		Stderr:  &output,
+		Context: ctx,
+	}
+	ex := &JobserverExecutor{Jobserver: js}
+	if err := ex.Execute(action); err != nil {
+		t.Fatalf("make failed: %v\n%s", err, output.String())
+	}
+	if strings.Contains(output.String(), "jobserver") {
+		t.Errorf("Unexpected jobserver warning from make: %s", output.String())
+	}
+
+	// the tokens taken by make have all been given back
+	release, err := js.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Failed to acquire token: %v", err)
+	}
+	defer release()
+	release2, err := js.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Failed to acquire second token: %v", err)
+	}
+	release2()
+}
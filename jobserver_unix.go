@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package cppdep
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openJobserverFDs returns the jobserver pipe inherited from make as file descriptors
+// rfd and wfd. Make closes them for commands that are not recursive make rules, in
+// which case the descriptors may since have been reused for something else, so they
+// must both be pipes.
+func openJobserverFDs(rfd, wfd int) (r, w *os.File, err error) {
+	for _, fd := range []int{rfd, wfd} {
+		var stat syscall.Stat_t
+		if err := syscall.Fstat(fd, &stat); err != nil || stat.Mode&syscall.S_IFMT != syscall.S_IFIFO {
+			return nil, nil, fmt.Errorf("jobserver file descriptor %d is not an open pipe, mark the make rule running cppdep as recursive with a leading +", fd)
+		}
+	}
+	return os.NewFile(uintptr(rfd), "jobserver-r"), os.NewFile(uintptr(wfd), "jobserver-w"), nil
+}
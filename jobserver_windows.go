@@ -0,0 +1,12 @@
+package cppdep
+
+import (
+	"errors"
+	"os"
+)
+
+// openJobserverFDs is not supported on Windows, where make uses a named semaphore for
+// its jobserver rather than a pipe.
+func openJobserverFDs(rfd, wfd int) (r, w *os.File, err error) {
+	return nil, nil, errors.New("the make jobserver is not supported on windows")
+}
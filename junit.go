@@ -0,0 +1,143 @@
+package cppdep
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// JUnitTestSuites is the root element of a JUnit XML report, as written by
+// WriteJUnit and by Google Test binaries run with GTEST_OUTPUT=xml:PATH.
+type JUnitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr,omitempty"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr,omitempty"`
+	Suites   []JUnitTestSuite `xml:"testsuite"`
+}
+
+type JUnitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr,omitempty"`
+	Time     string          `xml:"time,attr,omitempty"`
+	Cases    []JUnitTestCase `xml:"testcase"`
+}
+
+type JUnitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	ClassName string         `xml:"classname,attr,omitempty"`
+	Time      string         `xml:"time,attr,omitempty"`
+	Status    string         `xml:"status,attr,omitempty"`
+	Result    string         `xml:"result,attr,omitempty"`
+	Failures  []JUnitFailure `xml:"failure"`
+	Skipped   *JUnitSkipped  `xml:"skipped"`
+	SystemOut string         `xml:"system-out,omitempty"`
+}
+
+type JUnitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+type JUnitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
+
+// readJUnit reads a JUnit XML report.
+func readJUnit(r io.Reader) (*JUnitTestSuites, error) {
+	var suites JUnitTestSuites
+	if err := xml.NewDecoder(r).Decode(&suites); err != nil {
+		return nil, err
+	}
+	return &suites, nil
+}
+
+func formatJUnitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// FailedCases returns the names, as suite.case, of the test cases reported by the test
+// binary that failed.
+func (r *TestResult) FailedCases() []string {
+	var names []string
+	for _, suite := range r.Suites {
+		for _, tc := range suite.Cases {
+			if len(tc.Failures) > 0 {
+				names = append(names, suite.Name+"."+tc.Name)
+			}
+		}
+	}
+	return names
+}
+
+// junitSuites returns the test suites of the report for r. The suites reported by the
+// test binary are named after it, and a suite with a single case named after the
+// binary stands for a binary that reported no results, or failed without reporting a
+// failed case (such as by crashing or timing out).
+func (r *TestResult) junitSuites() []JUnitTestSuite {
+	var suites []JUnitTestSuite
+	for _, suite := range r.Suites {
+		suite.Name = r.Name + "." + suite.Name
+		suite.Tests, suite.Failures, suite.Skipped = len(suite.Cases), 0, 0
+		for _, tc := range suite.Cases {
+			if len(tc.Failures) > 0 {
+				suite.Failures++
+			} else if tc.Skipped != nil || tc.Status == "notrun" {
+				suite.Skipped++
+			}
+		}
+		suites = append(suites, suite)
+	}
+	if len(suites) > 0 && (r.Passed || len(r.FailedCases()) > 0) {
+		return suites
+	}
+
+	tc := JUnitTestCase{
+		Name:      r.Name,
+		ClassName: r.Name,
+		Time:      formatJUnitTime(r.Duration),
+		SystemOut: string(r.Output),
+	}
+	suite := JUnitTestSuite{Name: r.Name, Tests: 1, Time: tc.Time}
+	if !r.Passed {
+		tc.Failures = []JUnitFailure{{Message: r.failureMessage(), Text: string(r.Output)}}
+		tc.SystemOut = ""
+		suite.Failures = 1
+	}
+	suite.Cases = []JUnitTestCase{tc}
+	return append(suites, suite)
+}
+
+// WriteJUnit writes a JUnit XML report of results, combining the reports of the test
+// binaries that wrote one with a test case for each binary that did not.
+func WriteJUnit(w io.Writer, results []*TestResult) error {
+	report := JUnitTestSuites{Name: "cppdep"}
+	var total time.Duration
+	for _, r := range results {
+		total += r.Duration
+		for _, suite := range r.junitSuites() {
+			report.Tests += suite.Tests
+			report.Failures += suite.Failures
+			report.Errors += suite.Errors
+			report.Suites = append(report.Suites, suite)
+		}
+	}
+	report.Time = formatJUnitTime(total)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
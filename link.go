@@ -0,0 +1,170 @@
+package cppdep
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// isLinkLibrary returns true if arg refers to a library to be linked against, either
+// through -l or by providing a path to an archive or shared object directly.
+func isLinkLibrary(arg string) bool {
+	if strings.HasPrefix(arg, "-l") {
+		return true
+	}
+	if strings.HasPrefix(arg, "-") {
+		return false
+	}
+	base := filepath.Base(arg)
+	return strings.HasSuffix(base, ".a") || strings.HasSuffix(base, ".so") || strings.Contains(base, ".so.")
+}
+
+// linkFlagsWithArg are link flags whose argument is the next word, which must stay
+// with them.
+var linkFlagsWithArg = map[string]bool{
+	"-framework":      true,
+	"-weak_framework": true,
+	"-Xlinker":        true,
+	"-L":              true,
+	"-T":              true,
+	"-u":              true,
+	"-z":              true,
+}
+
+// positionalLinkerFlags are linker flags that apply to the libraries that follow them,
+// so libraries can not be moved across them.
+var positionalLinkerFlags = map[string]bool{
+	"-Bstatic":           true,
+	"-Bdynamic":          true,
+	"--whole-archive":    true,
+	"--no-whole-archive": true,
+	"--start-group":      true,
+	"--end-group":        true,
+	"-(":                 true,
+	"-)":                 true,
+	"--as-needed":        true,
+	"--no-as-needed":     true,
+}
+
+// isPositionalLinkFlag returns true if arg passes one of the positionalLinkerFlags to
+// the linker through -Wl.
+func isPositionalLinkFlag(arg string) bool {
+	if !strings.HasPrefix(arg, "-Wl,") {
+		return false
+	}
+	for _, flag := range strings.Split(arg[len("-Wl,"):], ",") {
+		if positionalLinkerFlags[flag] {
+			return true
+		}
+	}
+	return false
+}
+
+// orderLinkArgs orders the link arguments in args so that they can be passed to the
+// linker. All -L search paths come first, without duplicates, as they apply to every
+// library wherever they are given. Positional flags such as -Wl,-Bstatic and
+// -Wl,--whole-archive keep their place, since they apply to the libraries that follow
+// them, and each run of libraries between them is ordered by orderLinkLibraries. Other
+// flags, such as -pthread, are kept once, ahead of the libraries of their run.
+func orderLinkArgs(args []string, linkDeps map[string][]string) []string {
+	seen := make(map[string]bool)
+	var searchPaths, ordered, libs []string
+	flush := func() {
+		ordered = append(ordered, orderLinkLibraries(libs, linkDeps)...)
+		libs = nil
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		flag := []string{arg}
+		if linkFlagsWithArg[arg] && i+1 < len(args) {
+			i++
+			flag = append(flag, args[i])
+		}
+		switch {
+		case strings.HasPrefix(arg, "-L") && arg != "-L":
+			if !seen[arg] {
+				seen[arg] = true
+				searchPaths = append(searchPaths, arg)
+			}
+		case isLinkLibrary(arg):
+			libs = append(libs, arg)
+		case isPositionalLinkFlag(arg) || (arg == "-Xlinker" && len(flag) == 2 && positionalLinkerFlags[flag[1]]):
+			flush()
+			ordered = append(ordered, flag...)
+		default:
+			key := strings.Join(flag, " ")
+			if !seen[key] {
+				seen[key] = true
+				ordered = append(ordered, flag...)
+			}
+		}
+	}
+	flush()
+	return append(searchPaths, ordered...)
+}
+
+// orderLinkLibraries deduplicates the libraries in libs and orders them. linkDeps maps
+// a library argument to the library arguments it depends on (for example
+// {"-lpq": {"-lssl", "-lcrypto"}}). Dependencies not already in libs are added, and
+// libraries are topologically sorted so that every library comes before the libraries
+// it depends on, which is required when linking statically. Libraries with no ordering
+// constraint between them keep the order in which they were first seen.
+func orderLinkLibraries(libs []string, linkDeps map[string][]string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	var add func(lib string)
+	add = func(lib string) {
+		if seen[lib] {
+			return
+		}
+		seen[lib] = true
+		unique = append(unique, lib)
+		for _, dep := range linkDeps[lib] {
+			add(dep)
+		}
+	}
+	for _, lib := range libs {
+		add(lib)
+	}
+	libs = unique
+
+	index := make(map[string]int)
+	for i, lib := range libs {
+		index[lib] = i
+	}
+	inDegree := make([]int, len(libs))
+	for _, lib := range libs {
+		for _, dep := range linkDeps[lib] {
+			if i, ok := index[dep]; ok && dep != lib {
+				inDegree[i]++
+			}
+		}
+	}
+
+	// Kahn's algorithm, always choosing the earliest seen library that is ready so
+	// that the output is stable. If there is a cycle, the earliest seen remaining
+	// library is chosen to break it.
+	done := make([]bool, len(libs))
+	sortedLibs := make([]string, 0, len(libs))
+	for len(sortedLibs) < len(libs) {
+		next := -1
+		for i := range libs {
+			if done[i] {
+				continue
+			}
+			if inDegree[i] == 0 {
+				next = i
+				break
+			} else if next == -1 {
+				next = i
+			}
+		}
+		done[next] = true
+		sortedLibs = append(sortedLibs, libs[next])
+		for _, dep := range linkDeps[libs[next]] {
+			if i, ok := index[dep]; ok && !done[i] && dep != libs[next] {
+				inDegree[i]--
+			}
+		}
+	}
+	return sortedLibs
+}
@@ -0,0 +1,92 @@
+package cppdep
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrderLinkArgsDeduplicates(t *testing.T) {
+	args := []string{"-lz", "-lpthread", "-lz", "-lpthread", "-lz"}
+	exp := []string{"-lz", "-lpthread"}
+	if got := orderLinkArgs(args, nil); !reflect.DeepEqual(exp, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
+}
+
+func TestOrderLinkArgsSearchPathsFirst(t *testing.T) {
+	args := []string{"-lz", "-L/usr/pgsql/lib", "-lpq", "-Wl,--as-needed", "-L/opt/lib", "-L/usr/pgsql/lib"}
+	exp := []string{"-L/usr/pgsql/lib", "-L/opt/lib", "-lz", "-lpq", "-Wl,--as-needed"}
+	if got := orderLinkArgs(args, nil); !reflect.DeepEqual(exp, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
+}
+
+func TestOrderLinkArgsDependencies(t *testing.T) {
+	linkDeps := map[string][]string{
+		"-lpq":  {"-lssl", "-lcrypto"},
+		"-lssl": {"-lcrypto"},
+	}
+	args := []string{"-lcrypto", "-lz", "-lssl", "-lpq", "/opt/lib/libfoo.a"}
+	exp := []string{"-lz", "-lpq", "-lssl", "-lcrypto", "/opt/lib/libfoo.a"}
+	if got := orderLinkArgs(args, linkDeps); !reflect.DeepEqual(exp, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
+
+	// dependencies not already present should be added
+	exp = []string{"-lpq", "-lssl", "-lcrypto"}
+	if got := orderLinkArgs([]string{"-lpq"}, linkDeps); !reflect.DeepEqual(exp, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
+}
+
+func TestOrderLinkArgsCycle(t *testing.T) {
+	linkDeps := map[string][]string{
+		"-la": {"-lb"},
+		"-lb": {"-la"},
+	}
+	exp := []string{"-la", "-lb"}
+	if got := orderLinkArgs([]string{"-la", "-lb"}, linkDeps); !reflect.DeepEqual(exp, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
+}
+
+func TestOrderLinkArgsPositionalFlags(t *testing.T) {
+	linkDeps := map[string][]string{"-lfoo": {"-lbar"}}
+	args := []string{"-lz", "-Wl,-Bstatic", "-lfoo", "-Wl,-Bdynamic", "-lpthread", "-lz"}
+	exp := []string{"-lz", "-Wl,-Bstatic", "-lfoo", "-lbar", "-Wl,-Bdynamic", "-lpthread", "-lz"}
+	if got := orderLinkArgs(args, linkDeps); !reflect.DeepEqual(exp, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
+
+	args = []string{"-Wl,--whole-archive", "-lplugins", "-Wl,--no-whole-archive", "-ldl", "-Wl,--start-group", "-la", "-lb", "-Wl,--end-group"}
+	if got := orderLinkArgs(args, nil); !reflect.DeepEqual(args, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", args, got)
+	}
+
+	args = []string{"-Xlinker", "-Bstatic", "-lfoo", "-Xlinker", "-Bdynamic", "-lfoo"}
+	if got := orderLinkArgs(args, nil); !reflect.DeepEqual(args, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", args, got)
+	}
+
+	// other flags are not boundaries of a run of libraries, and are only kept once
+	args = []string{"-lz", "-framework", "Cocoa", "-pthread", "-lz", "-framework", "Cocoa", "-framework", "Metal"}
+	exp = []string{"-framework", "Cocoa", "-pthread", "-framework", "Metal", "-lz"}
+	if got := orderLinkArgs(args, nil); !reflect.DeepEqual(exp, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
+
+	// a library needed by one after a positional flag is repeated after it, as the
+	// earlier one is linked with different flags
+	linkDeps = map[string][]string{"-lpq": {"-lssl"}}
+	args = []string{"-pthread", "-lz", "-pthread", "-lz", "-lssl", "-Wl,--as-needed", "-lpq"}
+	exp = []string{"-pthread", "-lz", "-lssl", "-Wl,--as-needed", "-lpq", "-lssl"}
+	if got := orderLinkArgs(args, linkDeps); !reflect.DeepEqual(exp, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
+
+	args = []string{"-pthread", "-lz", "-pthread", "-lz", "-lssl", "-lpq", "-Wl,--as-needed", "-lpq"}
+	exp = []string{"-pthread", "-lz", "-lpq", "-lssl", "-Wl,--as-needed", "-lpq", "-lssl"}
+	if got := orderLinkArgs(args, linkDeps); !reflect.DeepEqual(exp, got) {
+		t.Errorf("link args not as expected:\nexp: %v\ngot: %v", exp, got)
+	}
+}
@@ -0,0 +1,253 @@
+package cppdep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MakefileMode is a build mode of a Makefile written by WriteMakefile.
+type MakefileMode struct {
+	Name      string
+	Flags     []string // compile flags, used in place of the Flags of the Compiler
+	LinkFlags []string // link flags, used in place of the LinkFlags of the Compiler
+}
+
+// Make variables used in the commands of a Makefile in place of the settings that
+// depend on the mode.
+const (
+	makeOutDir    = "$(OUTDIR)"
+	makeFlags     = "$(FLAGS)"
+	makeLinkFlags = "$(LINKFLAGS)"
+)
+
+// WriteMakefile writes a GNU Makefile that builds the binaries whose main functions
+// are defined by files, along with the outputs of the generators of st, using the same
+// commands as CompileAll so that the same outputs are built without cppdep. The mode
+// is chosen with MODE=name when running make, and defaults to the first of modes. The
+// outputs of a mode are written to the directory named after it in buildDir, as
+// CompileAll does with the OutputDir of the Compiler. The Flags, LinkFlags and
+// OutputDir of c are not used.
+//
+// Headers found by scanning are prerequisites of each object, and the dependency files
+// written by the compiler cover any that scanning missed. Unity sources are written by
+// WriteMakefile, and a clean target removes the outputs of the mode.
+func (c *Compiler) WriteMakefile(w io.Writer, st *SourceTree, files []*File, buildDir string, modes []MakefileMode) error {
+	if len(modes) == 0 {
+		return fmt.Errorf("no build modes to write")
+	}
+	// a Compiler whose commands refer to the settings of the mode through variables
+	tc := &Compiler{
+		IncludeDirs:        c.IncludeDirs,
+		Flags:              []string{makeFlags},
+		LinkFlags:          []string{makeLinkFlags},
+		BinaryLinks:        c.BinaryLinks,
+		PrecompiledHeaders: c.PrecompiledHeaders,
+		Unity:              c.Unity,
+		LinkDeps:           c.LinkDeps,
+		OutputDir:          makeOutDir,
+	}
+	plan, err := tc.planBuild(files)
+	if err != nil {
+		return err
+	}
+	mw := &makeWriter{w: bufio.NewWriter(w)}
+
+	var modeNames []string
+	for _, mode := range modes {
+		modeNames = append(modeNames, mode.Name)
+	}
+	mw.line("# This file is written by cppdep, do not edit it.")
+	mw.line("# Build with: make [MODE=%s] [all | clean | BINARY_NAME...]", strings.Join(modeNames, "|"))
+	mw.line("")
+	mw.line("CXX := g++")
+	mw.line("MODE ?= %s", modes[0].Name)
+	mw.line("BUILDDIR := %s", makePath(buildDir))
+	for _, mode := range modes {
+		mw.line("FLAGS_%s := %s", mode.Name, makeCommand(mode.Flags))
+		mw.line("LINKFLAGS_%s := %s", mode.Name, makeCommand(mode.LinkFlags))
+	}
+	mw.line("ifeq ($(filter $(MODE),%s),)", strings.Join(modeNames, " "))
+	mw.line("$(error Unknown mode $(MODE), expected one of: %s)", strings.Join(modeNames, " "))
+	mw.line("endif")
+	mw.line("OUTDIR := $(BUILDDIR)/$(MODE)")
+	mw.line("FLAGS := $(FLAGS_$(MODE))")
+	mw.line("LINKFLAGS := $(LINKFLAGS_$(MODE))")
+
+	var binPaths, names []string
+	for _, binInfo := range plan.binaries {
+		binPaths = append(binPaths, tc.BinPath(binInfo.file))
+		names = append(names, filepath.Base(tc.BinPath(binInfo.file)))
+	}
+	mw.line("")
+	mw.line(".PHONY: all clean %s", strings.Join(names, " "))
+	mw.line("all: %s", makePaths(binPaths))
+	for i, name := range names {
+		mw.line("%s: %s", name, makePath(binPaths[i]))
+	}
+
+	for _, action := range st.GeneratorActions() {
+		if len(action.Argv) == 0 {
+			return errNoGeneratorCommand(action)
+		}
+		mw.line("")
+		mw.line("%s: %s", makePath(action.Outputs[0]), makePaths(action.Inputs))
+		mw.recipe("mkdir -p $(@D)")
+		mw.recipe(makeEscape(generatorCommand(action)))
+		if len(action.Outputs) > 1 {
+			// written by the rule of the first output
+			mw.line("%s: %s ;", makePaths(action.Outputs[1:]), makePath(action.Outputs[0]))
+		}
+	}
+
+	for _, pch := range plan.pchs {
+		deps, depPaths := pchInputs(pch)
+		stubPath := tc.pchIncludePath(pch)
+		mw.line("")
+		mw.line("%s:", makePath(stubPath))
+		mw.recipe("mkdir -p $(@D)")
+		mw.recipe("echo " + makeEscape(shellQuote(fmt.Sprintf("#include %q", pch.Header.Path))) + " > $@")
+		mw.line("%s: %s | %s", makePath(tc.pchPath(pch)), makePaths(depPaths), makePath(stubPath))
+		args := append([]string{"$(CXX)", "-o", "$@"}, tc.pchFlags(deps)...)
+		mw.recipe(makeCommand(append(args, "-x", "c++-header", pch.Header.Path)))
+	}
+
+	var depFiles []string
+	for _, source := range plan.sources {
+		deps, depPaths, pchs := tc.objectInputs(source)
+		objectPath := tc.objectPath(source)
+		depFile := tc.depFilePath(objectPath)
+		depFiles = append(depFiles, depFile)
+		var stubs []string
+		for _, pch := range pchs {
+			stubs = append(stubs, tc.pchIncludePath(pch))
+		}
+		mw.line("")
+		if len(stubs) > 0 {
+			mw.line("%s: %s | %s", makePath(objectPath), makePaths(depPaths), makePaths(stubs))
+		} else {
+			mw.line("%s: %s", makePath(objectPath), makePaths(depPaths))
+		}
+		mw.recipe("mkdir -p $(@D)")
+		args := append([]string{"$(CXX)", "-o", "$@", "-MMD", "-MF", depFile}, tc.objectFlags(deps, pchs)...)
+		mw.recipe(makeCommand(append(args, "-c", source.Path)))
+	}
+
+	for _, binInfo := range plan.binaries {
+		var objects []string
+		for _, source := range binInfo.sources {
+			objects = append(objects, tc.objectPath(source))
+		}
+		flags, libs := tc.linkArgs(binInfo.file, binInfo.libs)
+		mw.line("")
+		mw.line("%s: %s", makePath(tc.BinPath(binInfo.file)), makePaths(objects))
+		mw.recipe("mkdir -p $(@D)")
+		args := append([]string{"$(CXX)", "-o", "$@"}, flags...)
+		args = append(append(args, objects...), libs...)
+		mw.recipe(makeCommand(args))
+	}
+
+	mw.line("")
+	mw.line("clean:")
+	cleanPaths := []string{filepath.Join(makeOutDir, "obj"), filepath.Join(makeOutDir, "bin")}
+	if len(plan.pchs) > 0 {
+		cleanPaths = append(cleanPaths, filepath.Join(makeOutDir, "pch"))
+	}
+	mw.recipe(makeCommand(append([]string{"rm", "-rf"}, cleanPaths...)))
+
+	// the dependency files written by the compiler name headers that scanning missed
+	sort.Strings(depFiles)
+	mw.line("")
+	mw.line("-include %s", makePaths(depFiles))
+	return mw.w.Flush()
+}
+
+type makeWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *makeWriter) line(format string, args ...interface{}) {
+	fmt.Fprintf(mw.w, format, args...)
+	mw.w.WriteByte('\n')
+}
+
+func (mw *makeWriter) recipe(command string) {
+	mw.line("\t%s", command)
+}
+
+var makeVariables = []string{makeOutDir, makeFlags, makeLinkFlags, "$(CXX)", "$@", "$(@D)"}
+
+// splitMakeVariables splits s into the make variables of makeVariables that it
+// contains and the text between them.
+func splitMakeVariables(s string) (parts []string, isVar []bool) {
+	for s != "" {
+		index, variable := len(s), ""
+		for _, v := range makeVariables {
+			if i := strings.Index(s, v); i != -1 && i < index {
+				index, variable = i, v
+			}
+		}
+		if index > 0 {
+			parts, isVar = append(parts, s[:index]), append(isVar, false)
+		}
+		if variable == "" {
+			break
+		}
+		parts, isVar = append(parts, variable), append(isVar, true)
+		s = s[index+len(variable):]
+	}
+	return parts, isVar
+}
+
+// makeCommand quotes args for the shell and escapes them for use in a Makefile, leaving
+// the make variables of makeVariables to be expanded by make.
+func makeCommand(args []string) string {
+	var words []string
+	for _, arg := range args {
+		parts, isVar := splitMakeVariables(arg)
+		word := ""
+		for i, part := range parts {
+			if isVar[i] {
+				word += part
+			} else {
+				word += makeEscape(shellQuote(part))
+			}
+		}
+		if word == "" {
+			word = "''"
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
+// makeEscape escapes a shell command for use in a Makefile.
+func makeEscape(s string) string {
+	return strings.Replace(s, "$", "$$", -1)
+}
+
+// makePath escapes a path for use as a target or prerequisite, leaving the make
+// variables of makeVariables to be expanded by make.
+func makePath(path string) string {
+	parts, isVar := splitMakeVariables(path)
+	var escaped string
+	for i, part := range parts {
+		if isVar[i] {
+			escaped += part
+		} else {
+			escaped += strings.NewReplacer("$", "$$", " ", "\\ ", "#", "\\#", ":", "\\:").Replace(part)
+		}
+	}
+	return escaped
+}
+
+func makePaths(paths []string) string {
+	var escaped []string
+	for _, path := range paths {
+		escaped = append(escaped, makePath(path))
+	}
+	return strings.Join(escaped, " ")
+}
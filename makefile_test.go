@@ -0,0 +1,101 @@
+package cppdep
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteMakefile(t *testing.T) {
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make is not installed")
+	}
+	outputDir, err := ioutil.TempDir("", "cppdep_makefile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	cg := &TypeGenerator{
+		InputExt:   ".txtc",
+		OutputExts: []string{".cc"},
+		Command:    []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.cc"},
+	}
+	hg := &TypeGenerator{
+		InputExt:   ".txth",
+		OutputExts: []string{".h"},
+		Command:    []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.h"},
+	}
+	st := &SourceTree{
+		SrcRoot:    "test_files/generator_compile",
+		Generators: []Generator{cg, hg},
+		BuildDir:   outputDir,
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+	mainFile := st.FindSource("main")
+	if mainFile == nil {
+		t.Fatalf("Unable to find main file")
+	}
+
+	c := &Compiler{IncludeDirs: st.IncludeDirs}
+	modes := []MakefileMode{
+		{Name: "debug", Flags: []string{"-g"}},
+		{Name: "release", Flags: []string{"-O2", "-DNAME=$HOME"}, LinkFlags: []string{"-s"}},
+	}
+	var buf bytes.Buffer
+	if err := c.WriteMakefile(&buf, st, []*File{mainFile}, outputDir, modes); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	makefile := buf.String()
+	expected := []string{
+		"MODE ?= debug\n",
+		"FLAGS_release := -O2 '-DNAME=$$HOME'\n",
+		"LINKFLAGS_release := -s\n",
+		"$(OUTDIR)/obj/main.o: " + filepath.Join(st.GenDir(), "a.h") + " " + filepath.Join(st.GenDir(), "main.cc") + "\n",
+		"$(OUTDIR)/bin/main: $(OUTDIR)/obj/a.o $(OUTDIR)/obj/main.o\n",
+		"main: $(OUTDIR)/bin/main\n",
+	}
+	for _, exp := range expected {
+		if !strings.Contains(makefile, exp) {
+			t.Errorf("Expected Makefile to contain %q:\n%s", exp, makefile)
+		}
+	}
+
+	// the generated files are written by make rather than by ProcessDirectory
+	if err := os.RemoveAll(st.GenDir()); err != nil {
+		t.Fatalf("Failed to remove gen dir: %v", err)
+	}
+	makefilePath := filepath.Join(outputDir, "Makefile")
+	if err := ioutil.WriteFile(makefilePath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write Makefile: %v", err)
+	}
+	for _, mode := range modes {
+		cmd := exec.Command("make", "-f", makefilePath, "MODE="+mode.Name)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("make failed for mode %s: %v\n%s", mode.Name, err, output)
+		}
+		binPath := filepath.Join(outputDir, mode.Name, "bin", "main")
+		if output, err := exec.Command(binPath).Output(); err != nil {
+			t.Errorf("Failed to run binary built for mode %s: %v", mode.Name, err)
+		} else if string(output) != "Hello World!\n" {
+			t.Errorf("Unexpected output of binary built for mode %s: %q", mode.Name, output)
+		}
+	}
+
+	cmd := exec.Command("make", "-f", makefilePath, "MODE=release", "clean")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("make clean failed: %v\n%s", err, output)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "release", "bin", "main")); !os.IsNotExist(err) {
+		t.Errorf("Expected clean to remove the binary: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "debug", "bin", "main")); err != nil {
+		t.Errorf("Expected clean to leave the binaries of other modes: %v", err)
+	}
+}
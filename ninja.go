@@ -0,0 +1,234 @@
+package cppdep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// NinjaRegenerate describes how a Ninja build file is written again when the
+// configuration or the structure of the source tree changes.
+type NinjaRegenerate struct {
+	Path    string   // the path of the build file
+	Command []string // the command that writes the build file
+	Dir     string   // the working directory of Command, if empty the directory ninja is run in
+	Inputs  []string // files such as the config file that the build file is written from
+}
+
+// WriteNinja writes a Ninja build file that builds the binaries whose main functions
+// are defined by files, using the same commands as CompileAll, along with the outputs
+// of the generators of st. Headers found by scanning are implicit dependencies of each
+// object, and the dependency files written by the compiler cover any that scanning
+// missed. If regen is set the build file depends on regen.Inputs and the directories
+// of the source tree, and is written again by running regen.Command when they change.
+//
+// Files generated by cppdep itself, such as unity sources and the stubs of precompiled
+// headers, are written by WriteNinja.
+func (c *Compiler) WriteNinja(w io.Writer, st *SourceTree, files []*File, regen *NinjaRegenerate) error {
+	plan, err := c.planBuild(files)
+	if err != nil {
+		return err
+	}
+	nw := &ninjaWriter{w: bufio.NewWriter(w)}
+
+	nw.line("# This file is written by cppdep, do not edit it.")
+	nw.line("ninja_required_version = 1.3")
+	nw.line("")
+	compilePool, linkPool := "", ""
+	if c.CompileConcurrency > 0 {
+		compilePool = "compile_pool"
+		nw.line("pool compile_pool")
+		nw.line("  depth = %d", c.CompileConcurrency)
+	}
+	if c.LinkConcurrency > 0 {
+		linkPool = "link_pool"
+		nw.line("pool link_pool")
+		nw.line("  depth = %d", c.LinkConcurrency)
+	}
+	// the dependency files are read on every run rather than moved into the ninja
+	// log (deps = gcc), as cppdep uses them too
+	nw.line("rule cxx")
+	nw.line("  command = g++ -o $out -MMD -MF $depfile $flags -c $in")
+	nw.line("  depfile = $depfile")
+	nw.line("  description = Compiling: $desc")
+	nw.line("rule pch")
+	nw.line("  command = g++ -o $out $flags -x c++-header $in")
+	nw.line("  description = Compiling: $desc")
+	nw.line("rule link")
+	nw.line("  command = g++ -o $out $flags $in $libs")
+	nw.line("  description = Compiling: $desc")
+	nw.line("rule generate")
+	nw.line("  command = $cmd")
+	nw.line("  description = $desc")
+	if regen != nil {
+		nw.line("rule regenerate")
+		nw.line("  command = $cmd")
+		nw.line("  description = Regenerating: $desc")
+		nw.line("  generator = 1")
+	}
+
+	for _, action := range st.GeneratorActions() {
+		if len(action.Argv) == 0 {
+			return errNoGeneratorCommand(action)
+		}
+		nw.line("")
+		nw.build(action.Outputs, "generate", action.Inputs, nil)
+		nw.variable("cmd", generatorCommand(action))
+		nw.variable("desc", action.Description)
+	}
+
+	for _, pch := range plan.pchs {
+		if err := c.writePCHStub(pch); err != nil {
+			return err
+		}
+		deps, depPaths := pchInputs(pch)
+		nw.line("")
+		nw.build([]string{c.pchPath(pch)}, "pch", []string{pch.Header.Path}, depPaths[:len(depPaths)-1])
+		nw.variable("flags", shellJoin(c.pchFlags(deps)))
+		nw.variable("desc", filepath.Base(c.pchPath(pch)))
+	}
+
+	for _, source := range plan.sources {
+		deps, depPaths, pchs := c.objectInputs(source)
+		objectPath := c.objectPath(source)
+		var implicit []string
+		for _, path := range depPaths {
+			if path != source.Path {
+				implicit = append(implicit, path)
+			}
+		}
+		nw.line("")
+		nw.build([]string{objectPath}, "cxx", []string{source.Path}, implicit)
+		nw.variable("depfile", c.depFilePath(objectPath))
+		nw.variable("flags", shellJoin(c.objectFlags(deps, pchs)))
+		nw.variable("desc", filepath.Base(objectPath))
+		if compilePool != "" {
+			nw.variable("pool", compilePool)
+		}
+	}
+
+	var binPaths []string
+	for _, binInfo := range plan.binaries {
+		binPath := c.BinPath(binInfo.file)
+		binPaths = append(binPaths, binPath)
+		var objects []string
+		for _, source := range binInfo.sources {
+			objects = append(objects, c.objectPath(source))
+		}
+		flags, libs := c.linkArgs(binInfo.file, binInfo.libs)
+		nw.line("")
+		nw.build([]string{binPath}, "link", objects, nil)
+		nw.variable("flags", shellJoin(flags))
+		nw.variable("libs", shellJoin(libs))
+		nw.variable("desc", filepath.Base(binPath))
+		if linkPool != "" {
+			nw.variable("pool", linkPool)
+		}
+		nw.line("build %s: phony %s", ninjaEscape(filepath.Base(binPath)), ninjaEscape(binPath))
+	}
+
+	if regen != nil {
+		inputs := append([]string{}, regen.Inputs...)
+		for _, dir := range st.Dirs() {
+			// the build directory changes with every build
+			if !pathWithin(dir, st.BuildDir) && !pathWithin(dir, c.OutputDir) {
+				inputs = append(inputs, dir)
+			}
+		}
+		nw.line("")
+		nw.build([]string{regen.Path}, "regenerate", inputs, nil)
+		nw.variable("cmd", generatorCommand(&Action{Argv: regen.Command, Dir: regen.Dir}))
+		nw.variable("desc", filepath.Base(regen.Path))
+		// a removed input makes the build file out of date rather than failing the build
+		nw.build(inputs, "phony", nil, nil)
+	}
+
+	nw.line("")
+	nw.line("default %s", ninjaEscapePaths(binPaths))
+	return nw.w.Flush()
+}
+
+type ninjaWriter struct {
+	w *bufio.Writer
+}
+
+func (nw *ninjaWriter) line(format string, args ...interface{}) {
+	fmt.Fprintf(nw.w, format, args...)
+	nw.w.WriteByte('\n')
+}
+
+func (nw *ninjaWriter) build(outputs []string, rule string, inputs, implicit []string) {
+	line := fmt.Sprintf("build %s: %s", ninjaEscapePaths(outputs), rule)
+	if len(inputs) > 0 {
+		line += " " + ninjaEscapePaths(inputs)
+	}
+	if len(implicit) > 0 {
+		line += " | " + ninjaEscapePaths(implicit)
+	}
+	nw.line("%s", line)
+}
+
+// variable writes a variable of the last build statement.
+func (nw *ninjaWriter) variable(name, value string) {
+	value = strings.NewReplacer("$", "$$", "\n", " ").Replace(value)
+	nw.line("  %s = %s", name, value)
+}
+
+var ninjaEscaper = strings.NewReplacer("$", "$$", " ", "$ ", ":", "$:", "\n", "$\n")
+
+// ninjaEscape escapes a path for use in a build statement.
+func ninjaEscape(path string) string {
+	return ninjaEscaper.Replace(path)
+}
+
+func ninjaEscapePaths(paths []string) string {
+	var escaped []string
+	for _, path := range paths {
+		escaped = append(escaped, ninjaEscape(path))
+	}
+	return strings.Join(escaped, " ")
+}
+
+// shellJoin quotes args for the shell and joins them into a command line.
+func shellJoin(args []string) string {
+	var quoted []string
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// generatorCommand returns the shell command that runs the generator action a, in its
+// working directory and with the CPPDEP_ environment variables of ShellGenerators.
+func generatorCommand(a *Action) string {
+	var words []string
+	if a.Dir != "" {
+		words = append(words, "cd", shellQuote(a.Dir), "&&")
+	}
+	for _, kv := range a.Env {
+		if strings.HasPrefix(kv, "CPPDEP_") {
+			words = append(words, shellQuote(kv))
+		}
+	}
+	for _, arg := range a.Argv {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// errNoGeneratorCommand returns the error for a generator that is not an
+// ActionGenerator, whose command can not be written to a build file.
+func errNoGeneratorCommand(action *Action) error {
+	return fmt.Errorf("the generator of %s does not describe its command, so it can only be run by cppdep", strings.Join(action.Outputs, ", "))
+}
+
+// pathWithin returns whether path is dir or is within it.
+func pathWithin(path, dir string) bool {
+	if dir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,88 @@
+package cppdep
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteNinja(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_ninja_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	cg := &TypeGenerator{
+		InputExt:   ".txtc",
+		OutputExts: []string{".cc"},
+		Command:    []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.cc"},
+	}
+	hg := &TypeGenerator{
+		InputExt:   ".txth",
+		OutputExts: []string{".h"},
+		Command:    []string{"cp", "$CPPDEP_INPUT_FILE", "$CPPDEP_OUTPUT_PREFIX.h"},
+	}
+	st := &SourceTree{
+		SrcRoot:    "test_files/generator_compile",
+		Generators: []Generator{cg, hg},
+		BuildDir:   outputDir,
+	}
+	if err := st.ProcessDirectory(); err != nil {
+		t.Fatalf("Failed to process directory: %v", err)
+	}
+	mainFile := st.FindSource("main")
+	if mainFile == nil {
+		t.Fatalf("Unable to find main file")
+	}
+
+	c := &Compiler{
+		OutputDir:       filepath.Join(outputDir, "default"),
+		IncludeDirs:     st.IncludeDirs,
+		Flags:           []string{"-O2", "-DNAME=$HOME"},
+		LinkConcurrency: 2,
+	}
+	regen := &NinjaRegenerate{
+		Path:    filepath.Join(outputDir, "build.ninja"),
+		Command: []string{"cppdep", "ninja"},
+		Inputs:  []string{"cppdep.yml"},
+	}
+	var buf bytes.Buffer
+	if err := c.WriteNinja(&buf, st, []*File{mainFile}, regen); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ninja := buf.String()
+
+	genDir := st.GenDir()
+	objDir := filepath.Join(c.OutputDir, "obj")
+	binPath := c.BinPath(mainFile)
+	expected := []string{
+		"build " + filepath.Join(genDir, "a.h") + ": generate " + filepath.Join(st.SrcRoot, "a.txth") + "\n",
+		"build " + filepath.Join(objDir, "main.o") + ": cxx " + filepath.Join(genDir, "main.cc") + " | " + filepath.Join(genDir, "a.h") + "\n",
+		"  depfile = " + filepath.Join(objDir, "main.d") + "\n",
+		"  flags = -O2 '-DNAME=$$HOME' -I" + genDir + "\n",
+		"build " + binPath + ": link " + filepath.Join(objDir, "a.o") + " " + filepath.Join(objDir, "main.o") + "\n",
+		"pool link_pool\n  depth = 2\n",
+		"  pool = link_pool\n",
+		"build main: phony " + binPath + "\n",
+		"build " + regen.Path + ": regenerate cppdep.yml " + st.SrcRoot + "\n",
+		"default " + binPath + "\n",
+	}
+	for _, exp := range expected {
+		if !strings.Contains(ninja, exp) {
+			t.Errorf("Expected build file to contain %q:\n%s", exp, ninja)
+		}
+	}
+	if strings.Contains(ninja, "compile_pool") {
+		t.Errorf("Expected no compile pool without a compile limit")
+	}
+}
+
+func TestNinjaEscape(t *testing.T) {
+	if got := ninjaEscape("dir with space/a:b$c"); got != "dir$ with$ space/a$:b$$c" {
+		t.Errorf("Unexpected escaped path: %q", got)
+	}
+}
@@ -0,0 +1,144 @@
+package cppdep
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PrecompiledHeader defines a header that will be compiled once per mode and then
+// force included (using -include) when compiling every source file in its scope.
+type PrecompiledHeader struct {
+	Header *File
+
+	// Scope is a list of absolute directory paths. Only source files within one of
+	// these directories will use the precompiled header. If Scope is empty, all source
+	// files will use it.
+	Scope []string
+}
+
+// inScope returns true if file should be compiled using the precompiled header. A unity
+// build source file is only in scope if all of the sources it includes are.
+func (pch *PrecompiledHeader) inScope(file *File) bool {
+	if len(pch.Scope) == 0 {
+		return true
+	}
+	if len(file.unitySources) > 0 {
+		for _, source := range file.unitySources {
+			if !pch.inScope(source) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, dir := range pch.Scope {
+		if strings.HasPrefix(file.Path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pchIncludePath returns the path passed to -include in order to use the precompiled
+// header. The compiler will look for the .gch file next to this path, and if the .gch
+// file is missing or unusable it will fall back to the stub written at this path which
+// includes the original header. The name of the header is followed by a hash of its
+// path, so that headers with the same name in different directories are kept apart.
+// The path is hashed relative to the OutputDir so that the name is the same in every
+// checkout of the source tree.
+func (c *Compiler) pchIncludePath(pch *PrecompiledHeader) string {
+	path := pch.Header.Path
+	if rel, err := filepath.Rel(c.OutputDir, path); err == nil {
+		path = rel
+	}
+	pathHash := sha1.Sum([]byte(path))
+	base := filepath.Base(pch.Header.Path)
+	ext := filepath.Ext(base)
+	name := fmt.Sprintf("%s_%x%s", strings.TrimSuffix(base, ext), pathHash[:4], ext)
+	return filepath.Join(c.OutputDir, "pch", name)
+}
+
+func (c *Compiler) pchPath(pch *PrecompiledHeader) string {
+	return c.pchIncludePath(pch) + ".gch"
+}
+
+// filePCHs returns the precompiled headers that should be used when compiling file.
+func (c *Compiler) filePCHs(file *File) []*PrecompiledHeader {
+	var pchs []*PrecompiledHeader
+	for i := range c.PrecompiledHeaders {
+		pch := &c.PrecompiledHeaders[i]
+		if pch.Header != file && pch.inScope(file) {
+			pchs = append(pchs, pch)
+		}
+	}
+	return pchs
+}
+
+// pchInputs returns the header of pch and the files it includes, and their paths.
+func pchInputs(pch *PrecompiledHeader) (deps []*File, depPaths []string) {
+	deps = append(pch.Header.DepList(), pch.Header)
+	for _, dep := range deps {
+		depPaths = append(depPaths, dep.Path)
+	}
+	return deps, depPaths
+}
+
+// pchFlags returns the flags for precompiling a header with the dependencies deps.
+func (c *Compiler) pchFlags(deps []*File) []string {
+	var args []string
+	args = append(args, c.Flags...)
+	args = append(args, depCFlags(deps)...)
+	return append(args, c.includeDirective()...)
+}
+
+// writePCHStub writes the file that is included in place of pch when it is used, see
+// pchIncludePath.
+func (c *Compiler) writePCHStub(pch *PrecompiledHeader) error {
+	stubPath := c.pchIncludePath(pch)
+	if err := os.MkdirAll(filepath.Dir(stubPath), 0755); err != nil {
+		return err
+	}
+	stub := fmt.Sprintf("#include %q\n", pch.Header.Path)
+	if contents, err := ioutil.ReadFile(stubPath); err != nil || string(contents) != stub {
+		return ioutil.WriteFile(stubPath, []byte(stub), 0644)
+	}
+	return nil
+}
+
+func (c *Compiler) makePCH(ctx context.Context, pch *PrecompiledHeader) (path string, err error) {
+	gchPath := c.pchPath(pch)
+	if err := c.writePCHStub(pch); err != nil {
+		return "", err
+	}
+
+	deps, depPaths := pchInputs(pch)
+	needsCompile, err := c.needsRebuild(depPaths, []string{gchPath})
+	if err != nil {
+		return "", err
+	} else if !needsCompile {
+		return gchPath, nil
+	}
+
+	args := append([]string{"g++", "-o", gchPath}, c.pchFlags(deps)...)
+	args = append(args, "-x", "c++-header", pch.Header.Path)
+	action := &Action{
+		Kind:        CompileAction,
+		Description: fmt.Sprintf("Compiling: %s", filepath.Base(gchPath)),
+		Argv:        args,
+		Inputs:      depPaths,
+		Outputs:     []string{gchPath},
+	}
+	if makePCHHook != nil {
+		makePCHHook(pch.Header)
+	}
+	endTrace := c.Trace.BeginAction(CompileAction, pch.Header.Path)
+	output, err := c.run(ctx, action)
+	endTrace(action.CPUTime)
+	c.collectDiagnostics(pch.Header.Path, output)
+	c.showOutput(action, output, err)
+	return gchPath, err
+}
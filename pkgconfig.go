@@ -0,0 +1,80 @@
+package cppdep
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// runPkgConfig runs pkg-config for the given package and returns its output. It is
+// a variable so that it can be replaced in testing.
+var runPkgConfig = func(pkg string) ([]byte, error) {
+	cmd := exec.Command("pkg-config", "--cflags", "--libs", pkg)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("pkg-config failed for package %q: %v (%s)", pkg, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+type pkgConfigResult struct {
+	once   sync.Once
+	cflags []string
+	libs   []string
+	err    error
+}
+
+// pkgConfigCache ensures that pkg-config is only run once per package.
+type pkgConfigCache struct {
+	mu      sync.Mutex
+	results map[string]*pkgConfigResult
+}
+
+// lookup returns the compile and link flags needed to use pkg.
+func (pc *pkgConfigCache) lookup(pkg string) (cflags, libs []string, err error) {
+	pc.mu.Lock()
+	if pc.results == nil {
+		pc.results = make(map[string]*pkgConfigResult)
+	}
+	res, ok := pc.results[pkg]
+	if !ok {
+		res = &pkgConfigResult{}
+		pc.results[pkg] = res
+	}
+	pc.mu.Unlock()
+
+	res.once.Do(func() {
+		var out []byte
+		out, res.err = runPkgConfig(pkg)
+		if res.err == nil {
+			res.cflags, res.libs = splitPkgConfigFlags(strings.Fields(string(out)))
+		}
+	})
+	return res.cflags, res.libs, res.err
+}
+
+// splitPkgConfigFlags splits the combined output of pkg-config --cflags --libs into
+// the flags needed when compiling and those needed when linking.
+func splitPkgConfigFlags(flags []string) (cflags, libs []string) {
+	for i := 0; i < len(flags); i++ {
+		flag := flags[i]
+		switch {
+		case flag == "-pthread":
+			cflags = append(cflags, flag)
+			libs = append(libs, flag)
+		case flag == "-framework" && i+1 < len(flags):
+			// joined so that it is kept together when link arguments are deduplicated
+			libs = append(libs, "-Wl,-framework,"+flags[i+1])
+			i++
+		case strings.HasPrefix(flag, "-l"), strings.HasPrefix(flag, "-L"), strings.HasPrefix(flag, "-Wl,"):
+			libs = append(libs, flag)
+		default:
+			cflags = append(cflags, flag)
+		}
+	}
+	return cflags, libs
+}
@@ -0,0 +1,176 @@
+package cppdep
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress displays the progress of CompileAll as a status line such as
+// "[123/980] Compiling: foo.o (40 up to date, 1m20s left)". The count is of finished
+// jobs (precompiled headers, objects and binaries) out of all the jobs of the build,
+// and the time left is estimated from the durations of past builds.
+type Progress struct {
+	W io.Writer
+
+	// Smart when set redraws the status line in place, which requires W to be a
+	// terminal. Otherwise a status line is written for each action, which suits logs.
+	Smart bool
+
+	// Width truncates the status line in smart mode so that it does not wrap, 0 means
+	// no limit.
+	Width int
+
+	mu          sync.Mutex
+	total       int
+	finished    int
+	upToDate    int
+	remaining   time.Duration
+	concurrency int
+	line        string
+}
+
+func NewProgress(w io.Writer, smart bool) *Progress {
+	return &Progress{W: w, Smart: smart}
+}
+
+// start begins a build of total jobs, estimated to take work in total, run on
+// concurrency goroutines.
+func (p *Progress) start(total int, work time.Duration, concurrency int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total, p.finished, p.upToDate = total, 0, 0
+	p.remaining = work
+	p.concurrency = concurrency
+	if p.concurrency < 1 {
+		p.concurrency = 1
+	}
+	p.line = ""
+}
+
+// status shows that an action with the given description has started.
+func (p *Progress) status(description string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.showLine(description)
+}
+
+// finish records that a job estimated to take estimate has finished, which is
+// upToDate if it did not need to run any action.
+func (p *Progress) finish(estimate time.Duration, upToDate bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finished++
+	if upToDate {
+		p.upToDate++
+	}
+	p.remaining -= estimate
+	if p.remaining < 0 {
+		p.remaining = 0
+	}
+	if p.Smart && p.line != "" {
+		p.draw(p.formatLine(p.line))
+	}
+}
+
+// done ends the status line, leaving a summary of the build unless it failed.
+func (p *Progress) done(failed bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if failed {
+		if p.Smart && p.line != "" {
+			fmt.Fprintln(p.W)
+		}
+		p.line = ""
+		return
+	}
+	if p.finished == p.upToDate {
+		p.clear()
+		fmt.Fprintf(p.W, "[%d/%d] everything up to date\n", p.finished, p.total)
+		return
+	}
+	summary := fmt.Sprintf("[%d/%d] done", p.finished, p.total)
+	if p.upToDate > 0 {
+		summary += fmt.Sprintf(" (%d up to date)", p.upToDate)
+	}
+	if p.Smart {
+		p.draw(summary)
+	} else {
+		fmt.Fprint(p.W, summary)
+	}
+	fmt.Fprintln(p.W)
+	p.line = ""
+}
+
+// print runs fn, which writes other output to the terminal, with the status line
+// cleared so that the output does not get mixed up with it. The status line is drawn
+// again afterwards.
+func (p *Progress) print(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	fn()
+	if p.Smart && p.line != "" {
+		p.draw(p.formatLine(p.line))
+	}
+}
+
+func (p *Progress) showLine(description string) {
+	p.line = description
+	line := p.formatLine(description)
+	if p.Smart {
+		p.draw(line)
+	} else {
+		fmt.Fprintln(p.W, line)
+	}
+}
+
+func (p *Progress) formatLine(description string) string {
+	// there is nothing to count for the actions, such as generators, that run before a
+	// build starts
+	if p.total == 0 {
+		return description
+	}
+	var extra []string
+	if p.upToDate > 0 {
+		extra = append(extra, fmt.Sprintf("%d up to date", p.upToDate))
+	}
+	if left := p.remaining / time.Duration(p.concurrency); left >= time.Second {
+		extra = append(extra, fmt.Sprintf("%s left", left.Round(time.Second)))
+	}
+	line := fmt.Sprintf("[%d/%d] %s", p.finished, p.total, description)
+	if len(extra) > 0 {
+		line += " (" + strings.Join(extra, ", ") + ")"
+	}
+	return line
+}
+
+// draw replaces the status line with line.
+func (p *Progress) draw(line string) {
+	if p.Width > 0 && len(line) > p.Width-1 {
+		line = line[:p.Width-1]
+	}
+	fmt.Fprintf(p.W, "\r%s\x1b[K", line)
+}
+
+// clear removes the status line in smart mode, leaving the cursor at the start of
+// the line.
+func (p *Progress) clear() {
+	if p.Smart {
+		fmt.Fprint(p.W, "\r\x1b[K")
+	}
+}
@@ -0,0 +1,102 @@
+package cppdep
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressPlain(t *testing.T) {
+	buf := &bytes.Buffer{}
+	p := NewProgress(buf, false)
+	p.start(3, 10*time.Second, 2)
+	p.finish(0, true)
+	p.status("Compiling: a.o")
+	p.finish(4*time.Second, false)
+	p.status("Compiling: main")
+	p.finish(time.Second, false)
+	p.done(false)
+
+	expected := "[1/3] Compiling: a.o (1 up to date, 5s left)\n" +
+		"[2/3] Compiling: main (1 up to date, 3s left)\n" +
+		"[3/3] done (1 up to date)\n"
+	if buf.String() != expected {
+		t.Errorf("progress output not as expected:\n%q\n%q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	p.start(2, 0, 1)
+	p.finish(0, true)
+	p.finish(0, true)
+	p.done(false)
+	if buf.String() != "[2/2] everything up to date\n" {
+		t.Errorf("Expected up to date message: %q", buf.String())
+	}
+}
+
+func TestProgressSmart(t *testing.T) {
+	buf := &bytes.Buffer{}
+	p := NewProgress(buf, true)
+	p.Width = 20
+	p.start(2, 0, 1)
+	p.status("Compiling: a_very_long_name.o")
+	p.print(func() { buf.WriteString("warning: x\n") })
+	p.finish(0, false)
+
+	expected := "\r[0/2] Compiling: a_\x1b[K" +
+		"\r\x1b[Kwarning: x\n" +
+		"\r[0/2] Compiling: a_\x1b[K" +
+		"\r[1/2] Compiling: a_\x1b[K"
+	if buf.String() != expected {
+		t.Errorf("progress output not as expected:\n%q\n%q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	p.done(true)
+	if buf.String() != "\n" {
+		t.Errorf("Expected failed build to leave the last status line: %q", buf.String())
+	}
+}
+
+func TestCompileAllProgress(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	st.ProcessDirectory()
+	files := []*File{st.FindSource("main"), st.FindSource("mainb")}
+
+	p := NewProgress(ioutil.Discard, false)
+	c := &Compiler{OutputDir: outputDir, Progress: p}
+	if _, err := c.CompileAll(files); err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	switch {
+	case p.total != 5:
+		t.Errorf("Expected 3 objects and 2 binaries in total: %d", p.total)
+	case p.finished != 5 || p.upToDate != 0:
+		t.Errorf("Expected all jobs to have been run: %d finished, %d up to date", p.finished, p.upToDate)
+	}
+
+	if _, err := c.CompileAll(files[:1]); err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	if p.total != 3 || p.finished != 3 || p.upToDate != 3 {
+		t.Errorf("Expected all jobs to be up to date: %d total, %d finished, %d up to date", p.total, p.finished, p.upToDate)
+	}
+
+	buf := &bytes.Buffer{}
+	p.W = buf
+	p.done(false)
+	if !strings.Contains(buf.String(), "everything up to date") {
+		t.Errorf("Expected up to date summary: %q", buf.String())
+	}
+}
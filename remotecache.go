@@ -0,0 +1,337 @@
+package cppdep
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteCache is a Cache backed by an HTTP server that speaks the simple GET/PUT
+// protocol used by bazel-remote. The contents of an output are stored under
+// /cas/<sha256 of contents>, and the key of the output is mapped to an ActionResult
+// protobuf naming the output and its digest under /ac/<key>, as bazel-remote expects.
+// If the server cannot be reached or fails a request, the RemoteCache disables itself
+// for the rest of the build, and every following Get will miss.
+type RemoteCache struct {
+	URL string
+
+	// ReadOnly when set will only fetch outputs from the server and never upload them.
+	ReadOnly bool
+
+	// Timeout is the timeout for each request to the server. Default is 10 seconds.
+	Timeout time.Duration
+
+	clientOnce sync.Once
+	client     *http.Client
+
+	mu       sync.Mutex
+	disabled bool
+}
+
+func (rc *RemoteCache) httpClient() *http.Client {
+	rc.clientOnce.Do(func() {
+		timeout := rc.Timeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		rc.client = &http.Client{Timeout: timeout}
+	})
+	return rc.client
+}
+
+func (rc *RemoteCache) isDisabled() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.disabled
+}
+
+// unavailable disables the cache and returns the error to be reported. Only the first
+// error is reported, so that an unreachable server is not reported for every output.
+func (rc *RemoteCache) unavailable(err error) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.disabled {
+		return nil
+	}
+	rc.disabled = true
+	return fmt.Errorf("remote cache %s unavailable, continuing without it: %v", rc.URL, err)
+}
+
+func (rc *RemoteCache) url(kind, hash string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(rc.URL, "/"), kind, hash)
+}
+
+// get fetches the given url, returning a nil body if it is not found.
+func (rc *RemoteCache) get(url string) ([]byte, error) {
+	resp, err := rc.httpClient().Get(url)
+	if err != nil {
+		return nil, rc.unavailable(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, rc.unavailable(err)
+		}
+		return body, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, rc.unavailable(fmt.Errorf("GET %s returned %s", url, resp.Status))
+	}
+}
+
+func (rc *RemoteCache) put(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := rc.httpClient().Do(req)
+	if err != nil {
+		return rc.unavailable(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return rc.unavailable(fmt.Errorf("PUT %s returned %s", url, resp.Status))
+	}
+	return nil
+}
+
+func (rc *RemoteCache) Get(key, path string) (bool, error) {
+	if rc.isDisabled() {
+		return false, nil
+	}
+	result, err := rc.get(rc.url("ac", key))
+	if err != nil || result == nil {
+		return false, err
+	}
+	hash, _, err := decodeActionResult(result)
+	if err != nil {
+		return false, fmt.Errorf("remote cache returned invalid action result for %s: %v", key, err)
+	}
+	contents, err := rc.get(rc.url("cas", hash))
+	if err != nil || contents == nil {
+		return false, err
+	}
+	if sum := sha256.Sum256(contents); hex.EncodeToString(sum[:]) != hash {
+		return false, fmt.Errorf("remote cache returned corrupt contents for %s", hash)
+	}
+
+	if err := writeFileAtomic(path, contents); err != nil {
+		return false, err
+	}
+	return true, os.Chmod(path, 0644)
+}
+
+func (rc *RemoteCache) Put(key, path string) error {
+	if rc.ReadOnly || rc.isDisabled() {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(contents)
+	hash := hex.EncodeToString(sum[:])
+	if err := rc.put(rc.url("cas", hash), contents); err != nil {
+		return err
+	}
+	return rc.put(rc.url("ac", key), encodeActionResult(filepath.Base(path), hash, int64(len(contents))))
+}
+
+// encodeActionResult returns a build.bazel.remote.execution.v2.ActionResult protobuf
+// with a single output file at path, whose contents have the sha256 hash and size.
+func encodeActionResult(path, hash string, size int64) []byte {
+	var digest []byte
+	digest = appendProtoBytes(digest, 1, []byte(hash))
+	digest = appendProtoVarint(digest, 2, uint64(size))
+	var outputFile []byte
+	outputFile = appendProtoBytes(outputFile, 1, []byte(path))
+	outputFile = appendProtoBytes(outputFile, 2, digest)
+	// output_files is field 2 of ActionResult
+	return appendProtoBytes(nil, 2, outputFile)
+}
+
+// decodeActionResult returns the hash and size of the first output file of an
+// ActionResult protobuf.
+func decodeActionResult(result []byte) (hash string, size int64, err error) {
+	outputFile, _, err := protoField(result, 2)
+	if err != nil {
+		return "", 0, err
+	}
+	digest, _, err := protoField(outputFile, 2)
+	if err != nil {
+		return "", 0, err
+	}
+	hashBytes, _, err := protoField(digest, 1)
+	if err != nil {
+		return "", 0, err
+	}
+	// size_bytes is left out when it is zero
+	_, sizeBytes, _ := protoField(digest, 2)
+	return string(hashBytes), int64(sizeBytes), nil
+}
+
+func appendUvarint(b []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], value)]...)
+}
+
+func appendProtoVarint(b []byte, field int, value uint64) []byte {
+	return appendUvarint(appendUvarint(b, uint64(field)<<3), value)
+}
+
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	b = appendUvarint(appendUvarint(b, uint64(field)<<3|2), uint64(len(value)))
+	return append(b, value...)
+}
+
+// protoField returns the first field numbered field in the protobuf message b: its
+// contents if it is length delimited, or its value if it is a varint.
+func protoField(b []byte, field int) (contents []byte, value uint64, err error) {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, 0, fmt.Errorf("invalid field tag")
+		}
+		b = b[n:]
+		num, wireType := int(tag>>3), tag&7
+		var length int
+		switch wireType {
+		case 0, 2:
+			value, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, 0, fmt.Errorf("invalid varint")
+			}
+			b = b[n:]
+			if wireType == 2 {
+				length = int(value)
+			}
+		case 1:
+			length = 8
+		case 5:
+			length = 4
+		default:
+			return nil, 0, fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		if length < 0 || length > len(b) {
+			return nil, 0, fmt.Errorf("truncated field")
+		}
+		if num == field && (wireType == 0 || wireType == 2) {
+			return b[:length], value, nil
+		}
+		b = b[length:]
+	}
+	return nil, 0, fmt.Errorf("missing field %d", field)
+}
+
+// MultiCache combines multiple caches, for example a LocalCache in front of a
+// RemoteCache. Get tries each cache in order, and when an output is found it is stored
+// in all the caches before the one it was found in. Put stores the output in all caches.
+type MultiCache []Cache
+
+func (mc MultiCache) Get(key, path string) (bool, error) {
+	var firstErr error
+	for i, cache := range mc {
+		found, err := cache.Get(key, path)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if !found {
+			continue
+		}
+		for _, earlier := range mc[:i] {
+			if err := earlier.Put(key, path); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return true, firstErr
+	}
+	return false, firstErr
+}
+
+func (mc MultiCache) Put(key, path string) error {
+	var firstErr error
+	for _, cache := range mc {
+		if err := cache.Put(key, path); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// CacheServer is a minimal in memory implementation of the server side of the protocol
+// used by RemoteCache. Like bazel-remote it only accepts action results whose output
+// is already stored. It is intended for testing.
+type CacheServer struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (cs *CacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || (parts[0] != "ac" && parts[0] != "cas") || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		cs.mu.Lock()
+		body, ok := cs.entries[r.URL.Path]
+		cs.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if sum := sha256.Sum256(body); parts[0] == "cas" && hex.EncodeToString(sum[:]) != parts[1] {
+			http.Error(w, "hash does not match contents", http.StatusBadRequest)
+			return
+		}
+		if parts[0] == "ac" {
+			// as bazel-remote does, unless run with --disable_http_ac_validation
+			hash, size, err := decodeActionResult(body)
+			cs.mu.Lock()
+			contents, ok := cs.entries["/cas/"+hash]
+			cs.mu.Unlock()
+			if err != nil || !ok || int64(len(contents)) != size {
+				http.Error(w, "invalid action result", http.StatusBadRequest)
+				return
+			}
+		}
+		cs.mu.Lock()
+		if cs.entries == nil {
+			cs.entries = make(map[string][]byte)
+		}
+		cs.entries[r.URL.Path] = body
+		cs.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Len returns the number of entries stored in the server.
+func (cs *CacheServer) Len() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.entries)
+}
@@ -0,0 +1,147 @@
+package cppdep
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoteCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cppdep_cache_test")
+	if err != nil {
+		t.Fatalf("Failed to setup cache dir")
+	}
+	defer os.RemoveAll(dir)
+
+	server := &CacheServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	src := filepath.Join(dir, "src.o")
+	if err := ioutil.WriteFile(src, []byte("object contents"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	dst := filepath.Join(dir, "dst.o")
+
+	readOnly := &RemoteCache{URL: ts.URL, ReadOnly: true}
+	if err := readOnly.Put("abcd", src); err != nil {
+		t.Errorf("Put returned error: %v", err)
+	} else if server.Len() != 0 {
+		t.Errorf("Expected read only cache to not store anything")
+	}
+
+	rc := &RemoteCache{URL: ts.URL}
+	if ok, err := rc.Get("abcd", dst); err != nil || ok {
+		t.Errorf("Expected cache miss: %v %v", ok, err)
+	}
+	if err := rc.Put("abcd", src); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if server.Len() != 2 {
+		t.Errorf("Expected an ac and cas entry to be stored, got %d entries", server.Len())
+	}
+	if ok, err := readOnly.Get("abcd", dst); err != nil || !ok {
+		t.Fatalf("Expected cache hit: %v %v", ok, err)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "object contents" {
+		t.Errorf("restored file not as expected: %q %v", b, err)
+	}
+}
+
+func TestRemoteCacheUnavailable(t *testing.T) {
+	ts := httptest.NewServer(&CacheServer{})
+	url := ts.URL
+	ts.Close()
+
+	rc := &RemoteCache{URL: url, Timeout: time.Second}
+	if ok, err := rc.Get("abcd", "/nonexistent/dst.o"); err == nil || ok {
+		t.Errorf("Expected first request to report the server as unavailable: %v %v", ok, err)
+	}
+	if ok, err := rc.Get("abcd", "/nonexistent/dst.o"); err != nil || ok {
+		t.Errorf("Expected following requests to be skipped: %v %v", ok, err)
+	}
+	if err := rc.Put("abcd", "/nonexistent/src.o"); err != nil {
+		t.Errorf("Expected following requests to be skipped: %v", err)
+	}
+}
+
+func TestRemoteCacheServerError(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "invalid action result", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "cppdep_cache_test")
+	if err != nil {
+		t.Fatalf("Failed to setup cache dir")
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src.o")
+	if err := ioutil.WriteFile(src, []byte("object contents"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	rc := &RemoteCache{URL: ts.URL}
+	if err := rc.Put("abcd", src); err == nil {
+		t.Errorf("Expected the first failed request to be reported")
+	}
+	if err := rc.Put("abcd", src); err != nil {
+		t.Errorf("Expected following requests to be skipped: %v", err)
+	}
+	if ok, err := rc.Get("abcd", filepath.Join(dir, "dst.o")); err != nil || ok {
+		t.Errorf("Expected following requests to be skipped: %v %v", ok, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected a single request to the failing server, got %d", n)
+	}
+}
+
+func TestActionResult(t *testing.T) {
+	hash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	for _, size := range []int64{0, 5, 1 << 40} {
+		gotHash, gotSize, err := decodeActionResult(encodeActionResult("a.o", hash, size))
+		if err != nil || gotHash != hash || gotSize != size {
+			t.Errorf("Unexpected decoded action result: %q %d %v", gotHash, gotSize, err)
+		}
+	}
+	if _, _, err := decodeActionResult([]byte(hash)); err == nil {
+		t.Errorf("Expected an error decoding a bare hash")
+	}
+}
+
+func TestMultiCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cppdep_cache_test")
+	if err != nil {
+		t.Fatalf("Failed to setup cache dir")
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(&CacheServer{})
+	defer ts.Close()
+
+	src := filepath.Join(dir, "src.o")
+	if err := ioutil.WriteFile(src, []byte("object contents"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	remote := &RemoteCache{URL: ts.URL}
+	if err := remote.Put("abcd", src); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	local := &LocalCache{Dir: filepath.Join(dir, "cache")}
+	mc := MultiCache{local, remote}
+	if ok, err := mc.Get("abcd", filepath.Join(dir, "dst.o")); err != nil || !ok {
+		t.Fatalf("Expected cache hit: %v %v", ok, err)
+	}
+	if ok, err := local.Get("abcd", filepath.Join(dir, "dst2.o")); err != nil || !ok {
+		t.Errorf("Expected output found in remote cache to be stored in local cache: %v %v", ok, err)
+	}
+}
@@ -0,0 +1,174 @@
+package cppdep
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var missingIncludeRegex = regexp.MustCompile(`(?m)^(.*?):(\d+):\d+: fatal error: (.*?): No such file or directory$`)
+
+// MissingDependencyError is returned when a sandboxed compile fails because a file
+// included by the source was not found in its dependency graph.
+type MissingDependencyError struct {
+	Source  string // the source file being compiled
+	File    string // the file containing the include statement
+	Line    int    // the line of the include statement
+	Include string // the include that could not be found
+}
+
+func (e *MissingDependencyError) Error() string {
+	return fmt.Sprintf("sandboxed compile of %s failed: %s:%d includes %q which is missing from the dependency graph",
+		e.Source, e.File, e.Line, e.Include)
+}
+
+// sandbox is a temporary directory containing only the files that the dependency graph
+// says are needed to compile a source file. The files are symlinked into the sandbox at
+// their absolute path below the sandbox directory.
+type sandbox struct {
+	dir string
+
+	// includeDirs and deps are the original paths of what the sandbox contains.
+	includeDirs []string
+	deps        []string
+}
+
+func newSandbox(outputDir string, deps []*File, includeDirs []string) (*sandbox, error) {
+	sandboxRoot := filepath.Join(outputDir, "sandbox")
+	if err := os.MkdirAll(sandboxRoot, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(sandboxRoot, "")
+	if err != nil {
+		return nil, err
+	}
+	sb := &sandbox{dir: dir}
+
+	for _, inc := range includeDirs {
+		sb.includeDirs = append(sb.includeDirs, filepath.Clean(inc))
+		if err := os.MkdirAll(sb.path(inc), 0755); err != nil {
+			sb.remove()
+			return nil, err
+		}
+	}
+	for _, dep := range deps {
+		if dep.Path == "" {
+			continue
+		}
+		sb.deps = append(sb.deps, filepath.Clean(dep.Path))
+		path := sb.path(dep.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			sb.remove()
+			return nil, err
+		}
+		if err := os.Symlink(dep.Path, path); err != nil && !os.IsExist(err) {
+			sb.remove()
+			return nil, err
+		}
+	}
+	return sb, nil
+}
+
+// path returns the location of path within the sandbox.
+func (sb *sandbox) path(path string) string {
+	return filepath.Join(sb.dir, path)
+}
+
+// original maps a path within the sandbox back to its original location.
+func (sb *sandbox) original(path string) string {
+	if strings.HasPrefix(path, sb.dir+string(filepath.Separator)) {
+		return path[len(sb.dir):]
+	}
+	return path
+}
+
+// includeFlags are the compiler flags that add a directory to the include path.
+var includeFlags = []string{"-I", "-isystem", "-iquote"}
+
+// rewriteArgs changes the source file and include directories of compiler arguments to
+// refer to their location within the sandbox. Include directories outside of the
+// sandbox, such as those of system or third party libraries, are left as they are.
+func (sb *sandbox) rewriteArgs(args []string, sourcePath string) []string {
+	var rewritten []string
+	for i, arg := range args {
+		if arg == sourcePath {
+			arg = sb.path(arg)
+		}
+		for _, flag := range includeFlags {
+			if i > 0 && args[i-1] == flag && sb.contains(arg) {
+				arg = sb.path(arg)
+			} else if len(arg) > len(flag) && strings.HasPrefix(arg, flag) && sb.contains(arg[len(flag):]) {
+				arg = flag + sb.path(arg[len(flag):])
+			}
+		}
+		rewritten = append(rewritten, arg)
+	}
+	return rewritten
+}
+
+// contains returns true if dir is an absolute path that is recreated in the sandbox:
+// either within one of its include directories or a directory containing one of its
+// dependencies.
+func (sb *sandbox) contains(dir string) bool {
+	if !filepath.IsAbs(dir) {
+		return false
+	}
+	dir = filepath.Clean(dir)
+	for _, inc := range sb.includeDirs {
+		if pathWithin(dir, inc) {
+			return true
+		}
+	}
+	for _, dep := range sb.deps {
+		if pathWithin(dep, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteDepFile changes the paths in a dependency file written by a sandboxed compile
+// back to their original paths.
+func (sb *sandbox) rewriteDepFile(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, sb.rewriteOutput(contents))
+}
+
+// rewriteOutput changes all paths within the sandbox in output back to their original
+// paths.
+func (sb *sandbox) rewriteOutput(output []byte) []byte {
+	prefix := []byte(sb.dir + string(filepath.Separator))
+	return bytes.Replace(output, prefix, []byte(string(filepath.Separator)), -1)
+}
+
+func (sb *sandbox) remove() error {
+	return os.RemoveAll(sb.dir)
+}
+
+// missingDependency looks through the compiler output of a sandboxed compile for an
+// include that could not be found.
+func (sb *sandbox) missingDependency(source string, compilerOutput []byte) *MissingDependencyError {
+	matches := missingIncludeRegex.FindSubmatch(compilerOutput)
+	if matches == nil {
+		return nil
+	}
+	line, _ := strconv.Atoi(string(matches[2]))
+	file := string(matches[1])
+	if filepath.IsAbs(file) {
+		file = sb.original(file)
+	}
+	return &MissingDependencyError{
+		Source:  source,
+		File:    file,
+		Line:    line,
+		Include: string(matches[3]),
+	}
+}
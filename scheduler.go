@@ -0,0 +1,377 @@
+package cppdep
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/mem"
+)
+
+// defaultCompileRate is the estimated compile time per byte of source, used when no
+// past compile durations are known.
+const defaultCompileRate = 20 * time.Microsecond
+
+// defaultLinkEstimate is the estimated link time used when no past link durations
+// are known.
+const defaultLinkEstimate = 500 * time.Millisecond
+
+// job is a unit of work in a build, such as compiling an object or linking a binary.
+type job struct {
+	name     string
+	run      func() error
+	estimate time.Duration
+
+	// priority is the estimate of the job plus the highest priority of the jobs
+	// that depend on it, i.e. the length of the longest path from the start of this
+	// job to the end of the build.
+	priority   time.Duration
+	dependents []*job
+	waiting    int // the number of dependencies that have not yet finished
+	pool       *jobPool
+	seq        int
+	index      int
+}
+
+// dependsOn records that j cannot start until all of deps have finished.
+func (j *job) dependsOn(deps ...*job) {
+	for _, dep := range deps {
+		dep.dependents = append(dep.dependents, j)
+		j.waiting++
+	}
+}
+
+func (j *job) computePriority() time.Duration {
+	if j.priority > 0 {
+		return j.priority
+	}
+	var longest time.Duration
+	for _, dep := range j.dependents {
+		if p := dep.computePriority(); p > longest {
+			longest = p
+		}
+	}
+	// never zero, so that it marks the priority as computed
+	j.priority = j.estimate + longest + 1
+	return j.priority
+}
+
+// jobQueue is a heap of jobs that are ready to run, ordered so that the job with the
+// highest priority is first and jobs with equal priority are in the order they
+// were added to the build.
+type jobQueue []*job
+
+func (q jobQueue) Len() int { return len(q) }
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q jobQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *jobQueue) Push(x interface{}) {
+	j := x.(*job)
+	j.index = len(*q)
+	*q = append(*q, j)
+}
+func (q *jobQueue) Pop() interface{} {
+	old := *q
+	j := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return j
+}
+
+// jobPool limits how many jobs of one kind, such as links, run at the same time.
+type jobPool struct {
+	// limit is the maximum number of jobs of the pool that run at the same time, 0
+	// means only the total concurrency of the build applies.
+	limit int
+
+	// memory is the amount of memory in bytes each job of the pool is expected to
+	// need. When set, a job is only started if that much memory is available on top
+	// of what is reserved for the running jobs of all pools, unless no other job of
+	// the pool is running. 0 disables memory throttling.
+	memory uint64
+
+	running int
+	ready   jobQueue
+}
+
+// availableMemory returns the memory available for starting new processes without
+// swapping.
+var availableMemory = func() (uint64, error) {
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, err
+	}
+	return vm.Available, nil
+}
+
+// runJobs runs jobs with at most concurrency of them running at the same time, and
+// no more than the limit of each job's pool. A job is started once all of the jobs it
+// depends on have finished, and of the jobs that are ready the one on the longest
+// remaining path through the build is started first, so that long jobs and the jobs
+// that gate them do not end up running last. After the first error, or once ctx is
+// done, no more jobs are started and the error is returned once running jobs have
+// finished. Jobs without a pool are only limited by concurrency.
+func runJobs(ctx context.Context, jobs []*job, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	defaultPool := &jobPool{}
+	var pools []*jobPool
+	seenPools := make(map[*jobPool]bool)
+	for i, j := range jobs {
+		j.seq = i
+		j.computePriority()
+		if j.pool == nil {
+			j.pool = defaultPool
+		}
+		if !seenPools[j.pool] {
+			seenPools[j.pool] = true
+			pools = append(pools, j.pool)
+		}
+	}
+	for _, j := range jobs {
+		if j.waiting == 0 {
+			heap.Push(&j.pool.ready, j)
+		}
+	}
+
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	remaining := len(jobs)
+	running := 0
+	var firstErr error
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			cond.Broadcast()
+			mu.Unlock()
+		case <-finished:
+		}
+	}()
+
+	// admit returns whether a job of pool p can be started now, and must be called
+	// with mu held.
+	admit := func(p *jobPool) bool {
+		if p.limit > 0 && p.running >= p.limit {
+			return false
+		}
+		if p.memory == 0 || p.running == 0 {
+			return true
+		}
+		avail, err := availableMemory()
+		if err != nil {
+			return true
+		}
+		// running jobs may not have allocated their memory yet, so it stays reserved
+		// in full until they finish
+		var reserved uint64
+		for _, pool := range pools {
+			reserved += uint64(pool.running) * pool.memory
+		}
+		return avail >= reserved+p.memory
+	}
+
+	var wg sync.WaitGroup
+	var start func(j *job)
+	// dispatch starts ready jobs, highest priority first, while there is capacity.
+	// It must be called with mu held.
+	dispatch := func() {
+		for running < concurrency && firstErr == nil {
+			var next *job
+			for _, p := range pools {
+				if p.ready.Len() == 0 || (next != nil && !jobQueue([]*job{p.ready[0], next}).Less(0, 1)) {
+					continue
+				}
+				if admit(p) {
+					next = p.ready[0]
+				}
+			}
+			if next == nil {
+				return
+			}
+			heap.Pop(&next.pool.ready)
+			next.pool.running++
+			running++
+			start(next)
+		}
+	}
+	start = func(j *job) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := j.run()
+
+			mu.Lock()
+			defer mu.Unlock()
+			remaining--
+			running--
+			j.pool.running--
+			if ctxErr := ctx.Err(); ctxErr != nil && firstErr == nil {
+				// the job most likely failed because it was cancelled
+				firstErr = ctxErr
+			} else if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			for _, dep := range j.dependents {
+				dep.waiting--
+				if dep.waiting == 0 {
+					heap.Push(&dep.pool.ready, dep)
+				}
+			}
+			dispatch()
+			cond.Broadcast()
+		}()
+	}
+
+	mu.Lock()
+	dispatch()
+	for running > 0 || (remaining > 0 && firstErr == nil) {
+		if running == 0 {
+			// nothing is running and nothing can be started, which can only happen
+			// if the jobs have a dependency cycle
+			firstErr = errors.New("build jobs have a dependency cycle")
+			break
+		}
+		cond.Wait()
+	}
+	mu.Unlock()
+	wg.Wait()
+	return firstErr
+}
+
+// durationLog holds the durations of compiles and links from past builds, keyed by
+// source or binary path. It is used to estimate how long jobs will take.
+type durationLog struct {
+	mu        sync.Mutex
+	path      string
+	durations map[string]time.Duration
+	readOnly  bool
+}
+
+// loadDurations reads the durations saved at path. A missing or unreadable file
+// results in an empty log.
+func loadDurations(path string) *durationLog {
+	d := &durationLog{path: path, durations: make(map[string]time.Duration)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return d
+	}
+	var millis map[string]int64
+	if err := json.Unmarshal(data, &millis); err != nil {
+		return d
+	}
+	for key, ms := range millis {
+		d.durations[key] = time.Duration(ms) * time.Millisecond
+	}
+	return d
+}
+
+func (d *durationLog) get(key string) (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dur, ok := d.durations[key]
+	return dur, ok
+}
+
+func (d *durationLog) set(key string, dur time.Duration) {
+	if d.readOnly {
+		return
+	}
+	d.mu.Lock()
+	d.durations[key] = dur
+	d.mu.Unlock()
+}
+
+func (d *durationLog) save() error {
+	if d.readOnly {
+		return nil
+	}
+	d.mu.Lock()
+	millis := make(map[string]int64, len(d.durations))
+	for key, dur := range d.durations {
+		millis[key] = int64(dur / time.Millisecond)
+	}
+	d.mu.Unlock()
+	data, err := json.Marshal(millis)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.path, data)
+}
+
+// compileEstimates returns the estimated compile time of each source. Sources that
+// have been compiled before use their last compile time, and all others are
+// estimated from their size, using the compile time per byte of the known sources.
+func (d *durationLog) compileEstimates(sources []*File) map[*File]time.Duration {
+	estimates := make(map[*File]time.Duration, len(sources))
+	sizes := make(map[*File]int64)
+	var knownTime time.Duration
+	var knownSize int64
+	for _, source := range sources {
+		var size int64
+		if info, err := os.Stat(source.Path); err == nil {
+			size = info.Size()
+		}
+		if dur, ok := d.get(source.Path); ok {
+			estimates[source] = dur
+			knownTime += dur
+			knownSize += size
+		} else {
+			sizes[source] = size
+		}
+	}
+	rate := defaultCompileRate
+	if knownSize > 0 && knownTime > 0 {
+		rate = knownTime / time.Duration(knownSize)
+	}
+	for source, size := range sizes {
+		estimates[source] = time.Duration(size) * rate
+	}
+	return estimates
+}
+
+// linkEstimate returns the estimated link time of the binary at path.
+func (d *durationLog) linkEstimate(path string) time.Duration {
+	if dur, ok := d.get(path); ok {
+		return dur
+	}
+	return defaultLinkEstimate
+}
+
+func (c *Compiler) durationsPath() string {
+	return filepath.Join(c.OutputDir, "durations.json")
+}
+
+// beginAction starts timing an action that builds key (a source or binary path),
+// recording it in the trace and, if it succeeds, in the durations used to schedule
+// future builds. It returns a function to call with the finished action and its result.
+func (c *Compiler) beginAction(kind, key string) (end func(action *Action, err error)) {
+	endTrace := c.Trace.BeginAction(kind, key)
+	start := time.Now()
+	return func(action *Action, err error) {
+		endTrace(action.CPUTime)
+		if err == nil && c.durations != nil {
+			c.durations.set(key, time.Since(start))
+		}
+	}
+}
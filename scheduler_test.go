@@ -0,0 +1,243 @@
+package cppdep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunJobsOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	newJob := func(name string, estimate time.Duration) *job {
+		return &job{
+			name:     name,
+			estimate: estimate,
+			run: func() error {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				return nil
+			},
+		}
+	}
+
+	// b.o is small, but is needed for the long link of big, so it should be
+	// started before the larger a.o
+	aObj := newJob("a.o", 2*time.Second)
+	bObj := newJob("b.o", time.Second)
+	cObj := newJob("c.o", 5*time.Second)
+	small := newJob("small", time.Second)
+	small.dependsOn(aObj)
+	big := newJob("big", 10*time.Second)
+	big.dependsOn(bObj)
+
+	err := runJobs(context.Background(), []*job{aObj, bObj, cObj, small, big}, 1)
+	expected := []string{"b.o", "big", "c.o", "a.o", "small"}
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %v", err)
+	case !reflect.DeepEqual(order, expected):
+		t.Errorf("jobs not run in the expected order:\n%v\n%v", order, expected)
+	}
+}
+
+func TestRunJobsDependencies(t *testing.T) {
+	var mu sync.Mutex
+	finished := make(map[string]bool)
+	var jobs []*job
+	var objects []*job
+	for _, name := range []string{"a.o", "b.o", "c.o", "d.o"} {
+		name := name
+		j := &job{name: name, run: func() error {
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			finished[name] = true
+			mu.Unlock()
+			return nil
+		}}
+		objects = append(objects, j)
+		jobs = append(jobs, j)
+	}
+	linkRanEarly := false
+	link := &job{name: "main", run: func() error {
+		mu.Lock()
+		linkRanEarly = len(finished) != len(objects)
+		mu.Unlock()
+		return nil
+	}}
+	link.dependsOn(objects...)
+	jobs = append(jobs, link)
+
+	if err := runJobs(context.Background(), jobs, 3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if linkRanEarly {
+		t.Errorf("Expected link to run after all of its objects")
+	}
+}
+
+func TestRunJobsStopsOnError(t *testing.T) {
+	failErr := errors.New("failed")
+	ran := false
+	fail := &job{name: "a.o", estimate: time.Second, run: func() error { return failErr }}
+	link := &job{name: "main", run: func() error { ran = true; return nil }}
+	link.dependsOn(fail)
+	other := &job{name: "b.o", run: func() error { ran = true; return nil }}
+
+	if err := runJobs(context.Background(), []*job{fail, other, link}, 1); err != failErr {
+		t.Errorf("Expected the job error to be returned: %v", err)
+	} else if ran {
+		t.Errorf("Expected no jobs to be started after an error")
+	}
+}
+
+// concurrencyCounter records the highest number of jobs of each pool that ran at
+// the same time.
+type concurrencyCounter struct {
+	mu      sync.Mutex
+	running map[string]int
+	max     map[string]int
+}
+
+func (cc *concurrencyCounter) job(name, pool string, p *jobPool) *job {
+	return &job{name: name, pool: p, run: func() error {
+		cc.mu.Lock()
+		cc.running[pool]++
+		if cc.running[pool] > cc.max[pool] {
+			cc.max[pool] = cc.running[pool]
+		}
+		cc.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		cc.mu.Lock()
+		cc.running[pool]--
+		cc.mu.Unlock()
+		return nil
+	}}
+}
+
+func TestRunJobsPoolLimits(t *testing.T) {
+	cc := &concurrencyCounter{running: make(map[string]int), max: make(map[string]int)}
+	compiles := &jobPool{limit: 3}
+	links := &jobPool{limit: 1}
+	var jobs []*job
+	for i := 0; i < 8; i++ {
+		jobs = append(jobs, cc.job(fmt.Sprintf("%d.o", i), "compile", compiles))
+		jobs = append(jobs, cc.job(fmt.Sprintf("bin%d", i), "link", links))
+	}
+
+	err := runJobs(context.Background(), jobs, 4)
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %v", err)
+	case cc.max["compile"] != 3:
+		t.Errorf("Expected 3 compiles to run at the same time, got %d", cc.max["compile"])
+	case cc.max["link"] != 1:
+		t.Errorf("Expected 1 link to run at a time, got %d", cc.max["link"])
+	}
+}
+
+func TestRunJobsMemoryThrottling(t *testing.T) {
+	defer func(orig func() (uint64, error)) { availableMemory = orig }(availableMemory)
+	// the memory available does not go down as links start, as they allocate
+	// their memory some time after starting
+	availableMemory = func() (uint64, error) { return 10 << 30, nil }
+
+	cc := &concurrencyCounter{running: make(map[string]int), max: make(map[string]int)}
+	links := &jobPool{memory: 4 << 30}
+	var jobs []*job
+	for i := 0; i < 6; i++ {
+		jobs = append(jobs, cc.job(fmt.Sprintf("bin%d", i), "link", links))
+	}
+	if err := runJobs(context.Background(), jobs, 8); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if cc.max["link"] != 2 {
+		t.Errorf("Expected 2 links to fit in the available memory, got %d", cc.max["link"])
+	}
+
+	// a job is started when nothing of its pool is running, even if there is not
+	// enough memory, so that the build can make progress
+	availableMemory = func() (uint64, error) { return 1 << 30, nil }
+	cc = &concurrencyCounter{running: make(map[string]int), max: make(map[string]int)}
+	jobs = nil
+	for i := 0; i < 3; i++ {
+		jobs = append(jobs, cc.job(fmt.Sprintf("bin%d", i), "link", links))
+	}
+	if err := runJobs(context.Background(), jobs, 8); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if cc.max["link"] != 1 {
+		t.Errorf("Expected links to run one at a time, got %d", cc.max["link"])
+	}
+}
+
+func TestDurationLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cppdep_scheduler_test")
+	if err != nil {
+		t.Fatalf("Failed to setup dir")
+	}
+	defer os.RemoveAll(dir)
+
+	small := &File{Path: filepath.Join(dir, "small.cc")}
+	large := &File{Path: filepath.Join(dir, "large.cc")}
+	ioutil.WriteFile(small.Path, make([]byte, 100), 0644)
+	ioutil.WriteFile(large.Path, make([]byte, 1000), 0644)
+
+	path := filepath.Join(dir, "durations.json")
+	d := loadDurations(path)
+	estimates := d.compileEstimates([]*File{small, large})
+	if estimates[small] != 100*defaultCompileRate || estimates[large] != 1000*defaultCompileRate {
+		t.Errorf("Expected estimates from file size: %v", estimates)
+	}
+
+	d.set(small.Path, time.Second)
+	d.set("bin/main", 3*time.Second)
+	if err := d.save(); err != nil {
+		t.Fatalf("Failed to save durations: %v", err)
+	}
+
+	d = loadDurations(path)
+	estimates = d.compileEstimates([]*File{small, large})
+	switch {
+	case estimates[small] != time.Second:
+		t.Errorf("Expected estimate from the saved duration: %v", estimates[small])
+	case estimates[large] != 10*time.Second:
+		t.Errorf("Expected estimate from the compile rate of known files: %v", estimates[large])
+	case d.linkEstimate("bin/main") != 3*time.Second:
+		t.Errorf("Expected link estimate from the saved duration: %v", d.linkEstimate("bin/main"))
+	case d.linkEstimate("bin/other") != defaultLinkEstimate:
+		t.Errorf("Expected default link estimate: %v", d.linkEstimate("bin/other"))
+	}
+}
+
+func TestCompileAllSavesDurations(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+	}
+	st.ProcessDirectory()
+	mainFile := st.FindSource("main")
+
+	c := &Compiler{OutputDir: outputDir, Concurrency: 2}
+	binaryPath, err := c.Compile(mainFile)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+
+	d := loadDurations(c.durationsPath())
+	for _, key := range []string{mainFile.Path, filepath.Join(st.SrcRoot, "a.cc"), binaryPath} {
+		if _, ok := d.get(key); !ok {
+			t.Errorf("Expected a duration to be saved for %q", key)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+#ifndef HEAVY_H
+#define HEAVY_H
+
+#include <string>
+#include <vector>
+
+#define PCH_HEADER_INCLUDED
+
+#endif
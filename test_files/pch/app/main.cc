@@ -0,0 +1,14 @@
+#include <stdio.h>
+
+#include "util.h"
+
+#ifndef PCH_HEADER_INCLUDED
+#error "precompiled header was not force included"
+#endif
+
+int main(int argc, char** argv) {
+  std::vector<std::string> words;
+  words.push_back("Hello");
+  printf("%s %s\n", words[0].c_str(), world());
+  return 0;
+}
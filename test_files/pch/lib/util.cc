@@ -0,0 +1,9 @@
+#include "util.h"
+
+#ifdef PCH_HEADER_INCLUDED
+#error "precompiled header should not be included outside of its scope"
+#endif
+
+const char* world() {
+  return "World!";
+}
@@ -0,0 +1,5 @@
+#include "compress.h"
+
+unsigned long compressBound(int len) {
+  return compressBound((uLong)len);
+}
@@ -0,0 +1,12 @@
+#ifndef COMPRESS_H
+#define COMPRESS_H
+
+#include <zlib.h>
+
+#ifndef PKG_CONFIG_CFLAGS
+#error "cflags from pkg-config were not passed to the compiler"
+#endif
+
+unsigned long compressBound(int len);
+
+#endif
@@ -0,0 +1,9 @@
+#include <stdio.h>
+#include <zlib.h>
+
+#include "compress.h"
+
+int main(int argc, char** argv) {
+  printf("%s %lu\n", zlibVersion(), compressBound(10));
+  return 0;
+}
@@ -0,0 +1,9 @@
+#include <stdio.h>
+
+#include "x.h"
+#include "y.h"
+
+int main(int argc, char** argv) {
+  printf("%s %s\n", x(), y());
+  return 0;
+}
@@ -0,0 +1,8 @@
+#include <stdio.h>
+
+#include "x.h"
+
+int main(int argc, char** argv) {
+  printf("%s\n", x());
+  return 0;
+}
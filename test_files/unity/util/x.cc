@@ -0,0 +1,5 @@
+#include "x.h"
+
+const char* x() {
+  return "Hello";
+}
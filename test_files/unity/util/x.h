@@ -0,0 +1,6 @@
+#ifndef X_H
+#define X_H
+
+const char* x();
+
+#endif
@@ -0,0 +1,5 @@
+#include "y.h"
+
+const char* y() {
+  return "World!";
+}
@@ -0,0 +1,6 @@
+#ifndef Y_H
+#define Y_H
+
+const char* y();
+
+#endif
@@ -0,0 +1,148 @@
+package cppdep
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TestRunner runs test binaries, such as those built with Google Test, and gathers
+// their results.
+type TestRunner struct {
+	// Executor runs the test binaries, LocalExecutor is used if nil.
+	Executor Executor
+
+	// Concurrency is the number of test binaries run at the same time. Default is 1.
+	Concurrency int
+
+	// Timeout when set is how long a test binary may run before it is killed and
+	// fails.
+	Timeout time.Duration
+
+	// Dir is the working directory of the test binaries, if empty the current directory
+	// is used.
+	Dir string
+
+	// OutputDir is where the XML reports of Google Test binaries are written. It is
+	// passed to them through the GTEST_OUTPUT environment variable, which other test
+	// binaries ignore.
+	OutputDir string
+
+	// Progress when set shows which test binaries are running.
+	Progress *Progress
+}
+
+// TestResult is the result of running a test binary.
+type TestResult struct {
+	Name     string // the base name of the binary
+	Path     string
+	Passed   bool
+	TimedOut bool
+	Err      error // why the binary failed, such as its exit status
+	Duration time.Duration
+	Output   []byte // the stdout and stderr of the binary
+
+	// Suites are the test suites reported by a Google Test binary, if any.
+	Suites []JUnitTestSuite
+}
+
+// Run runs the test binaries at paths and returns their results in the same order.
+// A binary passes if it exits with a zero exit status within the Timeout. When ctx is
+// done, running binaries are killed and those not started are not run, and the
+// results of both are left out.
+func (tr *TestRunner) Run(ctx context.Context, paths []string) ([]*TestResult, error) {
+	if err := os.MkdirAll(tr.OutputDir, 0755); err != nil {
+		return nil, err
+	}
+	concurrency := tr.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	tr.Progress.start(len(paths), 0, concurrency)
+
+	results := make([]*TestResult, len(paths))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				results[index] = tr.runTest(ctx, paths[index])
+			}
+		}()
+	}
+	for i := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	tr.Progress.done(ctx.Err() != nil)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (tr *TestRunner) runTest(ctx context.Context, path string) *TestResult {
+	name := filepath.Base(path)
+	result := &TestResult{Name: name, Path: path}
+	xmlPath := filepath.Join(tr.OutputDir, name+".xml")
+	os.Remove(xmlPath)
+
+	testCtx := ctx
+	if tr.Timeout > 0 {
+		var cancel context.CancelFunc
+		testCtx, cancel = context.WithTimeout(ctx, tr.Timeout)
+		defer cancel()
+	}
+	action := &Action{
+		Kind:        TestAction,
+		Description: fmt.Sprintf("Testing: %s", name),
+		Argv:        []string{path},
+		Env:         append(os.Environ(), "GTEST_OUTPUT=xml:"+xmlPath),
+		Dir:         tr.Dir,
+		Outputs:     []string{xmlPath},
+		Context:     testCtx,
+	}
+	ex := tr.Executor
+	if ex == nil {
+		ex = LocalExecutor{}
+	}
+	tr.Progress.status(action.Description)
+	start := time.Now()
+	result.Output, result.Err = runCaptured(ex, action)
+	result.Duration = time.Since(start)
+	if result.Err != nil && testCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		result.TimedOut = true
+		result.Err = fmt.Errorf("timed out after %v", tr.Timeout)
+	}
+	result.Passed = result.Err == nil
+
+	if fp, err := os.Open(xmlPath); err == nil {
+		report, err := readJUnit(fp)
+		fp.Close()
+		if err == nil {
+			result.Suites = report.Suites
+		} else if result.Passed {
+			result.Passed = false
+			result.Err = fmt.Errorf("failed to read test report: %v", err)
+		}
+	}
+	tr.Progress.finish(0, false)
+	return result
+}
+
+// failureMessage returns a short description of why the binary of r failed.
+func (r *TestResult) failureMessage() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	return "failed"
+}
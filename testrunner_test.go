@@ -0,0 +1,100 @@
+package cppdep
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTestRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cppdep_testrunner_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	gtestReport := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites tests="2" failures="1" errors="0" time="0.01" name="AllTests">
+  <testsuite name="MathTest" tests="2" failures="1" errors="0" time="0.01">
+    <testcase name="Adds" status="run" result="completed" time="0" classname="MathTest" />
+    <testcase name="Divides" status="run" result="completed" time="0.01" classname="MathTest">
+      <failure message="math_test.cc:12&#x0A;Expected equality" type=""><![CDATA[math_test.cc:12
+Expected equality]]></failure>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	scripts := map[string]string{
+		"pass_test":  "#!/bin/sh\necho ok\n",
+		"fail_test":  "#!/bin/sh\necho oops\nexit 2\n",
+		"slow_test":  "#!/bin/sh\nsleep 10\n",
+		"gtest_test": "#!/bin/sh\ncat > \"${GTEST_OUTPUT#xml:}\" <<'EOF'\n" + gtestReport + "EOF\nexit 1\n",
+		"pwd_test":   "#!/bin/sh\n[ \"$(pwd)\" = \"" + dir + "\" ]\n",
+	}
+	var paths []string
+	for _, name := range []string{"pass_test", "fail_test", "slow_test", "gtest_test", "pwd_test"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(scripts[name]), 0755); err != nil {
+			t.Fatalf("Failed to write test script: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	tr := &TestRunner{
+		Concurrency: 5,
+		Timeout:     time.Second,
+		Dir:         dir,
+		OutputDir:   filepath.Join(dir, "reports"),
+	}
+	start := time.Now()
+	results, err := tr.Run(context.Background(), paths)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the slow test to be killed after the timeout, took %v", elapsed)
+	}
+	pass, fail, slow, gtest, pwd := results[0], results[1], results[2], results[3], results[4]
+	switch {
+	case !pass.Passed || string(pass.Output) != "ok\n":
+		t.Errorf("Unexpected result of passing test: %+v", pass)
+	case fail.Passed || fail.Err == nil || string(fail.Output) != "oops\n":
+		t.Errorf("Unexpected result of failing test: %+v", fail)
+	case slow.Passed || !slow.TimedOut:
+		t.Errorf("Expected slow test to time out: %+v", slow)
+	case gtest.Passed || len(gtest.Suites) != 1:
+		t.Errorf("Expected the report of the gtest binary to be read: %+v", gtest)
+	case strings.Join(gtest.FailedCases(), ",") != "MathTest.Divides":
+		t.Errorf("Unexpected failed cases: %v", gtest.FailedCases())
+	case !pwd.Passed:
+		t.Errorf("Expected test to run in the test dir: %+v", pwd)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteJUnit(&buf, results); err != nil {
+		t.Fatalf("Failed to write JUnit report: %v", err)
+	}
+	report, err := readJUnit(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read JUnit report: %v\n%s", err, buf.String())
+	}
+	var names []string
+	for _, suite := range report.Suites {
+		names = append(names, suite.Name)
+	}
+	switch {
+	case strings.Join(names, ",") != "pass_test,fail_test,slow_test,gtest_test.MathTest,pwd_test":
+		t.Errorf("Unexpected test suites: %v", names)
+	case report.Tests != 6 || report.Failures != 3:
+		t.Errorf("Unexpected totals: %d tests, %d failures", report.Tests, report.Failures)
+	case !strings.Contains(report.Suites[2].Cases[0].Failures[0].Message, "timed out"):
+		t.Errorf("Expected the failure of the slow test to say it timed out: %+v", report.Suites[2].Cases[0])
+	case report.Suites[3].Cases[1].Failures[0].Text != "math_test.cc:12\nExpected equality":
+		t.Errorf("Expected the gtest failure to be kept: %+v", report.Suites[3].Cases[1])
+	}
+}
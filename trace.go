@@ -0,0 +1,206 @@
+package cppdep
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PhaseCategory is the trace category used for the phases of a build, such as walking
+// the source tree or compiling all objects. Actions are recorded with their Kind as
+// the category.
+const PhaseCategory = "phase"
+
+// TraceEvent is a span of time spent in one phase or action of a build.
+type TraceEvent struct {
+	Category string
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+
+	// CPUTime is the CPU time used by the command of an action, 0 for phases and
+	// actions that did not run a command.
+	CPUTime time.Duration
+
+	// lane is the row the event is drawn in when viewing the trace, so that events
+	// running at the same time do not overlap.
+	lane int
+}
+
+// Trace records the time spent in each phase and action of a build. A nil *Trace
+// is valid and records nothing, so that it does not have to be checked before use.
+type Trace struct {
+	mu     sync.Mutex
+	events []TraceEvent
+	lanes  []bool
+}
+
+func NewTrace() *Trace {
+	return &Trace{}
+}
+
+// Begin starts an event and returns a function that ends it.
+func (t *Trace) Begin(category, name string) (end func()) {
+	endAction := t.BeginAction(category, name)
+	return func() { endAction(0) }
+}
+
+// BeginAction starts an event for an action and returns a function that ends it,
+// which is passed the CPU time used by the command of the action.
+func (t *Trace) BeginAction(category, name string) (end func(cpuTime time.Duration)) {
+	if t == nil {
+		return func(time.Duration) {}
+	}
+	lane := 0
+	if category != PhaseCategory {
+		lane = t.takeLane()
+	}
+	start := time.Now()
+	return func(cpuTime time.Duration) {
+		ev := TraceEvent{
+			Category: category,
+			Name:     name,
+			Start:    start,
+			Duration: time.Since(start),
+			CPUTime:  cpuTime,
+			lane:     lane,
+		}
+		t.mu.Lock()
+		t.events = append(t.events, ev)
+		if lane > 0 {
+			t.lanes[lane-1] = false
+		}
+		t.mu.Unlock()
+	}
+}
+
+// takeLane returns the lowest lane not used by a running action. Lane 0 is reserved
+// for phases.
+func (t *Trace) takeLane() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, used := range t.lanes {
+		if !used {
+			t.lanes[i] = true
+			return i + 1
+		}
+	}
+	t.lanes = append(t.lanes, true)
+	return len(t.lanes)
+}
+
+// Events returns all events that have ended, ordered by start time.
+func (t *Trace) Events() []TraceEvent {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	events := append([]TraceEvent(nil), t.events...)
+	t.mu.Unlock()
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events
+}
+
+type chromeTraceEvent struct {
+	Name     string `json:"name"`
+	Category string `json:"cat"`
+	Phase    string `json:"ph"`
+	Time     int64  `json:"ts"`
+	Duration int64  `json:"dur"`
+	Pid      int    `json:"pid"`
+	Tid      int    `json:"tid"`
+}
+
+// WriteChromeJSON writes the trace in the Chrome trace_event format, which can be
+// viewed with chrome://tracing or https://ui.perfetto.dev.
+func (t *Trace) WriteChromeJSON(w io.Writer) error {
+	events := t.Events()
+	out := struct {
+		TraceEvents []chromeTraceEvent `json:"traceEvents"`
+	}{TraceEvents: []chromeTraceEvent{}}
+	if len(events) > 0 {
+		origin := events[0].Start
+		for _, ev := range events {
+			out.TraceEvents = append(out.TraceEvents, chromeTraceEvent{
+				Name:     ev.Name,
+				Category: ev.Category,
+				Phase:    "X",
+				Time:     int64(ev.Start.Sub(origin) / time.Microsecond),
+				Duration: int64(ev.Duration / time.Microsecond),
+				Pid:      1,
+				Tid:      ev.lane,
+			})
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(out)
+}
+
+// WriteSummary writes a human readable summary of the trace, listing the time spent
+// in each phase, the n slowest compiles and links, the total CPU time used by the
+// commands of actions, and the parallelism achieved: the CPU time divided by the
+// build time.
+func (t *Trace) WriteSummary(w io.Writer, n int) {
+	events := t.Events()
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No build timings recorded")
+		return
+	}
+
+	start, end := events[0].Start, events[0].Start
+	var cpuTime time.Duration
+	var phases, compiles, links []TraceEvent
+	for _, ev := range events {
+		if evEnd := ev.Start.Add(ev.Duration); evEnd.After(end) {
+			end = evEnd
+		}
+		switch ev.Category {
+		case PhaseCategory:
+			phases = append(phases, ev)
+			continue
+		case CompileAction:
+			compiles = append(compiles, ev)
+		case LinkAction:
+			links = append(links, ev)
+		}
+		cpuTime += ev.CPUTime
+	}
+	wall := end.Sub(start)
+	parallelism := 0.0
+	if wall > 0 {
+		parallelism = float64(cpuTime) / float64(wall)
+	}
+
+	fmt.Fprintf(w, "Build time: %s, CPU time: %s, parallelism: %.1fx\n",
+		formatDuration(wall), formatDuration(cpuTime), parallelism)
+	if len(phases) > 0 {
+		fmt.Fprintln(w, "Phases:")
+		for _, ev := range phases {
+			fmt.Fprintf(w, "  %8s  %s\n", formatDuration(ev.Duration), ev.Name)
+		}
+	}
+	writeSlowest(w, "Slowest translation units:", compiles, n)
+	writeSlowest(w, "Slowest links:", links, n)
+}
+
+func writeSlowest(w io.Writer, title string, events []TraceEvent, n int) {
+	if len(events) == 0 {
+		return
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Duration > events[j].Duration })
+	if len(events) > n {
+		events = events[:n]
+	}
+	fmt.Fprintln(w, title)
+	for _, ev := range events {
+		fmt.Fprintf(w, "  %8s  %s\n", formatDuration(ev.Duration), ev.Name)
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%.2fs", d.Seconds())
+}
@@ -0,0 +1,143 @@
+package cppdep
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceLanes(t *testing.T) {
+	trace := NewTrace()
+	endPhase := trace.Begin(PhaseCategory, "compile")
+	endA := trace.Begin(CompileAction, "a.cc")
+	endB := trace.Begin(CompileAction, "b.cc")
+	endA()
+	endC := trace.Begin(CompileAction, "c.cc")
+	endB()
+	endC()
+	endPhase()
+
+	lanes := make(map[string]int)
+	for _, ev := range trace.Events() {
+		lanes[ev.Name] = ev.lane
+	}
+	switch {
+	case len(lanes) != 4:
+		t.Fatalf("Expected 4 events: %v", lanes)
+	case lanes["compile"] != 0:
+		t.Errorf("Expected phase to be in lane 0: %d", lanes["compile"])
+	case lanes["a.cc"] != 1 || lanes["b.cc"] != 2:
+		t.Errorf("Expected concurrent actions in separate lanes: %v", lanes)
+	case lanes["c.cc"] != 1:
+		t.Errorf("Expected c.cc to reuse the lane a.cc finished with: %d", lanes["c.cc"])
+	}
+
+	var nilTrace *Trace
+	nilTrace.Begin(PhaseCategory, "walk")()
+	if events := nilTrace.Events(); events != nil {
+		t.Errorf("Expected nil trace to record nothing: %v", events)
+	}
+}
+
+func TestTraceChromeJSON(t *testing.T) {
+	trace := NewTrace()
+	end := trace.Begin(LinkAction, "bin/main")
+	time.Sleep(2 * time.Millisecond)
+	end()
+
+	buf := &bytes.Buffer{}
+	if err := trace.WriteChromeJSON(buf); err != nil {
+		t.Fatalf("Failed to write trace: %v", err)
+	}
+	var out struct {
+		TraceEvents []map[string]interface{} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("Failed to parse trace: %v", err)
+	}
+	switch {
+	case len(out.TraceEvents) != 1:
+		t.Fatalf("Expected a single event: %v", out.TraceEvents)
+	case out.TraceEvents[0]["name"] != "bin/main" || out.TraceEvents[0]["cat"] != LinkAction:
+		t.Errorf("Event name or category not as expected: %v", out.TraceEvents[0])
+	case out.TraceEvents[0]["ph"] != "X":
+		t.Errorf("Expected a complete event: %v", out.TraceEvents[0])
+	case out.TraceEvents[0]["dur"].(float64) < 2000:
+		t.Errorf("Expected duration in microseconds: %v", out.TraceEvents[0]["dur"])
+	}
+}
+
+func TestTraceSummaryCPUTime(t *testing.T) {
+	start := time.Now()
+	trace := NewTrace()
+	trace.events = []TraceEvent{
+		{Category: PhaseCategory, Name: "compile and link", Start: start, Duration: 2 * time.Second},
+		{Category: CompileAction, Name: "a.cc", Start: start, Duration: 2 * time.Second, CPUTime: 1500 * time.Millisecond},
+		{Category: CompileAction, Name: "b.cc", Start: start, Duration: 2 * time.Second, CPUTime: 1500 * time.Millisecond},
+	}
+
+	buf := &bytes.Buffer{}
+	trace.WriteSummary(buf, 10)
+	if exp := "Build time: 2.00s, CPU time: 3.00s, parallelism: 1.5x\n"; !strings.HasPrefix(buf.String(), exp) {
+		t.Errorf("Expected summary to start with %q:\n%s", exp, buf.String())
+	}
+}
+
+func TestCompileAllTrace(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "cppdep_compile_test")
+	if err != nil {
+		t.Fatalf("Failed to setup output dir")
+	}
+	defer os.RemoveAll(outputDir)
+
+	trace := NewTrace()
+	st := SourceTree{
+		SrcRoot: "test_files/simple",
+		Trace:   trace,
+	}
+	st.ProcessDirectory()
+
+	c := &Compiler{OutputDir: outputDir, Concurrency: 2, Trace: trace}
+	if _, err := c.CompileAll([]*File{st.FindSource("main"), st.FindSource("mainb")}); err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+
+	phases := make(map[string]int)
+	counts := make(map[string]int)
+	var cpuTime time.Duration
+	for _, ev := range trace.Events() {
+		if ev.Category == PhaseCategory {
+			phases[ev.Name]++
+		} else {
+			counts[ev.Category]++
+		}
+		cpuTime += ev.CPUTime
+	}
+	if cpuTime <= 0 {
+		t.Errorf("Expected the CPU time of the compiles and links to be recorded")
+	}
+	for _, phase := range []string{"walk", "generate", "scan", "compile and link"} {
+		if phases[phase] != 1 {
+			t.Errorf("Expected the %s phase to be recorded once: %d", phase, phases[phase])
+		}
+	}
+	switch {
+	case counts[CompileAction] != 3:
+		t.Errorf("Expected 3 compiles to be recorded: %d", counts[CompileAction])
+	case counts[LinkAction] != 2:
+		t.Errorf("Expected 2 links to be recorded: %d", counts[LinkAction])
+	}
+
+	buf := &bytes.Buffer{}
+	trace.WriteSummary(buf, 10)
+	summary := buf.String()
+	for _, expected := range []string{"CPU time:", "parallelism", "Slowest translation units:", "main.cc", "Slowest links:", "bin/mainb"} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("Expected summary to contain %q:\n%s", expected, summary)
+		}
+	}
+}
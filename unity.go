@@ -0,0 +1,216 @@
+package cppdep
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// UnityBuild configures compiling batches of source files together as a single
+// translation unit. For each batch an amalgamated source file that includes every
+// source in the batch is written to Dir, and that file is compiled in place of the
+// individual sources.
+type UnityBuild struct {
+	// Dir is the directory the amalgamated source files are written to, this is
+	// normally a directory within SourceTree.GenDir().
+	Dir string
+
+	// BatchSize is the maximum number of sources included in each amalgamated source
+	// file. Default is 8.
+	BatchSize int
+
+	// PerDirectory will batch together the sources found in the same directory, rather
+	// than the sources of each binary. The main files of the binaries being compiled are
+	// always compiled on their own in this mode.
+	PerDirectory bool
+
+	// Excludes are patterns (as defined by filepath.Match) of sources that should always
+	// be compiled on their own. A pattern is matched against both the base name and the
+	// full path of a source.
+	Excludes []string
+}
+
+func (u *UnityBuild) excluded(file *File) bool {
+	for _, pattern := range u.Excludes {
+		if matched, _ := filepath.Match(pattern, filepath.Base(file.Path)); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, file.Path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *UnityBuild) batchSize() int {
+	if u.BatchSize <= 0 {
+		return 8
+	}
+	return u.BatchSize
+}
+
+// unityFiles splits sources into batches and returns a File for the amalgamated source
+// of each batch. Sources in batches of one are returned in singles rather than being
+// amalgamated. The amalgamated sources are only written if their contents change, so
+// that they are not needlessly recompiled.
+func (u *UnityBuild) unityFiles(name string, sources []*File) (unityFiles, singles []*File, err error) {
+	batchSize := u.batchSize()
+	for i := 0; i < len(sources); i += batchSize {
+		end := i + batchSize
+		if end > len(sources) {
+			end = len(sources)
+		}
+		batch := sources[i:end]
+		if len(batch) == 1 {
+			singles = append(singles, batch[0])
+			continue
+		}
+
+		path := filepath.Join(u.Dir, fmt.Sprintf("unity_%s_%d.cc", name, i/batchSize))
+		var contents strings.Builder
+		for _, source := range batch {
+			fmt.Fprintf(&contents, "#include %q\n", source.Path)
+		}
+		if err := writeIfChanged(path, contents.String()); err != nil {
+			return nil, nil, err
+		}
+		unityFile := &File{
+			Path:         path,
+			Type:         SourceType,
+			Deps:         batch,
+			unitySources: batch,
+			stMu:         batch[0].stMu,
+		}
+		unityFiles = append(unityFiles, unityFile)
+	}
+	return unityFiles, singles, nil
+}
+
+func writeIfChanged(path, contents string) error {
+	if current, err := ioutil.ReadFile(path); err == nil && string(current) == contents {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(contents), 0644)
+}
+
+// unitySources replaces the sources needed by each binary with the amalgamated sources
+// that include them. The libraries needed by any extra sources that end up being linked
+// into a binary (when batching per directory) are returned in extraLibs.
+func (c *Compiler) unitySources(files []*File, fileSources [][]*File) (newSources [][]*File, extraLibs [][]string, err error) {
+	u := c.Unity
+	if err := os.MkdirAll(u.Dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	if !u.PerDirectory {
+		for i, file := range files {
+			var batchable, sources []*File
+			for _, source := range fileSources[i] {
+				if u.excluded(source) {
+					sources = append(sources, source)
+				} else {
+					batchable = append(batchable, source)
+				}
+			}
+			sort.Sort(ByBase(batchable))
+			unityFiles, singles, err := u.unityFiles(binaryName(file), batchable)
+			if err != nil {
+				return nil, nil, err
+			}
+			sources = append(sources, singles...)
+			sources = append(sources, unityFiles...)
+			newSources = append(newSources, sources)
+			extraLibs = append(extraLibs, nil)
+		}
+		return newSources, extraLibs, nil
+	}
+
+	mainFiles := make(map[*File]struct{})
+	for _, file := range files {
+		mainFiles[file] = struct{}{}
+	}
+	dirSources := make(map[string][]*File)
+	seen := make(map[*File]struct{})
+	for _, sources := range fileSources {
+		for _, source := range sources {
+			if _, ok := seen[source]; ok {
+				continue
+			}
+			seen[source] = struct{}{}
+			if _, ok := mainFiles[source]; ok || u.excluded(source) {
+				continue
+			}
+			dir := filepath.Dir(source.Path)
+			dirSources[dir] = append(dirSources[dir], source)
+		}
+	}
+
+	var dirs []string
+	for dir := range dirSources {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	batchOf := make(map[*File]*File)
+	for _, dir := range dirs {
+		sources := dirSources[dir]
+		sort.Sort(ByBase(sources))
+		dirHash := sha1.Sum([]byte(dir))
+		name := fmt.Sprintf("%s_%x", filepath.Base(dir), dirHash[:4])
+		unityFiles, _, err := u.unityFiles(name, sources)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, unityFile := range unityFiles {
+			for _, source := range unityFile.unitySources {
+				batchOf[source] = unityFile
+			}
+		}
+	}
+
+	// Every source in a batch is linked into a binary that needs any source of the batch,
+	// so the sources and libraries those extra sources depend on must be linked as well.
+	for _, sources := range fileSources {
+		needed := make(map[*File]struct{})
+		added := make(map[*File]struct{})
+		var binSources []*File
+		var libs []string
+		queue := append([]*File{}, sources...)
+		for _, source := range sources {
+			needed[source] = struct{}{}
+		}
+		for len(queue) > 0 {
+			source := queue[0]
+			queue = queue[1:]
+			object := source
+			if unityFile, ok := batchOf[source]; ok {
+				object = unityFile
+			}
+			if _, ok := added[object]; ok {
+				continue
+			}
+			added[object] = struct{}{}
+			binSources = append(binSources, object)
+			for _, member := range object.unitySources {
+				if _, ok := needed[member]; ok {
+					continue
+				}
+				needed[member] = struct{}{}
+				memberSources, memberLibs := filterDeps(append(member.DepListFollowSource(), member))
+				libs = append(libs, memberLibs...)
+				for _, memberSource := range memberSources {
+					if _, ok := needed[memberSource]; !ok {
+						needed[memberSource] = struct{}{}
+						queue = append(queue, memberSource)
+					}
+				}
+			}
+		}
+		newSources = append(newSources, binSources)
+		extraLibs = append(extraLibs, libs)
+	}
+	return newSources, extraLibs, nil
+}